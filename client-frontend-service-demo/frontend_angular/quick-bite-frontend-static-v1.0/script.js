@@ -633,7 +633,7 @@ function displayOrderConfirmation(order) {
         </div>
         <div class="confirmation-item">
             <span><strong>Delivery Address:</strong></span>
-            <span>${order.address}</span>
+            <span>${formatAddress(order.address)}</span>
         </div>
         <div class="confirmation-item">
             <span><strong>Order Date:</strong></span>
@@ -772,6 +772,26 @@ function formatOrderStatus(status) {
   }
 }
 
+// Format a delivery address on one line, e.g. "123 Main St, Floor 2, 10115 City".
+// order-service returns an object; older orders and mock data have a string.
+function formatAddress(address) {
+  if (!address || typeof address === "string") {
+    return address || "";
+  }
+  const parts = [[address.number, address.street].filter(Boolean).join(" ")];
+  if (address.floor) {
+    parts.push(`Floor ${address.floor}`);
+  }
+  if (address.entrance) {
+    parts.push(`Entrance ${address.entrance}`);
+  }
+  const city = [address.postcode, address.city].filter(Boolean).join(" ");
+  if (city) {
+    parts.push(city);
+  }
+  return parts.join(", ");
+}
+
 // Get restaurant name by ID (mock function)
 function getRestaurantName(restaurantId) {
   // In a real app, this would fetch from cache or API
@@ -869,7 +889,9 @@ function displayOrderDetails(order) {
                 <div><strong>Date:</strong> ${new Date(
                   order.createdAt
                 ).toLocaleString()}</div>
-                <div><strong>Delivery Address:</strong> ${order.address}</div>
+                <div><strong>Delivery Address:</strong> ${formatAddress(
+                  order.address
+                )}</div>
             </div>
             
             <h3>Order Items</h3>
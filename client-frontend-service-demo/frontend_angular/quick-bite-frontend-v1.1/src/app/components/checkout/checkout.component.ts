@@ -19,6 +19,8 @@ export class CheckoutComponent implements OnInit {
   deliveryAddress = '';
   paymentMethod = 'card';
   loading = false;
+  // Reused when the same checkout is submitted again, so retries don't duplicate the order
+  private idempotencyKey = crypto.randomUUID();
 
   constructor(
     private router: Router,
@@ -68,9 +70,10 @@ export class CheckoutComponent implements OnInit {
 
     this.loading = true;
 
-    this.apiService.createOrder(order as Order).subscribe({
+    this.apiService.createOrder(order as Order, this.idempotencyKey).subscribe({
       next: (createdOrder) => {
         this.loading = false;
+        this.idempotencyKey = crypto.randomUUID();
         // Clear cart
         this.cartService.clearCart();
         // Navigate to order confirmation
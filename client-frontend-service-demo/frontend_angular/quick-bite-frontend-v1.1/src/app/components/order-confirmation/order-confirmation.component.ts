@@ -2,7 +2,7 @@ import { Component, OnInit } from '@angular/core';
 import { CommonModule } from '@angular/common';
 import { Router, ActivatedRoute } from '@angular/router';
 import { ApiService } from '../../services/api.service';
-import { Order } from '../../models/order.model';
+import { Order, formatAddress } from '../../models/order.model';
 
 @Component({
   selector: 'app-order-confirmation',
@@ -14,6 +14,7 @@ import { Order } from '../../models/order.model';
 export class OrderConfirmationComponent implements OnInit {
   order: Order | null = null;
   loading = true;
+  formatAddress = formatAddress;
 
   constructor(
     private route: ActivatedRoute,
@@ -2,7 +2,7 @@ import { Component, OnInit } from '@angular/core';
 import { CommonModule } from '@angular/common';
 import { RouterModule } from '@angular/router';
 import { ApiService } from '../../services/api.service';
-import { Order } from '../../models/order.model';
+import { Order, formatAddress } from '../../models/order.model';
 
 @Component({
   selector: 'app-orders',
@@ -14,6 +14,7 @@ import { Order } from '../../models/order.model';
 export class OrdersComponent implements OnInit {
   orders: Order[] = [];
   loading = true;
+  formatAddress = formatAddress;
 
   constructor(private apiService: ApiService) {}
 
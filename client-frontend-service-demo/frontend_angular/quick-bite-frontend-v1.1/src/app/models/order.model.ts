@@ -3,18 +3,234 @@ export interface Order {
   userId: number;
   restaurantId: number;
   items: OrderItem[];
+  promoCode?: string;
+  currency?: string; // ISO 4217 code of every amount in the order
+  subtotal?: number; // items before discounts
+  discounts?: AppliedDiscount[];
+  tip?: number;
+  pricing?: PriceBreakdown; // how totalAmount adds up
+  cancelledItems?: ItemCancellation[]; // items taken off after the order was placed
   totalAmount: number;
   status: string;
-  address: string;
+  acceptance?: RestaurantAcceptance; // the restaurant's decision once the order is paid
+  eta?: OrderETA; // when the order should arrive, unset once cancelled
+  group?: OrderGroup; // set for orders submitted from a group session
+  address: DeliveryAddress | string; // order-service always returns an object, a string is parsed on create
+  addressId?: number; // the saved address it was delivered to
+  scheduledFor?: string; // requested delivery time for scheduled orders
   createdAt: string;
   updatedAt?: string;
 }
 
+export interface OrderPage {
+  items: Order[];
+  nextCursor: string | null;
+}
+
+export interface AppliedDiscount {
+  code: string;
+  type: string;
+  description: string;
+  amount: number;
+}
+
+export interface PriceLine {
+  type: string; // items, discount, delivery_fee, small_basket_fee, service_fee, tip
+  description: string;
+  amount: number; // negative for discounts
+  vatRate: number;
+}
+
+export interface TaxLine {
+  rate: number;
+  net: number;
+  vat: number;
+  gross: number;
+}
+
+export interface PriceBreakdown {
+  lines: PriceLine[];
+  taxes: TaxLine[];
+  total: number;
+}
+
+export interface RestaurantAcceptance {
+  deadline: string; // rejected automatically if not accepted by then
+  acceptedAt?: string;
+  prepTimeMinutes?: number;
+  readyAt?: string;
+  rejectedAt?: string;
+  rejectReason?: string;
+}
+
+// A shared cart that participants join with its code
+export interface GroupSession {
+  code: string;
+  hostUserId: number;
+  restaurantId: number;
+  address: DeliveryAddress;
+  addressId?: number;
+  status: 'open' | 'locked' | 'submitted';
+  participants: GroupParticipant[];
+  orderId?: number; // set once submitted
+  createdAt: string;
+  updatedAt: string;
+}
+
+export interface GroupParticipant {
+  userId: number;
+  name?: string;
+  items: OrderItem[];
+  subtotal: number;
+  joinedAt: string;
+}
+
+export interface OrderGroup {
+  code: string;
+  hostUserId: number;
+  shares: PaymentShare[];
+}
+
+// What one participant pays for a group order
+export interface PaymentShare {
+  userId: number;
+  subtotal: number; // their items
+  amount: number; // their part of the order total
+}
+
+// Combines the restaurant's prep time with the courier's delivery estimate
+export interface OrderETA {
+  estimatedAt: string; // when the order should arrive
+  readyAt: string; // when the food should be ready for pickup
+  deliveryMinutes: number;
+  courierAssigned: boolean;
+  basis: 'estimated' | 'scheduled' | 'restaurant' | 'in_transit' | 'delivered';
+  pickedUpAt?: string;
+  deliveredAt?: string;
+  updatedAt: string;
+}
+
+export interface ItemCancellation {
+  id: number; // numbers the cancellations of an order from 1
+  menuItemId: number;
+  name: string;
+  options?: SelectedOption[]; // of the line the units were taken from
+  instructions?: string;
+  quantity: number;
+  refund: number;
+  actor: string;
+  reason?: string;
+  at: string;
+}
+
+// One difference between a past order and its reorder
+export interface ReorderChange {
+  menuItemId: number;
+  name: string;
+  quantity: number;
+  change: 'unavailable' | 'price_changed' | 'renamed';
+  oldPrice?: number;
+  newPrice?: number;
+  newName?: string;
+}
+
+// A past order rebuilt against the current menu, not placed yet
+export interface ReorderDraft {
+  order: Order;
+  changes: ReorderChange[];
+  previousTotal: number;
+}
+
+// A status change pushed by GET /api/orders/{id}/events
+export interface OrderStatusEvent {
+  id: number;
+  orderId: number;
+  userId: number;
+  from: string;
+  status: string;
+  actor: string;
+  reason?: string;
+  at: string;
+}
+
 export interface OrderItem {
   menuItemId: number;
   name: string;
-  price: number;
+  price: number; // of one unit, options included
   quantity: number;
+  options?: SelectedOption[];
+  instructions?: string; // free text for the kitchen
+}
+
+// An option chosen on an order line; send groupId and optionId, the rest is
+// filled in from the menu
+export interface SelectedOption {
+  groupId: number;
+  optionId: number;
+  group?: string;
+  name?: string;
+  priceDelta?: number;
+}
+
+// Where an order is delivered. lat and lng are set when the address was
+// located, by a pin the user dropped or by order-service's gazetteer.
+export interface DeliveryAddress {
+  street: string;
+  number?: string;
+  floor?: string;
+  entrance?: string;
+  city?: string;
+  postcode?: string;
+  lat?: number;
+  lng?: number;
+  precision?: 'client' | 'street' | 'postcode' | 'city';
+  notes?: string; // for the courier
+}
+
+// An entry of a user's address book
+export interface SavedAddress {
+  id?: number;
+  userId?: number;
+  label?: string; // e.g. Home, Work
+  address: DeliveryAddress;
+  isDefault?: boolean; // used when an order names no address
+  createdAt?: string;
+  updatedAt?: string;
+}
+
+// The address on one line, e.g. "123 Main St, Floor 2, 10115 City"
+export function formatAddress(address: DeliveryAddress | string): string {
+  if (typeof address === 'string') {
+    return address;
+  }
+  const parts = [[address.number, address.street].filter(Boolean).join(' ')];
+  if (address.floor) {
+    parts.push(`Floor ${address.floor}`);
+  }
+  if (address.entrance) {
+    parts.push(`Entrance ${address.entrance}`);
+  }
+  const city = [address.postcode, address.city].filter(Boolean).join(' ');
+  if (city) {
+    parts.push(city);
+  }
+  return parts.join(', ');
+}
+
+// A user's cart as kept by order-service, so it follows them across devices
+export interface Cart {
+  userId: number;
+  restaurantId?: number; // unset while the cart is empty
+  items: OrderItem[];
+  createdAt: string;
+  updatedAt: string;
+  expiresAt: string; // emptied if not touched by then
+}
+
+// A cart checked against the restaurant's current menu
+export interface CartView extends Cart {
+  quote?: Order; // the cart priced as an order
+  changes: ReorderChange[]; // menu changes since the items were added
 }
 
 export interface CartItem {
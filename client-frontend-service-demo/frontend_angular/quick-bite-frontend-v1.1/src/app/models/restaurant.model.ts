@@ -3,7 +3,9 @@ export interface Restaurant {
   name: string;
   address: string;
   cuisine: string;
-  rating: number;
+  rating: number; // time-weighted average food score of the published reviews, 0 until the first
+  deliveryRating?: number;
+  reviewCount?: number;
   menuItems?: MenuItem[];
 }
 
@@ -12,5 +14,46 @@ export interface MenuItem {
   name: string;
   description: string;
   price: number;
+  currency?: string; // ISO 4217 code of price
   category: string;
+  optionGroups?: OptionGroup[]; // sizes, extras and removals the customer can choose
+}
+
+// A choice on a menu item; pick between minSelect and maxSelect (0 for no limit) options
+export interface OptionGroup {
+  id: number;
+  name: string;
+  minSelect: number;
+  maxSelect: number;
+  options: MenuOption[];
+}
+
+export interface MenuOption {
+  id: number;
+  name: string;
+  priceDelta: number;
+  default?: boolean; // chosen when nothing is picked from the group
+}
+
+export type ReviewStatus = 'pending' | 'published' | 'rejected';
+
+// A customer's rating of a delivered order, one per order
+export interface Review {
+  id?: number;
+  restaurantId?: number;
+  orderId: number;
+  userId: number;
+  foodScore: number; // 1 to 5
+  deliveryScore: number; // 1 to 5
+  text?: string;
+  photos?: string[]; // references to photos uploaded elsewhere
+  status?: ReviewStatus; // reviews with text or photos stay pending until moderated
+  moderationNote?: string;
+  createdAt?: string;
+  updatedAt?: string;
+}
+
+export interface ReviewPage {
+  items: Review[];
+  nextCursor: string | null;
 }
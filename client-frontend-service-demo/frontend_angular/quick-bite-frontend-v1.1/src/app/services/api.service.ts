@@ -1,9 +1,9 @@
 import { Injectable } from '@angular/core';
-import { HttpClient } from '@angular/common/http';
-import { Observable } from 'rxjs';
+import { HttpClient, HttpHeaders } from '@angular/common/http';
+import { Observable, map } from 'rxjs';
 import { User } from '../models/user.model';
-import { Restaurant, MenuItem } from '../models/restaurant.model';
-import { Order } from '../models/order.model';
+import { Restaurant, MenuItem, Review, ReviewPage } from '../models/restaurant.model';
+import { Cart, CartView, DeliveryAddress, GroupSession, Order, OrderItem, OrderPage, OrderStatusEvent, ReorderDraft, SavedAddress, SelectedOption } from '../models/order.model';
 import { ConfigService } from './config.service';
 
 @Injectable({
@@ -17,6 +17,10 @@ export class ApiService {
       users: `${this.config.getApiBaseUrl()}/api/users`,
       restaurants: `${this.config.getRestaurantsServiceUrl()}/api/restaurants`,
       orders: `${this.config.getOrdersServiceUrl()}/api/orders`,
+      groupOrders: `${this.config.getOrdersServiceUrl()}/api/group-orders`,
+      carts: `${this.config.getOrdersServiceUrl()}/api/carts`,
+      addressBook: `${this.config.getOrdersServiceUrl()}/api/address-book`,
+      geocode: `${this.config.getOrdersServiceUrl()}/api/geocode`,
       payments: `${this.config.getPaymentsServiceUrl()}/api/payments`,
       deliveries: `${this.config.getDeliveriesServiceUrl()}/api/deliveries`,
       notifications: `${this.config.getNotificationsServiceUrl()}/api/notifications`,
@@ -41,18 +45,176 @@ export class ApiService {
     );
   }
 
+  // Review API calls
+  // Published reviews, newest first; pass the page's nextCursor for the next one
+  getRestaurantReviews(restaurantId: number, cursor?: string): Observable<ReviewPage> {
+    const query = cursor ? `?cursor=${encodeURIComponent(cursor)}` : '';
+    return this.http.get<ReviewPage>(
+      `${this.API_ENDPOINTS.restaurants}/${restaurantId}/reviews${query}`
+    );
+  }
+
+  // Only delivered orders can be reviewed, once
+  createReview(restaurantId: number, review: Review): Observable<Review> {
+    return this.http.post<Review>(
+      `${this.API_ENDPOINTS.restaurants}/${restaurantId}/reviews`,
+      review
+    );
+  }
+
   // Order API calls
+  // Returns the most recent page of the user's orders, newest first
   getOrders(userId: number): Observable<Order[]> {
-    return this.http.get<Order[]>(
-      `${this.API_ENDPOINTS.orders}/user/${userId}/orders`
-    );
+    return this.http
+      .get<OrderPage>(`${this.API_ENDPOINTS.orders}/user/${userId}/orders`)
+      .pipe(map((page) => page.items));
   }
 
   getOrderById(orderId: number): Observable<Order> {
     return this.http.get<Order>(`${this.API_ENDPOINTS.orders}/${orderId}`);
   }
 
-  createOrder(order: Order): Observable<Order> {
-    return this.http.post<Order>(this.API_ENDPOINTS.orders, order);
+  // Retrying with the same idempotencyKey returns the original order instead of creating a new one
+  createOrder(order: Order, idempotencyKey?: string): Observable<Order> {
+    const headers = idempotencyKey
+      ? new HttpHeaders({ 'Idempotency-Key': idempotencyKey })
+      : undefined;
+    return this.http.post<Order>(this.API_ENDPOINTS.orders, order, { headers });
+  }
+
+  // Only allowed before the order is paid; the order comes back re-priced
+  updateOrderItems(orderId: number, items: OrderItem[]): Observable<Order> {
+    return this.http.patch<Order>(`${this.API_ENDPOINTS.orders}/${orderId}/items`, { items });
+  }
+
+  // A draft with the items of a past order at today's prices; place it with createOrder
+  reorder(orderId: number, userId: number): Observable<ReorderDraft> {
+    return this.http.post<ReorderDraft>(`${this.API_ENDPOINTS.orders}/${orderId}/reorder`, { userId });
+  }
+
+  // Cart API calls
+  getCart(userId: number): Observable<CartView> {
+    return this.http.get<CartView>(`${this.API_ENDPOINTS.carts}/${userId}`);
+  }
+
+  // Adds an item or sets its quantity. Items from another restaurant are
+  // refused with 409 unless replace is set, which empties the cart first.
+  // The same item with other options or instructions is a separate line.
+  setCartItem(
+    userId: number,
+    restaurantId: number,
+    menuItemId: number,
+    quantity: number,
+    replace = false,
+    options: SelectedOption[] = [],
+    instructions = ''
+  ): Observable<Cart> {
+    return this.http.put<Cart>(`${this.API_ENDPOINTS.carts}/${userId}/items/${menuItemId}`, {
+      restaurantId,
+      quantity,
+      options,
+      instructions,
+      replace,
+    });
+  }
+
+  removeCartItem(userId: number, menuItemId: number): Observable<Cart> {
+    return this.http.delete<Cart>(`${this.API_ENDPOINTS.carts}/${userId}/items/${menuItemId}`);
+  }
+
+  clearCart(userId: number): Observable<void> {
+    return this.http.delete<void>(`${this.API_ENDPOINTS.carts}/${userId}`);
+  }
+
+  // Places the cart as an order and empties it. Send an address or the
+  // addressId of a saved one; with neither the user's default address is used.
+  checkoutCart(userId: number, checkout: { address?: DeliveryAddress | string; addressId?: number; tip?: number; promoCode?: string; scheduledFor?: string }, idempotencyKey?: string): Observable<Order> {
+    const headers = idempotencyKey
+      ? new HttpHeaders({ 'Idempotency-Key': idempotencyKey })
+      : undefined;
+    return this.http.post<Order>(`${this.API_ENDPOINTS.carts}/${userId}/checkout`, checkout, { headers });
+  }
+
+  // Address book API calls
+  getSavedAddresses(userId: number): Observable<SavedAddress[]> {
+    return this.http.get<SavedAddress[]>(`${this.API_ENDPOINTS.addressBook}/${userId}`);
+  }
+
+  // The first address saved becomes the default
+  saveAddress(userId: number, saved: SavedAddress): Observable<SavedAddress> {
+    if (saved.id) {
+      return this.http.put<SavedAddress>(`${this.API_ENDPOINTS.addressBook}/${userId}/${saved.id}`, saved);
+    }
+    return this.http.post<SavedAddress>(`${this.API_ENDPOINTS.addressBook}/${userId}`, saved);
+  }
+
+  deleteAddress(userId: number, addressId: number): Observable<void> {
+    return this.http.delete<void>(`${this.API_ENDPOINTS.addressBook}/${userId}/${addressId}`);
+  }
+
+  // Where order-service would locate an address, without saving it
+  geocodeAddress(address: DeliveryAddress): Observable<DeliveryAddress> {
+    return this.http.post<DeliveryAddress>(this.API_ENDPOINTS.geocode, address);
+  }
+
+  // Group order API calls
+  createGroupOrder(hostUserId: number, restaurantId: number, address: DeliveryAddress | string | number, name?: string): Observable<GroupSession> {
+    const body = typeof address === 'number'
+      ? { hostUserId, restaurantId, addressId: address, name }
+      : { hostUserId, restaurantId, address, name };
+    return this.http.post<GroupSession>(this.API_ENDPOINTS.groupOrders, body);
+  }
+
+  getGroupOrder(code: string): Observable<GroupSession> {
+    return this.http.get<GroupSession>(`${this.API_ENDPOINTS.groupOrders}/${code}`);
+  }
+
+  joinGroupOrder(code: string, userId: number, name?: string): Observable<GroupSession> {
+    return this.http.post<GroupSession>(`${this.API_ENDPOINTS.groupOrders}/${code}/join`, { userId, name });
+  }
+
+  // Replaces the participant's items; an empty list clears them
+  setGroupItems(code: string, userId: number, items: OrderItem[]): Observable<GroupSession> {
+    return this.http.put<GroupSession>(`${this.API_ENDPOINTS.groupOrders}/${code}/participants/${userId}/items`, { items });
+  }
+
+  lockGroupOrder(code: string, hostUserId: number): Observable<GroupSession> {
+    return this.http.put<GroupSession>(`${this.API_ENDPOINTS.groupOrders}/${code}/lock`, { hostUserId });
+  }
+
+  unlockGroupOrder(code: string, hostUserId: number): Observable<GroupSession> {
+    return this.http.put<GroupSession>(`${this.API_ENDPOINTS.groupOrders}/${code}/unlock`, { hostUserId });
+  }
+
+  // The order waits until every participant has paid their share in order.group.shares
+  submitGroupOrder(code: string, hostUserId: number, tip?: number, promoCode?: string): Observable<Order> {
+    return this.http.post<Order>(`${this.API_ENDPOINTS.groupOrders}/${code}/submit`, { hostUserId, tip, promoCode });
+  }
+
+  // The host pays the shares that are still open with one payment
+  coverGroupOrder(code: string, hostUserId: number): Observable<any> {
+    return this.http.post<any>(`${this.API_ENDPOINTS.groupOrders}/${code}/cover`, { hostUserId });
+  }
+
+  // Live status changes of an order instead of polling getOrderById. The
+  // browser reconnects on its own and resumes after the last event it saw.
+  orderStatusEvents(orderId: number): Observable<OrderStatusEvent> {
+    return this.statusEvents(`${this.API_ENDPOINTS.orders}/${orderId}/events`);
+  }
+
+  // Live status changes of all of a user's orders
+  userOrderStatusEvents(userId: number): Observable<OrderStatusEvent> {
+    return this.statusEvents(`${this.API_ENDPOINTS.orders}/user/${userId}/events`);
+  }
+
+  private statusEvents(url: string): Observable<OrderStatusEvent> {
+    return new Observable<OrderStatusEvent>((subscriber) => {
+      const source = new EventSource(url);
+      source.addEventListener('status', (event) => {
+        subscriber.next(JSON.parse((event as MessageEvent).data));
+      });
+      // Closing on unsubscribe lets the server drop the stream
+      return () => source.close();
+    });
   }
 }
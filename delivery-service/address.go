@@ -0,0 +1,31 @@
+// delivery-service/address.go
+package main
+
+import "encoding/json"
+
+// DeliveryAddress is where the courier takes the order, as order-service
+// sends it. Lat and Lng are set when the address was located.
+type DeliveryAddress struct {
+	Street    string   `json:"street"`
+	Number    string   `json:"number,omitempty"`
+	Floor     string   `json:"floor,omitempty"`
+	Entrance  string   `json:"entrance,omitempty"`
+	City      string   `json:"city,omitempty"`
+	Postcode  string   `json:"postcode,omitempty"`
+	Lat       *float64 `json:"lat,omitempty"`
+	Lng       *float64 `json:"lng,omitempty"`
+	Precision string   `json:"precision,omitempty"` // how exactly Lat and Lng place it: "client", "street", "postcode" or "city"
+	Notes     string   `json:"notes,omitempty"`     // for the courier
+}
+
+// UnmarshalJSON also accepts the free-text addresses older orders were sent
+// with, keeping the whole text as the street
+func (a *DeliveryAddress) UnmarshalJSON(data []byte) error {
+	var line string
+	if err := json.Unmarshal(data, &line); err == nil {
+		*a = DeliveryAddress{Street: line}
+		return nil
+	}
+	type plain DeliveryAddress
+	return json.Unmarshal(data, (*plain)(a))
+}
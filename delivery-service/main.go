@@ -18,17 +18,17 @@ import (
 
 // Delivery represents a delivery entity
 type Delivery struct {
-	ID           int       `json:"id"`
-	OrderID      int       `json:"orderId"`
-	UserID       int       `json:"userId"`
-	RestaurantID int       `json:"restaurantId"`
-	CourierID    int       `json:"courierId"`
-	Status       string    `json:"status"` // "pending", "assigned", "picked_up", "delivered", "cancelled"
-	Address      string    `json:"address"`
-	EstimatedTime int      `json:"estimatedTime"` // in minutes
-	ActualTime    int      `json:"actualTime"`    // in minutes
-	CreatedAt     time.Time `json:"createdAt"`
-	UpdatedAt     time.Time `json:"updatedAt"`
+	ID            int             `json:"id"`
+	OrderID       int             `json:"orderId"`
+	UserID        int             `json:"userId"`
+	RestaurantID  int             `json:"restaurantId"`
+	CourierID     int             `json:"courierId"`
+	Status        string          `json:"status"` // "pending", "assigned", "picked_up", "delivered", "cancelled"
+	Address       DeliveryAddress `json:"address"`
+	EstimatedTime int             `json:"estimatedTime"` // in minutes
+	ActualTime    int             `json:"actualTime"`    // in minutes
+	CreatedAt     time.Time       `json:"createdAt"`
+	UpdatedAt     time.Time       `json:"updatedAt"`
 }
 
 // Courier represents a courier entity
@@ -131,9 +131,9 @@ func createDelivery(w http.ResponseWriter, r *http.Request) {
 			if deliveries[i].ID == delivery.ID {
 				deliveries[i].CourierID = assignedCourier.ID
 				deliveries[i].Status = "assigned"
-				
-				// Notify order service about the assignment
-				go updateOrderStatus(delivery.OrderID, "preparing")
+				// The order is already preparing: order-service asks for a
+				// courier once the restaurant accepts it
+				delivery = deliveries[i]
 			}
 		}
 	}
@@ -244,6 +244,8 @@ func updateOrderStatus(orderID int, status string) {
 		return
 	}
 	req.Header.Set("Content-Type", "application/json")
+	// Lets order-service record who changed the status
+	req.Header.Set("X-Source-Service", "delivery-service")
 	
 	client := &http.Client{}
 	resp, err := client.Do(req)
@@ -432,6 +434,7 @@ func main() {
 	
 	// Filtered deliveries
 	r.HandleFunc("/api/orders/{orderId}/deliveries", getDeliveriesByOrder).Methods("GET")
+	r.HandleFunc("/api/deliveries/order/{orderId}", getDeliveriesByOrder).Methods("GET")
 	r.HandleFunc("/api/couriers/{courierId}/deliveries", getDeliveriesByCourier).Methods("GET")
 	
 	// Courier routes
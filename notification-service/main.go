@@ -16,14 +16,15 @@ import (
 
 // Notification represents a notification entity
 type Notification struct {
-	ID        int       `json:"id"`
-	UserID    int       `json:"userId"`
-	Type      string    `json:"type"` // "order_update", "delivery_update", "payment_update", etc.
-	Message   string    `json:"message"`
-	Read      bool      `json:"read"`
-	OrderID   int       `json:"orderId,omitempty"`
-	Status    string    `json:"status,omitempty"`
-	CreatedAt time.Time `json:"createdAt"`
+	ID        int        `json:"id"`
+	UserID    int        `json:"userId"`
+	Type      string     `json:"type"` // "order_update", "delivery_update", "payment_update", etc.
+	Message   string     `json:"message"`
+	Read      bool       `json:"read"`
+	OrderID   int        `json:"orderId,omitempty"`
+	Status    string     `json:"status,omitempty"`
+	ETA       *time.Time `json:"eta,omitempty"` // when the order should arrive, for order updates
+	CreatedAt time.Time  `json:"createdAt"`
 }
 
 // Config holds service configuration from environment variables
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Limits on the preparation time a restaurant can quote, in minutes
+const (
+	minPrepTime = 1
+	maxPrepTime = 240
+)
+
+// ErrNotAwaitingRestaurant means the restaurant already decided, or the order never got that far
+var ErrNotAwaitingRestaurant = errors.New("order is not waiting for the restaurant")
+
+// RestaurantAcceptance is the restaurant's decision on a paid order
+type RestaurantAcceptance struct {
+	Deadline        time.Time  `json:"deadline"` // rejected automatically if not accepted by then
+	AcceptedAt      *time.Time `json:"acceptedAt,omitempty"`
+	PrepTimeMinutes int        `json:"prepTimeMinutes,omitempty"`
+	ReadyAt         *time.Time `json:"readyAt,omitempty"` // when the restaurant expects the food to be ready
+	RejectedAt      *time.Time `json:"rejectedAt,omitempty"`
+	RejectReason    string     `json:"rejectReason,omitempty"`
+}
+
+// awaitRestaurant hands a paid order to the restaurant, which has until the
+// deadline to accept it
+func awaitRestaurant(order *Order, tx *OrderTx) error {
+	if err := changeStatus(order, tx, "awaiting_restaurant", "order-service", "waiting for the restaurant to accept"); err != nil {
+		return err
+	}
+	order.Acceptance = &RestaurantAcceptance{Deadline: order.UpdatedAt.Add(config.AcceptanceTimeout)}
+	return nil
+}
+
+// rejectOrder cancels an order the restaurant won't cook. Cancelling turns
+// the saga around, which refunds the payment.
+func rejectOrder(order *Order, tx *OrderTx, actor, reason string) error {
+	if order.Status != "awaiting_restaurant" {
+		return ErrNotAwaitingRestaurant
+	}
+	if err := changeStatus(order, tx, "cancelled", actor, "rejected by the restaurant: "+reason); err != nil {
+		return err
+	}
+	rejectedAt := order.UpdatedAt
+	if order.Acceptance == nil {
+		order.Acceptance = &RestaurantAcceptance{}
+	}
+	order.Acceptance.RejectedAt = &rejectedAt
+	order.Acceptance.RejectReason = reason
+
+	notificationData := map[string]interface{}{
+		"userId":  order.UserID,
+		"type":    "order_update",
+		"message": fmt.Sprintf("The restaurant couldn't take your order #%d (%s). You will be refunded %s.", order.ID, reason, order.TotalAmount),
+		"orderId": order.ID,
+		"status":  order.Status,
+	}
+	return tx.Enqueue(OutboxEvent{
+		OrderID:        order.ID,
+		Destination:    "notification",
+		Method:         "POST",
+		IdempotencyKey: fmt.Sprintf("order-%d-status-%s", order.ID, order.Status),
+	}, notificationData)
+}
+
+// restaurantOrderUpdate applies a restaurant's decision to one of its orders
+func restaurantOrderUpdate(w http.ResponseWriter, r *http.Request, decide func(order *Order, tx *OrderTx) error) {
+	w.Header().Set("Content-Type", "application/json")
+	params := mux.Vars(r)
+	restaurantID, err := strconv.Atoi(params["restaurantId"])
+	if err != nil {
+		http.Error(w, "Invalid restaurant ID", http.StatusBadRequest)
+		return
+	}
+	id, err := strconv.Atoi(params["id"])
+	if err != nil {
+		http.Error(w, "Invalid order ID", http.StatusBadRequest)
+		return
+	}
+
+	order, err := store.Update(id, func(order *Order, tx *OrderTx) error {
+		// Restaurants only see their own orders
+		if order.RestaurantID != restaurantID {
+			return ErrOrderNotFound
+		}
+		return decide(order, tx)
+	})
+	if errors.Is(err, ErrNotAwaitingRestaurant) {
+		http.Error(w, "Only orders waiting for the restaurant can be accepted or rejected", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	outbox.Wake()
+	sagas.Wake()
+
+	json.NewEncoder(w).Encode(order)
+}
+
+// Accept a paid order with an estimate of how long it takes to prepare. A
+// courier is assigned once the order is accepted.
+func acceptRestaurantOrder(w http.ResponseWriter, r *http.Request) {
+	var acceptRequest struct {
+		PrepTimeMinutes int    `json:"prepTimeMinutes"`
+		Actor           string `json:"actor"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&acceptRequest); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if acceptRequest.PrepTimeMinutes < minPrepTime || acceptRequest.PrepTimeMinutes > maxPrepTime {
+		http.Error(w, fmt.Sprintf("prepTimeMinutes must be between %d and %d", minPrepTime, maxPrepTime), http.StatusBadRequest)
+		return
+	}
+
+	actor := requestActor(r, acceptRequest.Actor, "restaurant")
+	restaurantOrderUpdate(w, r, func(order *Order, tx *OrderTx) error {
+		if order.Status != "awaiting_restaurant" {
+			return ErrNotAwaitingRestaurant
+		}
+		reason := fmt.Sprintf("accepted, ready in %d minutes", acceptRequest.PrepTimeMinutes)
+		if err := changeStatus(order, tx, "preparing", actor, reason); err != nil {
+			return err
+		}
+		acceptedAt := order.UpdatedAt
+		readyAt := acceptedAt.Add(time.Duration(acceptRequest.PrepTimeMinutes) * time.Minute)
+		if order.Acceptance == nil {
+			order.Acceptance = &RestaurantAcceptance{}
+		}
+		order.Acceptance.AcceptedAt = &acceptedAt
+		order.Acceptance.PrepTimeMinutes = acceptRequest.PrepTimeMinutes
+		order.Acceptance.ReadyAt = &readyAt
+		updateETA(order, acceptedAt)
+
+		notificationData := map[string]interface{}{
+			"userId":  order.UserID,
+			"type":    "order_update",
+			"message": fmt.Sprintf("The restaurant accepted your order #%d, it will be ready in about %d minutes.%s", order.ID, acceptRequest.PrepTimeMinutes, etaMessage(*order)),
+			"orderId": order.ID,
+			"status":  order.Status,
+			"eta":     order.ETA.EstimatedAt,
+		}
+		return tx.Enqueue(OutboxEvent{
+			OrderID:        order.ID,
+			Destination:    "notification",
+			Method:         "POST",
+			IdempotencyKey: fmt.Sprintf("order-%d-status-%s", order.ID, order.Status),
+		}, notificationData)
+	})
+}
+
+// Reject a paid order, e.g. because the kitchen is closing. The customer is refunded.
+func rejectRestaurantOrder(w http.ResponseWriter, r *http.Request) {
+	var rejectRequest struct {
+		Reason string `json:"reason"`
+		Actor  string `json:"actor"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&rejectRequest); err != nil && err != io.EOF {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if rejectRequest.Reason == "" {
+		http.Error(w, "A reason is required to reject an order", http.StatusBadRequest)
+		return
+	}
+
+	actor := requestActor(r, rejectRequest.Actor, "restaurant")
+	restaurantOrderUpdate(w, r, func(order *Order, tx *OrderTx) error {
+		return rejectOrder(order, tx, actor, rejectRequest.Reason)
+	})
+}
+
+// rejectOverdue rejects the orders restaurants didn't accept in time
+func (s *OrderScheduler) rejectOverdue(now time.Time) {
+	waiting, err := store.Query(OrderQuery{Statuses: []string{"awaiting_restaurant"}, SortBy: sortByCreatedAt})
+	if err != nil {
+		log.Printf("Error loading orders waiting for restaurants: %v", err)
+		return
+	}
+
+	rejected := false
+	for _, order := range waiting {
+		if order.Acceptance == nil || order.Acceptance.Deadline.After(now) {
+			continue
+		}
+		_, err := store.Update(order.ID, func(order *Order, tx *OrderTx) error {
+			reason := fmt.Sprintf("not accepted within %s", config.AcceptanceTimeout)
+			return rejectOrder(order, tx, "scheduler", reason)
+		})
+		if errors.Is(err, ErrNotAwaitingRestaurant) {
+			// Accepted or cancelled since it was loaded
+			continue
+		}
+		if err != nil {
+			log.Printf("Error rejecting order #%d: %v", order.ID, err)
+			continue
+		}
+		log.Printf("Rejected order #%d, restaurant %d didn't accept it in time", order.ID, order.RestaurantID)
+		rejected = true
+	}
+	if rejected {
+		outbox.Wake()
+		sagas.Wake()
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Field limits of a delivery address, in characters
+const (
+	maxAddressFieldLength = 200
+	maxAddressNotesLength = 500
+)
+
+// DeliveryAddress is where an order is delivered. Lat and Lng are set when
+// the client sent a pin or the gazetteer found the address; Precision says
+// which.
+type DeliveryAddress struct {
+	Street    string   `json:"street"`
+	Number    string   `json:"number,omitempty"`
+	Floor     string   `json:"floor,omitempty"`
+	Entrance  string   `json:"entrance,omitempty"`
+	City      string   `json:"city,omitempty"`
+	Postcode  string   `json:"postcode,omitempty"`
+	Lat       *float64 `json:"lat,omitempty"`
+	Lng       *float64 `json:"lng,omitempty"`
+	Precision string   `json:"precision,omitempty"` // "client", "street", "postcode" or "city", empty when not located
+	Notes     string   `json:"notes,omitempty"`     // for the courier, e.g. "ring twice"
+}
+
+// UnmarshalJSON reads an address object, or a free-text address as sent
+// before addresses were structured and as stored on older orders
+func (a *DeliveryAddress) UnmarshalJSON(data []byte) error {
+	var line string
+	if err := json.Unmarshal(data, &line); err == nil {
+		*a = parseAddressLine(line)
+		return nil
+	}
+	type plain DeliveryAddress
+	return json.Unmarshal(data, (*plain)(a))
+}
+
+// String is the address on one line, e.g. "123 Main St, Floor 2, 10115 City"
+func (a DeliveryAddress) String() string {
+	parts := []string{strings.TrimSpace(a.Number + " " + a.Street)}
+	if a.Floor != "" {
+		parts = append(parts, "Floor "+a.Floor)
+	}
+	if a.Entrance != "" {
+		parts = append(parts, "Entrance "+a.Entrance)
+	}
+	if city := strings.TrimSpace(a.Postcode + " " + a.City); city != "" {
+		parts = append(parts, city)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// IsZero reports whether no address was given
+func (a DeliveryAddress) IsZero() bool {
+	return a.Street == "" && a.City == "" && a.Postcode == "" && a.Lat == nil && a.Lng == nil
+}
+
+// parseAddressLine makes a best effort at splitting a free-text address like
+// "123 Main St, 10115 City". The first part is the street and number, the
+// last the postcode and city, anything in between goes to the notes.
+func parseAddressLine(line string) DeliveryAddress {
+	var address DeliveryAddress
+	parts := strings.Split(line, ",")
+	for i := range parts {
+		parts[i] = strings.TrimSpace(parts[i])
+	}
+	address.Street, address.Number = splitHouseNumber(parts[0])
+	if len(parts) > 1 {
+		last := parts[len(parts)-1]
+		if code, city, ok := strings.Cut(last, " "); ok && startsWithDigit(code) {
+			address.Postcode, address.City = code, strings.TrimSpace(city)
+		} else if startsWithDigit(last) {
+			address.Postcode = last
+		} else {
+			address.City = last
+		}
+		address.Notes = strings.Join(parts[1:len(parts)-1], ", ")
+	}
+	return address
+}
+
+// splitHouseNumber takes the house number off the front ("123 Main St") or
+// back ("Hauptstraße 5") of a street
+func splitHouseNumber(street string) (string, string) {
+	fields := strings.Fields(street)
+	if len(fields) < 2 {
+		return street, ""
+	}
+	if startsWithDigit(fields[0]) {
+		return strings.Join(fields[1:], " "), fields[0]
+	}
+	if last := fields[len(fields)-1]; startsWithDigit(last) {
+		return strings.Join(fields[:len(fields)-1], " "), last
+	}
+	return street, ""
+}
+
+func startsWithDigit(s string) bool {
+	r, _ := utf8.DecodeRuneInString(s)
+	return unicode.IsDigit(r)
+}
+
+// validateAddress trims the fields of an address and checks it can be delivered to
+func validateAddress(a *DeliveryAddress) error {
+	for _, field := range []*string{&a.Street, &a.Number, &a.Floor, &a.Entrance, &a.City, &a.Postcode, &a.Notes} {
+		*field = strings.TrimSpace(*field)
+	}
+	if a.Street == "" {
+		return &ValidationError{Message: "The delivery address needs a street"}
+	}
+	fields := []struct{ name, value string }{
+		{"street", a.Street}, {"number", a.Number}, {"floor", a.Floor},
+		{"entrance", a.Entrance}, {"city", a.City}, {"postcode", a.Postcode},
+	}
+	for _, field := range fields {
+		if utf8.RuneCountInString(field.value) > maxAddressFieldLength {
+			return &ValidationError{Message: fmt.Sprintf("The address %s must be at most %d characters", field.name, maxAddressFieldLength)}
+		}
+	}
+	if utf8.RuneCountInString(a.Notes) > maxAddressNotesLength {
+		return &ValidationError{Message: fmt.Sprintf("The address notes must be at most %d characters", maxAddressNotesLength)}
+	}
+	if (a.Lat == nil) != (a.Lng == nil) {
+		return &ValidationError{Message: "Send both lat and lng, or neither"}
+	}
+	if a.Lat != nil && (*a.Lat < -90 || *a.Lat > 90 || *a.Lng < -180 || *a.Lng > 180) {
+		return &ValidationError{Message: "lat must be between -90 and 90 and lng between -180 and 180"}
+	}
+	return nil
+}
+
+// locateAddress validates an address and fills in its coordinates. A pin the
+// client dropped is kept; otherwise the address is geocoded again, so an
+// edited address never keeps the coordinates of the old one. Addresses the
+// gazetteer doesn't know are still accepted, without coordinates.
+func locateAddress(a *DeliveryAddress) error {
+	if err := validateAddress(a); err != nil {
+		return err
+	}
+	if a.Lat != nil && (a.Precision == "" || a.Precision == precisionClient) {
+		a.Precision = precisionClient
+		return nil
+	}
+	a.Lat, a.Lng, a.Precision = nil, nil, ""
+	location, err := geocoder.Geocode(*a)
+	if errors.Is(err, ErrNotGeocoded) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	lat, lng := location.Lat, location.Lng
+	a.Lat, a.Lng, a.Precision = &lat, &lng, location.Precision
+	return nil
+}
+
+// resolveAddress works out where an order goes: the saved address addressID
+// of the user, the address sent with the order, or else the user's default
+// saved address
+func resolveAddress(userID, addressID int, address DeliveryAddress) (DeliveryAddress, int, error) {
+	if addressID == 0 && address.IsZero() {
+		saved, err := store.ListAddresses(userID)
+		if err != nil {
+			return address, 0, err
+		}
+		for _, s := range saved {
+			if s.IsDefault {
+				return s.Address, s.ID, nil
+			}
+		}
+		return address, 0, &ValidationError{Message: "A delivery address or addressId is required"}
+	}
+	if addressID != 0 {
+		saved, err := store.GetAddress(userID, addressID)
+		if err != nil {
+			return address, 0, err
+		}
+		return saved.Address, saved.ID, nil
+	}
+	if err := locateAddress(&address); err != nil {
+		return address, 0, err
+	}
+	return address, 0, nil
+}
+
+// Write the HTTP error matching an address error
+func writeAddressError(w http.ResponseWriter, err error) {
+	var validationErr *ValidationError
+	switch {
+	case errors.As(err, &validationErr):
+		http.Error(w, validationErr.Message, http.StatusBadRequest)
+	case errors.Is(err, ErrAddressNotFound):
+		http.Error(w, "Saved address not found", http.StatusNotFound)
+	default:
+		writeStoreError(w, err)
+	}
+}
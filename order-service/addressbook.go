@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Most addresses one user can save
+const maxSavedAddresses = 20
+
+// ErrAddressNotFound is returned by an AddressStore for an address the user hasn't saved
+var ErrAddressNotFound = errors.New("saved address not found")
+
+// SavedAddress is an entry of a user's address book. Orders placed with its
+// ID get a copy of the address, so editing it later doesn't move past orders.
+type SavedAddress struct {
+	ID        int             `json:"id"`
+	UserID    int             `json:"userId"`
+	Label     string          `json:"label,omitempty"` // e.g. "Home", "Work"
+	Address   DeliveryAddress `json:"address"`
+	IsDefault bool            `json:"isDefault"` // used for orders that name no address
+	CreatedAt time.Time       `json:"createdAt"`
+	UpdatedAt time.Time       `json:"updatedAt"`
+}
+
+// AddressStore persists users' saved addresses. It is part of OrderStore.
+type AddressStore interface {
+	// ListAddresses returns a user's saved addresses, oldest first
+	ListAddresses(userID int) ([]SavedAddress, error)
+	// GetAddress returns one of a user's saved addresses or ErrAddressNotFound
+	GetAddress(userID, id int) (SavedAddress, error)
+	// SaveAddress creates the address if its ID is 0 and replaces it
+	// otherwise, or returns ErrAddressNotFound. Saving a default address
+	// makes it the user's only one.
+	SaveAddress(address *SavedAddress) error
+	// DeleteAddress removes a saved address or returns ErrAddressNotFound
+	DeleteAddress(userID, id int) error
+}
+
+// Read the user and address IDs of an address book route
+func addressBookIDs(w http.ResponseWriter, r *http.Request) (userID, id int, ok bool) {
+	params := mux.Vars(r)
+	userID, err := strconv.Atoi(params["userId"])
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return 0, 0, false
+	}
+	if v, found := params["id"]; found {
+		id, err = strconv.Atoi(v)
+		if err != nil {
+			http.Error(w, "Invalid address ID", http.StatusBadRequest)
+			return 0, 0, false
+		}
+	}
+	return userID, id, true
+}
+
+// Get a user's saved addresses
+func getSavedAddresses(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	userID, _, ok := addressBookIDs(w, r)
+	if !ok {
+		return
+	}
+
+	addresses, err := store.ListAddresses(userID)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	if addresses == nil {
+		addresses = []SavedAddress{}
+	}
+	json.NewEncoder(w).Encode(addresses)
+}
+
+// Save a new address. It is geocoded from the gazetteer unless it comes with
+// a pin, and the user's first address becomes their default.
+func createSavedAddress(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	userID, _, ok := addressBookIDs(w, r)
+	if !ok {
+		return
+	}
+
+	var saved SavedAddress
+	err := json.NewDecoder(r.Body).Decode(&saved)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := locateAddress(&saved.Address); err != nil {
+		writeAddressError(w, err)
+		return
+	}
+
+	existing, err := store.ListAddresses(userID)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	if len(existing) >= maxSavedAddresses {
+		http.Error(w, "The address book is full, delete an address first", http.StatusConflict)
+		return
+	}
+
+	now := time.Now()
+	saved.ID = 0
+	saved.UserID = userID
+	saved.Label = strings.TrimSpace(saved.Label)
+	saved.IsDefault = saved.IsDefault || len(existing) == 0
+	saved.CreatedAt = now
+	saved.UpdatedAt = now
+	if err := store.SaveAddress(&saved); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(saved)
+}
+
+// Replace a saved address. Orders already placed keep the old one.
+func updateSavedAddress(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	userID, id, ok := addressBookIDs(w, r)
+	if !ok {
+		return
+	}
+
+	var update SavedAddress
+	err := json.NewDecoder(r.Body).Decode(&update)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := locateAddress(&update.Address); err != nil {
+		writeAddressError(w, err)
+		return
+	}
+
+	saved, err := store.GetAddress(userID, id)
+	if err != nil {
+		writeAddressError(w, err)
+		return
+	}
+	saved.Label = strings.TrimSpace(update.Label)
+	saved.Address = update.Address
+	// The default moves by making another address the default, never by unsetting it
+	saved.IsDefault = saved.IsDefault || update.IsDefault
+	saved.UpdatedAt = time.Now()
+	if err := store.SaveAddress(&saved); err != nil {
+		writeAddressError(w, err)
+		return
+	}
+	json.NewEncoder(w).Encode(saved)
+}
+
+// Delete a saved address. If it was the default, the oldest remaining one
+// takes over.
+func deleteSavedAddress(w http.ResponseWriter, r *http.Request) {
+	userID, id, ok := addressBookIDs(w, r)
+	if !ok {
+		return
+	}
+
+	saved, err := store.GetAddress(userID, id)
+	if err != nil {
+		writeAddressError(w, err)
+		return
+	}
+	if err := store.DeleteAddress(userID, id); err != nil {
+		writeAddressError(w, err)
+		return
+	}
+	if saved.IsDefault {
+		remaining, err := store.ListAddresses(userID)
+		if err == nil && len(remaining) > 0 {
+			remaining[0].IsDefault = true
+			err = store.SaveAddress(&remaining[0])
+		}
+		if err != nil {
+			writeStoreError(w, err)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Check where an address would be delivered without saving it
+func geocodeAddress(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	var address DeliveryAddress
+	err := json.NewDecoder(r.Body).Decode(&address)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := locateAddress(&address); err != nil {
+		writeAddressError(w, err)
+		return
+	}
+	json.NewEncoder(w).Encode(address)
+}
@@ -0,0 +1,390 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+	_ "time/tzdata" // Time zones for bucketing, the alpine image has no zoneinfo
+
+	"github.com/gorilla/mux"
+	"quickbite/shared/money"
+)
+
+// Analytics request limits
+const (
+	analyticsDefaultDays = 30
+	analyticsMaxDays     = 366
+	analyticsDefaultTop  = 10
+	analyticsMaxTop      = 100
+)
+
+// Bucket sizes of the sales report
+const (
+	intervalDay  = "day"
+	intervalWeek = "week"
+)
+
+// analyticsQuery is what an analytics request asks for. From and To are
+// midnights in Location; To is exclusive.
+type analyticsQuery struct {
+	RestaurantID int // 0 for all restaurants
+	From         time.Time
+	To           time.Time
+	Location     *time.Location
+	Interval     string // sales only
+	Limit        int    // top items only
+	SortBy       string // top items only: "quantity" or "revenue"
+}
+
+// SalesBucket is the sales of one restaurant over one day or week. Orders
+// are counted in the bucket they were placed in.
+type SalesBucket struct {
+	RestaurantID     int         `json:"restaurantId"`
+	Period           string      `json:"period"` // first day of the bucket
+	Start            time.Time   `json:"start"`
+	Revenue          money.Money `json:"revenue"` // totals of the delivered orders
+	Orders           int         `json:"orders"`  // delivered orders
+	AverageBasket    money.Money `json:"averageBasket"`
+	Cancelled        int         `json:"cancelled"`
+	CancellationRate float64     `json:"cancellationRate"` // cancelled out of delivered and cancelled, 0 to 1
+}
+
+// SalesReport is the response of the sales endpoints
+type SalesReport struct {
+	From     string        `json:"from"`
+	To       string        `json:"to"` // inclusive
+	TimeZone string        `json:"timeZone"`
+	Interval string        `json:"interval"`
+	Buckets  []SalesBucket `json:"buckets"`
+}
+
+// TopItem is how much of one menu item was sold in delivered orders
+type TopItem struct {
+	RestaurantID int         `json:"restaurantId"`
+	MenuItemID   int         `json:"menuItemId"`
+	Name         string      `json:"name"` // as last ordered
+	Quantity     int         `json:"quantity"`
+	Revenue      money.Money `json:"revenue"`
+	Orders       int         `json:"orders"`
+}
+
+// TopItemsReport is the response of the top items endpoints
+type TopItemsReport struct {
+	From     string    `json:"from"`
+	To       string    `json:"to"`
+	TimeZone string    `json:"timeZone"`
+	SortBy   string    `json:"sortBy"`
+	Items    []TopItem `json:"items"`
+}
+
+// HeatmapReport counts delivered orders by weekday and hour they were placed
+type HeatmapReport struct {
+	From     string       `json:"from"`
+	To       string       `json:"to"`
+	TimeZone string       `json:"timeZone"`
+	Days     []string     `json:"days"`   // row labels, Monday first
+	Counts   [7][24]int   `json:"counts"` // [day][hour]
+	Orders   int          `json:"orders"`
+	Peak     *HeatmapPeak `json:"peak,omitempty"`
+}
+
+// HeatmapPeak is the busiest hour of the week
+type HeatmapPeak struct {
+	Day    string `json:"day"`
+	Hour   int    `json:"hour"`
+	Orders int    `json:"orders"`
+}
+
+// parseAnalyticsQuery reads ?from=&to= (dates, to inclusive), ?tz= (an IANA
+// zone), ?interval=, ?limit= and ?sortBy= from the request
+func parseAnalyticsQuery(r *http.Request) (analyticsQuery, error) {
+	values := r.URL.Query()
+	q := analyticsQuery{Interval: intervalDay, Limit: analyticsDefaultTop, SortBy: "quantity"}
+
+	var err error
+	q.From, q.To, q.Location, err = parseDateRange(values)
+	if err != nil {
+		return q, err
+	}
+
+	if v := values.Get("interval"); v != "" {
+		if v != intervalDay && v != intervalWeek {
+			return q, &ValidationError{Message: "interval must be \"day\" or \"week\""}
+		}
+		q.Interval = v
+	}
+	if v := values.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit <= 0 || limit > analyticsMaxTop {
+			return q, &ValidationError{Message: fmt.Sprintf("limit must be between 1 and %d", analyticsMaxTop)}
+		}
+		q.Limit = limit
+	}
+	if v := values.Get("sortBy"); v != "" {
+		if v != "quantity" && v != "revenue" {
+			return q, &ValidationError{Message: "sortBy must be \"quantity\" or \"revenue\""}
+		}
+		q.SortBy = v
+	}
+	if v := values.Get("restaurantId"); v != "" {
+		id, err := strconv.Atoi(v)
+		if err != nil || id <= 0 {
+			return q, &ValidationError{Message: "Invalid restaurantId"}
+		}
+		q.RestaurantID = id
+	}
+	return q, nil
+}
+
+// parseDateRange reads the from and to dates (both inclusive, default the
+// last 30 days) and the tz they are in. The range is returned as midnights
+// in that zone with to exclusive.
+func parseDateRange(values url.Values) (from, to time.Time, location *time.Location, err error) {
+	zone := values.Get("tz")
+	if zone == "" {
+		zone = config.AnalyticsTimeZone
+	}
+	location, err = time.LoadLocation(zone)
+	if err != nil {
+		return from, to, nil, &ValidationError{Message: fmt.Sprintf("Unknown time zone %q", zone)}
+	}
+
+	now := time.Now().In(location)
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, location)
+	to = today.AddDate(0, 0, 1)
+	if v := values.Get("to"); v != "" {
+		day, err := time.ParseInLocation("2006-01-02", v, location)
+		if err != nil {
+			return from, to, location, &ValidationError{Message: "Invalid to, expected a date like 2006-01-02"}
+		}
+		to = day.AddDate(0, 0, 1)
+	}
+	from = to.AddDate(0, 0, -analyticsDefaultDays)
+	if v := values.Get("from"); v != "" {
+		day, err := time.ParseInLocation("2006-01-02", v, location)
+		if err != nil {
+			return from, to, location, &ValidationError{Message: "Invalid from, expected a date like 2006-01-02"}
+		}
+		from = day
+	}
+	if !from.Before(to) {
+		return from, to, location, &ValidationError{Message: "from must not be after to"}
+	}
+	if from.AddDate(0, 0, analyticsMaxDays).Before(to) {
+		return from, to, location, &ValidationError{Message: fmt.Sprintf("Reports cover at most %d days", analyticsMaxDays)}
+	}
+	return from, to, location, nil
+}
+
+// lastDay is the inclusive end date of the query
+func (q analyticsQuery) lastDay() string {
+	return q.To.AddDate(0, 0, -1).Format("2006-01-02")
+}
+
+// bucketStart is the start of the day or week t falls in
+func (q analyticsQuery) bucketStart(t time.Time) time.Time {
+	t = t.In(q.Location)
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, q.Location)
+	if q.Interval == intervalWeek {
+		// Weeks start on Monday
+		day = day.AddDate(0, 0, -((int(day.Weekday()) + 6) % 7))
+	}
+	return day
+}
+
+// nextBucket is the start of the bucket after start
+func (q analyticsQuery) nextBucket(start time.Time) time.Time {
+	if q.Interval == intervalWeek {
+		return start.AddDate(0, 0, 7)
+	}
+	return start.AddDate(0, 0, 1)
+}
+
+// salesReport buckets delivered and cancelled orders per restaurant. Every
+// restaurant in the report gets a bucket for every period, even without orders.
+func salesReport(q analyticsQuery, orders []Order) interface{} {
+	type bucketKey struct {
+		restaurantID int
+		start        int64
+	}
+	buckets := make(map[bucketKey]*SalesBucket)
+	restaurants := make(map[int]bool)
+	if q.RestaurantID != 0 {
+		restaurants[q.RestaurantID] = true
+	}
+	for _, order := range orders {
+		restaurants[order.RestaurantID] = true
+	}
+	for restaurantID := range restaurants {
+		for start := q.bucketStart(q.From); start.Before(q.To); start = q.nextBucket(start) {
+			buckets[bucketKey{restaurantID, start.Unix()}] = &SalesBucket{
+				RestaurantID:  restaurantID,
+				Period:        start.Format("2006-01-02"),
+				Start:         start,
+				Revenue:       money.New(0, config.Currency),
+				AverageBasket: money.New(0, config.Currency),
+			}
+		}
+	}
+
+	for _, order := range orders {
+		bucket := buckets[bucketKey{order.RestaurantID, q.bucketStart(order.CreatedAt).Unix()}]
+		if bucket == nil {
+			continue
+		}
+		switch order.Status {
+		case "delivered":
+			bucket.Orders++
+			bucket.Revenue = bucket.Revenue.Add(order.TotalAmount)
+		case "cancelled":
+			bucket.Cancelled++
+		}
+	}
+
+	report := SalesReport{From: q.From.Format("2006-01-02"), To: q.lastDay(), TimeZone: q.Location.String(), Interval: q.Interval, Buckets: []SalesBucket{}}
+	for _, bucket := range buckets {
+		if bucket.Orders > 0 {
+			bucket.AverageBasket = money.New(money.DivRound(bucket.Revenue.Amount, int64(bucket.Orders)), bucket.Revenue.Currency)
+		}
+		if finished := bucket.Orders + bucket.Cancelled; finished > 0 {
+			bucket.CancellationRate = math.Round(float64(bucket.Cancelled)/float64(finished)*10000) / 10000
+		}
+		report.Buckets = append(report.Buckets, *bucket)
+	}
+	sort.Slice(report.Buckets, func(i, j int) bool {
+		a, b := report.Buckets[i], report.Buckets[j]
+		if a.RestaurantID != b.RestaurantID {
+			return a.RestaurantID < b.RestaurantID
+		}
+		return a.Start.Before(b.Start)
+	})
+	return report
+}
+
+// topItemsReport ranks the menu items of delivered orders
+func topItemsReport(q analyticsQuery, orders []Order) interface{} {
+	type itemKey struct {
+		restaurantID int
+		menuItemID   int
+	}
+	items := make(map[itemKey]*TopItem)
+	for _, order := range orders {
+		if order.Status != "delivered" {
+			continue
+		}
+		for _, item := range order.Items {
+			key := itemKey{order.RestaurantID, item.MenuItemID}
+			top, ok := items[key]
+			if !ok {
+				top = &TopItem{RestaurantID: order.RestaurantID, MenuItemID: item.MenuItemID, Revenue: money.New(0, config.Currency)}
+				items[key] = top
+			}
+			// Orders are sorted by creation, so this keeps the latest name
+			top.Name = item.Name
+			top.Quantity += item.Quantity
+			top.Revenue = top.Revenue.Add(item.Price.Mul(item.Quantity))
+			top.Orders++
+		}
+	}
+
+	report := TopItemsReport{From: q.From.Format("2006-01-02"), To: q.lastDay(), TimeZone: q.Location.String(), SortBy: q.SortBy, Items: []TopItem{}}
+	for _, item := range items {
+		report.Items = append(report.Items, *item)
+	}
+	sort.Slice(report.Items, func(i, j int) bool {
+		a, b := report.Items[i], report.Items[j]
+		if q.SortBy == "revenue" && a.Revenue.Cmp(b.Revenue) != 0 {
+			return a.Revenue.Cmp(b.Revenue) > 0
+		}
+		if a.Quantity != b.Quantity {
+			return a.Quantity > b.Quantity
+		}
+		if a.Revenue.Cmp(b.Revenue) != 0 {
+			return a.Revenue.Cmp(b.Revenue) > 0
+		}
+		return a.MenuItemID < b.MenuItemID
+	})
+	if len(report.Items) > q.Limit {
+		report.Items = report.Items[:q.Limit]
+	}
+	return report
+}
+
+// heatmapReport counts delivered orders by local weekday and hour
+func heatmapReport(q analyticsQuery, orders []Order) interface{} {
+	report := HeatmapReport{
+		From:     q.From.Format("2006-01-02"),
+		To:       q.lastDay(),
+		TimeZone: q.Location.String(),
+		Days:     []string{"Monday", "Tuesday", "Wednesday", "Thursday", "Friday", "Saturday", "Sunday"},
+	}
+	for _, order := range orders {
+		if order.Status != "delivered" {
+			continue
+		}
+		placed := order.CreatedAt.In(q.Location)
+		day := (int(placed.Weekday()) + 6) % 7
+		report.Counts[day][placed.Hour()]++
+		report.Orders++
+	}
+	for day := range report.Counts {
+		for hour, count := range report.Counts[day] {
+			if count > 0 && (report.Peak == nil || count > report.Peak.Orders) {
+				report.Peak = &HeatmapPeak{Day: report.Days[day], Hour: hour, Orders: count}
+			}
+		}
+	}
+	return report
+}
+
+// serveAnalytics loads the finished orders a report needs and writes it.
+// Restaurant endpoints are limited to the restaurant in the path; admin
+// endpoints take an optional ?restaurantId=.
+func serveAnalytics(w http.ResponseWriter, r *http.Request, build func(q analyticsQuery, orders []Order) interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	q, err := parseAnalyticsQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if v, ok := mux.Vars(r)["restaurantId"]; ok {
+		q.RestaurantID, err = strconv.Atoi(v)
+		if err != nil {
+			http.Error(w, "Invalid restaurant ID", http.StatusBadRequest)
+			return
+		}
+	}
+
+	orders, err := store.Query(OrderQuery{
+		RestaurantID: q.RestaurantID,
+		Statuses:     []string{"delivered", "cancelled"},
+		CreatedFrom:  q.From,
+		CreatedTo:    q.To,
+		SortBy:       sortByCreatedAt,
+	})
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	json.NewEncoder(w).Encode(build(q, orders))
+}
+
+// Revenue, order count, average basket and cancellation rate per day or week
+func getSalesAnalytics(w http.ResponseWriter, r *http.Request) {
+	serveAnalytics(w, r, salesReport)
+}
+
+// Best-selling menu items by quantity or revenue
+func getTopItemsAnalytics(w http.ResponseWriter, r *http.Request) {
+	serveAnalytics(w, r, topItemsReport)
+}
+
+// Delivered orders by weekday and hour
+func getHeatmapAnalytics(w http.ResponseWriter, r *http.Request) {
+	serveAnalytics(w, r, heatmapReport)
+}
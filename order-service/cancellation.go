@@ -0,0 +1,349 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"quickbite/shared/money"
+)
+
+// Statuses in which single items can still be cancelled: the food hasn't
+// left the restaurant yet
+var itemCancellableStatuses = map[string]bool{
+	"scheduled":           true,
+	"created":             true,
+	"paid":                true,
+	"awaiting_restaurant": true,
+	"preparing":           true,
+}
+
+// ErrLastItem means cancelling the items would leave the order empty
+var ErrLastItem = errors.New("these are the last items of the order, cancel the order instead")
+
+// ItemCancellation records items removed from an order after it was placed
+type ItemCancellation struct {
+	ID           int              `json:"id"` // numbers the cancellations of an order from 1
+	MenuItemID   int              `json:"menuItemId"`
+	Name         string           `json:"name"`
+	Options      []SelectedOption `json:"options,omitempty"` // of the line the units were taken from
+	Instructions string           `json:"instructions,omitempty"`
+	Quantity     int              `json:"quantity"`
+	Refund       money.Money      `json:"refund"` // what the customer gets back, after their share of discounts
+	Actor        string           `json:"actor"`
+	Reason       string           `json:"reason,omitempty"`
+	At           time.Time        `json:"at"`
+}
+
+// description names the cancelled line for the customer, e.g. "Pizza (Large; Extra cheese)"
+func (c ItemCancellation) description() string {
+	if len(c.Options) == 0 {
+		return c.Name
+	}
+	return fmt.Sprintf("%s (%s)", c.Name, optionsSummary(OrderItem{Options: c.Options}))
+}
+
+// LineSelector picks the order line a cancellation applies to. A menu item
+// can be on several lines with different options or instructions, so either
+// the line's index in the order's items or its options and instructions
+// tell them apart. A menu item on a single line needs neither.
+type LineSelector struct {
+	Line         *int             `json:"line"`         // index in the order's items
+	Options      []SelectedOption `json:"options"`      // groupId and optionId of every option of the line, defaults included
+	Instructions *string          `json:"instructions"` // as on the line, "" for none
+}
+
+// findOrderLine returns the index of the line of the menu item the selector
+// picks. A selector that fits several lines is rejected.
+func findOrderLine(order Order, menuItemID int, selector LineSelector) (int, error) {
+	invalid := func(format string, args ...interface{}) (int, error) {
+		return 0, &ValidationError{Message: fmt.Sprintf(format, args...)}
+	}
+	byOptions := selector.Options != nil || selector.Instructions != nil
+	probe := OrderItem{MenuItemID: menuItemID, Options: sortedOptions(selector.Options)}
+	if selector.Instructions != nil {
+		probe.Instructions = strings.TrimSpace(*selector.Instructions)
+	}
+	matches := func(item OrderItem) bool {
+		if !byOptions {
+			return item.MenuItemID == menuItemID
+		}
+		item.Options = sortedOptions(item.Options)
+		if selector.Instructions == nil {
+			probe.Instructions = item.Instructions
+		}
+		return sameLine(item, probe)
+	}
+
+	if selector.Line != nil {
+		line := *selector.Line
+		if line < 0 || line >= len(order.Items) {
+			return invalid("Invalid line %d, the order has %d lines", line, len(order.Items))
+		}
+		if order.Items[line].MenuItemID != menuItemID {
+			return invalid("Line %d of this order is not menu item %d", line, menuItemID)
+		}
+		if !matches(order.Items[line]) {
+			return invalid("Line %d of this order has other options or instructions", line)
+		}
+		return line, nil
+	}
+
+	found, count := 0, 0
+	for i, item := range order.Items {
+		if matches(item) {
+			found = i
+			count++
+		}
+	}
+	switch {
+	case count == 0 && byOptions:
+		return invalid("Menu item %d is not in this order with these options and instructions", menuItemID)
+	case count == 0:
+		return invalid("Menu item %d is not in this order", menuItemID)
+	case count > 1:
+		return invalid("Menu item %d is on %d lines of this order, choose one by its line or its options and instructions", menuItemID, count)
+	}
+	return found, nil
+}
+
+// sortedOptions returns a copy of options ordered by group and option ID, so
+// the same choice compares equal however it was listed
+func sortedOptions(options []SelectedOption) []SelectedOption {
+	sorted := append([]SelectedOption(nil), options...)
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].GroupID != sorted[j].GroupID {
+			return sorted[i].GroupID < sorted[j].GroupID
+		}
+		return sorted[i].OptionID < sorted[j].OptionID
+	})
+	return sorted
+}
+
+// removeOrderItems takes quantity units (all of them if 0) off one line of
+// an order. The customer gets back what they paid for those units: their
+// price minus their proportional share of item discounts. Delivery and
+// service fees and the tip are not refunded. Items keep the price they were
+// ordered at, so nothing is fetched from restaurant-service.
+func removeOrderItems(order *Order, line, quantity int) (ItemCancellation, error) {
+	item := order.Items[line]
+	cancellation := ItemCancellation{
+		MenuItemID:   item.MenuItemID,
+		Name:         item.Name,
+		Options:      item.Options,
+		Instructions: item.Instructions,
+		Quantity:     quantity,
+	}
+	if quantity < 0 || quantity > item.Quantity {
+		return cancellation, &ValidationError{Message: fmt.Sprintf("Invalid quantity %d, the line has %d of %s", quantity, item.Quantity, item.Name)}
+	}
+	if quantity == 0 {
+		cancellation.Quantity = item.Quantity
+	}
+
+	items := append([]OrderItem(nil), order.Items...)
+	items[line].Quantity -= cancellation.Quantity
+	removed := item.Price.Mul(cancellation.Quantity)
+	kept := items[:0]
+	for _, item := range items {
+		if item.Quantity > 0 {
+			kept = append(kept, item)
+		}
+	}
+	if len(kept) == 0 {
+		return cancellation, ErrLastItem
+	}
+
+	// Discounts on the items shrink with the basket; a free delivery stays
+	discountShare := money.New(0, order.Currency)
+	discounts := append([]AppliedDiscount(nil), order.Discounts...)
+	for i := range discounts {
+		if discounts[i].Type == promoFreeDelivery || !order.Subtotal.IsPositive() {
+			continue
+		}
+		share := money.New(money.DivRound(discounts[i].Amount.Amount*removed.Amount, order.Subtotal.Amount), order.Currency)
+		discounts[i].Amount = discounts[i].Amount.Sub(share)
+		discountShare = discountShare.Add(share)
+	}
+
+	order.Items = kept
+	order.Subtotal = order.Subtotal.Sub(removed)
+	order.Discounts = discounts
+	cancellation.Refund = removed.Sub(discountShare)
+
+	if order.Pricing == nil {
+		// Priced before breakdowns existed
+		order.TotalAmount = order.TotalAmount.Sub(cancellation.Refund)
+		return cancellation, nil
+	}
+	lines := append([]PriceLine(nil), order.Pricing.Lines...)
+	discount := 0
+	for i := range lines {
+		switch lines[i].Type {
+		case lineItems:
+			lines[i].Amount = order.Subtotal
+			lines[i].Description = fmt.Sprintf("Items (%d)", countItems(order.Items))
+		case lineDiscount:
+			if discount < len(discounts) {
+				lines[i].Amount = discounts[discount].Amount.Neg()
+				discount++
+			}
+		}
+	}
+	order.Pricing = newPriceBreakdown(lines, order.Currency)
+	order.TotalAmount = order.Pricing.Total
+	return cancellation, nil
+}
+
+// Cancel some or all units of one item of an order, e.g. when the
+// restaurant ran out of a dish. The customer is refunded and notified.
+func cancelOrderItem(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	params := mux.Vars(r)
+	id, err := strconv.Atoi(params["id"])
+	if err != nil {
+		http.Error(w, "Invalid order ID", http.StatusBadRequest)
+		return
+	}
+	menuItemID, err := strconv.Atoi(params["menuItemId"])
+	if err != nil {
+		http.Error(w, "Invalid menu item ID", http.StatusBadRequest)
+		return
+	}
+
+	// The body is optional: {"quantity": 1, "reason": "...", "actor": "..."}
+	// plus a LineSelector when the item is on several lines. Without a
+	// quantity every unit of the line is cancelled.
+	var cancelRequest struct {
+		LineSelector
+		Quantity int    `json:"quantity"`
+		Actor    string `json:"actor"`
+		Reason   string `json:"reason"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&cancelRequest); err != nil && err != io.EOF {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	actor := requestActor(r, cancelRequest.Actor, "customer")
+	order, err := store.Update(id, func(order *Order, tx *OrderTx) error {
+		if !itemCancellableStatuses[order.Status] {
+			return &ItemsLockedError{Status: order.Status}
+		}
+		if order.Group != nil {
+			return ErrGroupOrderItems
+		}
+		line, err := findOrderLine(*order, menuItemID, cancelRequest.LineSelector)
+		if err != nil {
+			return err
+		}
+		cancellation, err := removeOrderItems(order, line, cancelRequest.Quantity)
+		if err != nil {
+			return err
+		}
+		cancellation.ID = len(order.CancelledItems) + 1
+		cancellation.Actor = actor
+		cancellation.Reason = cancelRequest.Reason
+		cancellation.At = time.Now()
+		order.CancelledItems = append(order.CancelledItems, cancellation)
+		order.UpdatedAt = cancellation.At
+
+		switch order.Status {
+		case "created":
+			// Not paid yet: the pending payment just asks for less
+			if err := notifyPaymentAmountChanged(tx, *order); err != nil {
+				return err
+			}
+		case "paid", "awaiting_restaurant", "preparing":
+			if err := notifyPaymentRefund(tx, *order, cancellation); err != nil {
+				return err
+			}
+		}
+		return notifyItemsCancelled(tx, *order, cancellation)
+	})
+	var validationErr *ValidationError
+	var lockedErr *ItemsLockedError
+	switch {
+	case errors.As(err, &validationErr):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case errors.As(err, &lockedErr):
+		http.Error(w, "Items can only be cancelled before the order is out for delivery", http.StatusConflict)
+		return
+	case errors.Is(err, ErrGroupOrderItems):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case errors.Is(err, ErrLastItem):
+		http.Error(w, "These are the last items of the order, cancel the order instead", http.StatusConflict)
+		return
+	case err != nil:
+		writeStoreError(w, err)
+		return
+	}
+	outbox.Wake()
+
+	json.NewEncoder(w).Encode(order)
+}
+
+// notifyPaymentRefund queues a partial refund of the order's completed payment
+func notifyPaymentRefund(tx *OrderTx, order Order, cancellation ItemCancellation) error {
+	amount := cancellation.Refund
+	if !amount.IsPositive() {
+		return nil
+	}
+	reference := fmt.Sprintf("order-%d-cancellation-%d", order.ID, cancellation.ID)
+	refundData := map[string]interface{}{
+		"amount":   amount,
+		"currency": order.Currency,
+		"reason":   fmt.Sprintf("%d x %s cancelled", cancellation.Quantity, cancellation.description()),
+		"lines": []PriceLine{{
+			Type:        lineItems,
+			Description: fmt.Sprintf("%d x %s", cancellation.Quantity, cancellation.description()),
+			Amount:      amount,
+			VATRate:     config.Fees.FoodVATRate,
+		}},
+		"reference": reference,
+	}
+
+	return tx.Enqueue(OutboxEvent{
+		OrderID:        order.ID,
+		Destination:    "payment",
+		Method:         "POST",
+		Path:           fmt.Sprintf("/order/%d/refunds", order.ID),
+		IdempotencyKey: reference,
+	}, refundData)
+}
+
+// notifyItemsCancelled tells the customer what was taken off their order
+func notifyItemsCancelled(tx *OrderTx, order Order, cancellation ItemCancellation) error {
+	message := fmt.Sprintf("%d x %s was removed from your order #%d", cancellation.Quantity, cancellation.description(), order.ID)
+	if cancellation.Reason != "" {
+		message += fmt.Sprintf(" (%s)", cancellation.Reason)
+	}
+	if cancellation.Refund.IsPositive() && (order.Status == "paid" || order.Status == "awaiting_restaurant" || order.Status == "preparing") {
+		message += fmt.Sprintf(". %s will be refunded to you.", cancellation.Refund)
+	} else {
+		message += fmt.Sprintf(". Your new total is %s.", order.TotalAmount)
+	}
+	notificationData := map[string]interface{}{
+		"userId":  order.UserID,
+		"type":    "order_update",
+		"message": message,
+		"orderId": order.ID,
+		"status":  order.Status,
+	}
+
+	return tx.Enqueue(OutboxEvent{
+		OrderID:        order.ID,
+		Destination:    "notification",
+		Method:         "POST",
+		IdempotencyKey: fmt.Sprintf("order-%d-cancellation-%d-notification", order.ID, cancellation.ID),
+	}, notificationData)
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"quickbite/shared/money"
+)
+
+var (
+	// ErrCartNotFound is returned by a CartStore when the user has no cart
+	ErrCartNotFound = errors.New("cart not found")
+	// ErrCartChanged means the cart changed while it was being checked out
+	ErrCartChanged = errors.New("cart changed during checkout")
+	// ErrCartOtherRestaurant means an item was added from a restaurant other than the cart's
+	ErrCartOtherRestaurant = errors.New("cart holds items from another restaurant")
+)
+
+// Cart is what a user is about to order, kept server-side so it follows
+// them across devices. All items come from one restaurant.
+type Cart struct {
+	UserID       int         `json:"userId"`
+	RestaurantID int         `json:"restaurantId,omitempty"` // 0 while the cart is empty
+	Items        []OrderItem `json:"items"`
+	CreatedAt    time.Time   `json:"createdAt"`
+	UpdatedAt    time.Time   `json:"updatedAt"`
+	ExpiresAt    time.Time   `json:"expiresAt"` // emptied if not touched by then
+}
+
+// CartView is a cart checked against the restaurant's current menu
+type CartView struct {
+	Cart
+	Quote   *Order          `json:"quote,omitempty"` // the cart priced as an order, nil while empty
+	Changes []ReorderChange `json:"changes"`         // menu changes since the items were added
+}
+
+// CartStore persists carts. It is part of OrderStore so checking out
+// removes the cart in the same transaction that creates the order.
+type CartStore interface {
+	// GetCart returns a user's cart or ErrCartNotFound
+	GetCart(userID int) (Cart, error)
+	// UpdateCart applies fn to the user's cart, a new empty one if there is
+	// none or it expired, and saves the result atomically. If fn returns an
+	// error nothing is written.
+	UpdateCart(userID int, fn func(cart *Cart) error) (Cart, error)
+	// DeleteCart removes a user's cart, if there is one
+	DeleteCart(userID int) error
+	// PurgeExpiredCarts removes the carts that expired before now and returns how many
+	PurgeExpiredCarts(now time.Time) (int, error)
+}
+
+// CheckoutCart removes a cart in the current transaction. The store fails
+// the transaction with ErrCartChanged if the cart was updated since it was read.
+func (tx *OrderTx) CheckoutCart(cart Cart) {
+	tx.carts = append(tx.carts, cart)
+}
+
+func newCart(userID int, now time.Time) Cart {
+	return Cart{UserID: userID, Items: []OrderItem{}, CreatedAt: now, UpdatedAt: now, ExpiresAt: now.Add(config.CartTTL)}
+}
+
+func (c *Cart) expired(now time.Time) bool {
+	return !c.ExpiresAt.After(now)
+}
+
+// touch records a change and pushes the expiry back
+func (c *Cart) touch(now time.Time) {
+	c.UpdatedAt = now
+	c.ExpiresAt = now.Add(config.CartTTL)
+	if len(c.Items) == 0 {
+		c.RestaurantID = 0
+	}
+}
+
+// cloneCart copies the items so callers can't mutate stored state
+func cloneCart(cart Cart) Cart {
+	cart.Items = append([]OrderItem(nil), cart.Items...)
+	return cart
+}
+
+// loadCart returns the user's live cart, or an empty one
+func loadCart(userID int, now time.Time) (Cart, error) {
+	cart, err := store.GetCart(userID)
+	if errors.Is(err, ErrCartNotFound) || err == nil && cart.expired(now) {
+		return newCart(userID, now), nil
+	}
+	return cart, err
+}
+
+// Write the HTTP error matching a cart error
+func writeCartError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, ErrCartOtherRestaurant):
+		http.Error(w, "The cart has items from another restaurant, empty it or add with \"replace\": true", http.StatusConflict)
+	default:
+		writeStoreError(w, err)
+	}
+}
+
+// Get a user's cart, re-priced against the restaurant's current menu. Items
+// that left the menu are listed in changes and not part of the quote.
+func getCart(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	params := mux.Vars(r)
+	userID, err := strconv.Atoi(params["userId"])
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	cart, err := loadCart(userID, time.Now())
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	view := CartView{Cart: cart, Changes: []ReorderChange{}}
+	if len(cart.Items) == 0 {
+		json.NewEncoder(w).Encode(view)
+		return
+	}
+
+	menu, err := fetchMenu(cart.RestaurantID)
+	if err != nil {
+		writePricingError(w, err)
+		return
+	}
+	items, changes, err := reorderItems(cart.Items, menu)
+	if err != nil {
+		writePricingError(w, err)
+		return
+	}
+	view.Changes = changes
+	if len(items) > 0 {
+		quote := Order{UserID: userID, RestaurantID: cart.RestaurantID, Items: items, Currency: config.Currency}
+		if _, err := priceOrder(&quote, config.Fees, time.Now()); err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		view.Quote = &quote
+	}
+	json.NewEncoder(w).Encode(view)
+}
+
+// Add an item to the cart or change its quantity. The same item with other
+// options or instructions is a separate line. Items from another restaurant
+// are refused unless "replace" is set, which empties the cart first.
+func setCartItem(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	params := mux.Vars(r)
+	userID, err := strconv.Atoi(params["userId"])
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+	menuItemID, err := strconv.Atoi(params["menuItemId"])
+	if err != nil {
+		http.Error(w, "Invalid menu item ID", http.StatusBadRequest)
+		return
+	}
+
+	var itemRequest struct {
+		RestaurantID int              `json:"restaurantId"`
+		Quantity     int              `json:"quantity"`
+		Options      []SelectedOption `json:"options"`
+		Instructions string           `json:"instructions"`
+		Replace      bool             `json:"replace"`
+	}
+	err = json.NewDecoder(r.Body).Decode(&itemRequest)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if itemRequest.RestaurantID == 0 {
+		http.Error(w, "restaurantId is required", http.StatusBadRequest)
+		return
+	}
+
+	// Priced before taking the store lock, the menu is a network call away
+	priced, err := priceOrderItems(itemRequest.RestaurantID, []OrderItem{{
+		MenuItemID:   menuItemID,
+		Quantity:     itemRequest.Quantity,
+		Options:      itemRequest.Options,
+		Instructions: itemRequest.Instructions,
+	}})
+	if err != nil {
+		writePricingError(w, err)
+		return
+	}
+
+	cart, err := store.UpdateCart(userID, func(cart *Cart) error {
+		if len(cart.Items) > 0 && cart.RestaurantID != itemRequest.RestaurantID {
+			if !itemRequest.Replace {
+				return ErrCartOtherRestaurant
+			}
+			cart.Items = []OrderItem{}
+		}
+		cart.RestaurantID = itemRequest.RestaurantID
+
+		replaced := false
+		for i := range cart.Items {
+			if sameLine(cart.Items[i], priced[0]) {
+				cart.Items[i] = priced[0]
+				replaced = true
+			}
+		}
+		if !replaced {
+			cart.Items = append(cart.Items, priced[0])
+		}
+		cart.touch(time.Now())
+		return nil
+	})
+	if err != nil {
+		writeCartError(w, err)
+		return
+	}
+	json.NewEncoder(w).Encode(cart)
+}
+
+// Take an item out of the cart, every line of it whatever its options
+func removeCartItem(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	params := mux.Vars(r)
+	userID, err := strconv.Atoi(params["userId"])
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+	menuItemID, err := strconv.Atoi(params["menuItemId"])
+	if err != nil {
+		http.Error(w, "Invalid menu item ID", http.StatusBadRequest)
+		return
+	}
+
+	cart, err := store.UpdateCart(userID, func(cart *Cart) error {
+		kept := []OrderItem{}
+		for _, item := range cart.Items {
+			if item.MenuItemID != menuItemID {
+				kept = append(kept, item)
+			}
+		}
+		cart.Items = kept
+		cart.touch(time.Now())
+		return nil
+	})
+	if err != nil {
+		writeCartError(w, err)
+		return
+	}
+	json.NewEncoder(w).Encode(cart)
+}
+
+// Empty a user's cart
+func clearCart(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	userID, err := strconv.Atoi(params["userId"])
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	if err := store.DeleteCart(userID); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Turn the cart into an order. The items are priced again from the menu and
+// the cart is removed in the same transaction that stores the order.
+func checkoutCart(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	params := mux.Vars(r)
+	userID, err := strconv.Atoi(params["userId"])
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	var checkoutRequest struct {
+		Address      DeliveryAddress `json:"address"`
+		AddressID    int             `json:"addressId"` // a saved address instead of Address
+		Tip          money.Money     `json:"tip"`
+		PromoCode    string          `json:"promoCode"`
+		ScheduledFor *time.Time      `json:"scheduledFor"`
+	}
+	err = json.NewDecoder(r.Body).Decode(&checkoutRequest)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	cart, err := loadCart(userID, time.Now())
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	if len(cart.Items) == 0 {
+		http.Error(w, "The cart is empty", http.StatusConflict)
+		return
+	}
+
+	order := Order{
+		UserID:       userID,
+		RestaurantID: cart.RestaurantID,
+		Items:        cart.Items,
+		PromoCode:    checkoutRequest.PromoCode,
+		Tip:          checkoutRequest.Tip,
+		Address:      checkoutRequest.Address,
+		AddressID:    checkoutRequest.AddressID,
+		ScheduledFor: checkoutRequest.ScheduledFor,
+	}
+	placeOrder(w, r, order, func(order *Order, tx *OrderTx) error {
+		tx.CheckoutCart(cart)
+		return nil
+	})
+}
+
+// purgeCarts removes the carts nobody touched within CART_TTL
+func (s *OrderScheduler) purgeCarts(now time.Time) {
+	purged, err := store.PurgeExpiredCarts(now)
+	if err != nil {
+		log.Printf("Error purging expired carts: %v", err)
+		return
+	}
+	if purged > 0 {
+		log.Printf("Purged %d expired carts", purged)
+	}
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"quickbite/shared/money"
+)
+
+// Promo code types
+const (
+	promoPercent      = "percent"       // Percent off the items subtotal
+	promoFixed        = "fixed"         // Amount off the items subtotal
+	promoFreeDelivery = "free_delivery" // waives the delivery fee
+	promoBuyXGetY     = "buy_x_get_y"   // every BuyQuantity+GetQuantity units of MenuItemID, GetQuantity are free
+)
+
+// ErrPromoNotFound is returned when a promo code does not exist
+var ErrPromoNotFound = errors.New("promo code not found")
+
+// PromoCode is a discount customers can apply to an order
+type PromoCode struct {
+	Code           string      `json:"code"` // stored upper-case
+	Type           string      `json:"type"`
+	Percent        float64     `json:"percent,omitempty"`    // percent only
+	Amount         money.Money `json:"amount"`               // fixed only
+	MenuItemID     int         `json:"menuItemId,omitempty"` // buy_x_get_y only
+	BuyQuantity    int         `json:"buyQuantity,omitempty"`
+	GetQuantity    int         `json:"getQuantity,omitempty"`
+	MinBasket      money.Money `json:"minBasket"`               // minimum items subtotal
+	RestaurantIDs  []int       `json:"restaurantIds,omitempty"` // empty means every restaurant
+	ValidFrom      *time.Time  `json:"validFrom,omitempty"`
+	ValidUntil     *time.Time  `json:"validUntil,omitempty"`
+	MaxUsesPerUser int         `json:"maxUsesPerUser,omitempty"` // 0 means unlimited
+	MaxUses        int         `json:"maxUses,omitempty"`        // 0 means unlimited
+	Active         bool        `json:"active"`
+	Description    string      `json:"description,omitempty"`
+	CreatedAt      time.Time   `json:"createdAt"`
+	UpdatedAt      time.Time   `json:"updatedAt"`
+}
+
+// AppliedDiscount is a discount itemised on an order
+type AppliedDiscount struct {
+	Code        string      `json:"code"`
+	Type        string      `json:"type"`
+	Description string      `json:"description"`
+	Amount      money.Money `json:"amount"`
+}
+
+// PromoRedemption records that a user used a promo code on an order
+type PromoRedemption struct {
+	Code           string
+	UserID         int
+	OrderID        int
+	MaxUsesPerUser int
+	MaxUses        int
+	RedeemedAt     time.Time
+}
+
+// PromoStore is the promo code side of an OrderStore. Redemptions are added
+// through OrderTx so usage limits are checked in the order's transaction.
+type PromoStore interface {
+	ListPromoCodes() ([]PromoCode, error)
+	GetPromoCode(code string) (PromoCode, error)
+	// SavePromoCode creates or replaces a promo code
+	SavePromoCode(promo PromoCode) error
+	DeletePromoCode(code string) error
+}
+
+// RedeemPromo records a promo code use in the current transaction. The store
+// rejects the whole transaction if it would exceed the code's usage limits.
+func (tx *OrderTx) RedeemPromo(redemption PromoRedemption) {
+	tx.redemptions = append(tx.redemptions, redemption)
+}
+
+// checkRedemptionLimits returns a *ValidationError if one more use of a code
+// would go over its limits, given how often it was already used
+func checkRedemptionLimits(redemption PromoRedemption, usesByUser, uses int) error {
+	if redemption.MaxUsesPerUser > 0 && usesByUser >= redemption.MaxUsesPerUser {
+		return &ValidationError{Message: fmt.Sprintf("Promo code %s was already used the maximum number of times", redemption.Code)}
+	}
+	if redemption.MaxUses > 0 && uses >= redemption.MaxUses {
+		return &ValidationError{Message: fmt.Sprintf("Promo code %s is no longer available", redemption.Code)}
+	}
+	return nil
+}
+
+// normalisePromoCode makes codes case-insensitive
+func normalisePromoCode(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+// validatePromoCode checks a promo code definition sent by an admin
+func validatePromoCode(promo PromoCode) error {
+	if promo.Code == "" {
+		return &ValidationError{Message: "Promo code is required"}
+	}
+	switch promo.Type {
+	case promoPercent:
+		if promo.Percent <= 0 || promo.Percent > 100 {
+			return &ValidationError{Message: "Percent promo codes need a percent between 0 and 100"}
+		}
+	case promoFixed:
+		if !promo.Amount.IsPositive() {
+			return &ValidationError{Message: "Fixed promo codes need a positive amount"}
+		}
+	case promoFreeDelivery:
+	case promoBuyXGetY:
+		if promo.MenuItemID == 0 || promo.BuyQuantity <= 0 || promo.GetQuantity <= 0 {
+			return &ValidationError{Message: "Buy X get Y promo codes need menuItemId, buyQuantity and getQuantity"}
+		}
+	default:
+		return &ValidationError{Message: "Invalid promo type, expected percent, fixed, free_delivery or buy_x_get_y"}
+	}
+	if promo.ValidFrom != nil && promo.ValidUntil != nil && !promo.ValidUntil.After(*promo.ValidFrom) {
+		return &ValidationError{Message: "validUntil must be after validFrom"}
+	}
+	if promo.MinBasket.Amount < 0 || promo.MaxUses < 0 || promo.MaxUsesPerUser < 0 {
+		return &ValidationError{Message: "Limits can't be negative"}
+	}
+	return nil
+}
+
+// computeDiscount works out what a promo code takes off an order. The order
+// must already be priced; subtotal is the sum of its items and deliveryFee
+// what delivering it costs.
+func computeDiscount(promo PromoCode, order Order, subtotal, deliveryFee money.Money, now time.Time) (AppliedDiscount, error) {
+	invalid := func(format string, args ...interface{}) (AppliedDiscount, error) {
+		return AppliedDiscount{}, &ValidationError{Message: fmt.Sprintf(format, args...)}
+	}
+
+	if !promo.Active {
+		return invalid("Promo code %s is not active", promo.Code)
+	}
+	if promo.ValidFrom != nil && now.Before(*promo.ValidFrom) {
+		return invalid("Promo code %s is not valid yet", promo.Code)
+	}
+	if promo.ValidUntil != nil && !now.Before(*promo.ValidUntil) {
+		return invalid("Promo code %s has expired", promo.Code)
+	}
+	if len(promo.RestaurantIDs) > 0 {
+		allowed := false
+		for _, id := range promo.RestaurantIDs {
+			if id == order.RestaurantID {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return invalid("Promo code %s can't be used at this restaurant", promo.Code)
+		}
+	}
+	if subtotal.Cmp(promo.MinBasket) < 0 {
+		return invalid("Promo code %s needs a basket of at least %s", promo.Code, promo.MinBasket)
+	}
+
+	discount := AppliedDiscount{Code: promo.Code, Type: promo.Type, Description: promo.Description}
+	switch promo.Type {
+	case promoPercent:
+		discount.Amount = subtotal.Percent(promo.Percent)
+		if discount.Description == "" {
+			discount.Description = fmt.Sprintf("%g%% off", promo.Percent)
+		}
+	case promoFixed:
+		discount.Amount = promo.Amount.Min(subtotal)
+		if discount.Description == "" {
+			discount.Description = fmt.Sprintf("%s off", promo.Amount)
+		}
+	case promoFreeDelivery:
+		if deliveryFee.IsZero() {
+			return invalid("Promo code %s: delivery is already free for this order", promo.Code)
+		}
+		discount.Amount = deliveryFee
+		if discount.Description == "" {
+			discount.Description = "Free delivery"
+		}
+	case promoBuyXGetY:
+		// Lines of the item may cost more or less by their options, the
+		// free units are priced at the cheapest
+		quantity := 0
+		var price money.Money
+		for _, item := range order.Items {
+			if item.MenuItemID == promo.MenuItemID {
+				if quantity == 0 || item.Price.Cmp(price) < 0 {
+					price = item.Price
+				}
+				quantity += item.Quantity
+			}
+		}
+		free := quantity / (promo.BuyQuantity + promo.GetQuantity) * promo.GetQuantity
+		if free == 0 {
+			return invalid("Promo code %s needs %d of menu item %d in the order",
+				promo.Code, promo.BuyQuantity+promo.GetQuantity, promo.MenuItemID)
+		}
+		discount.Amount = price.Mul(free)
+		if discount.Description == "" {
+			discount.Description = fmt.Sprintf("Buy %d get %d free", promo.BuyQuantity, promo.GetQuantity)
+		}
+	}
+	return discount, nil
+}
+
+// applyPromoCode looks up the order's promo code and sets the itemised
+// Discounts. deliveryFee is what a free delivery code waives.
+func applyPromoCode(order *Order, deliveryFee money.Money, now time.Time) (*PromoCode, error) {
+	order.Discounts = nil
+	order.PromoCode = normalisePromoCode(order.PromoCode)
+	if order.PromoCode == "" {
+		return nil, nil
+	}
+	promo, err := store.GetPromoCode(order.PromoCode)
+	if errors.Is(err, ErrPromoNotFound) {
+		return nil, &ValidationError{Message: fmt.Sprintf("Unknown promo code %s", order.PromoCode)}
+	}
+	if err != nil {
+		return nil, err
+	}
+	discount, err := computeDiscount(promo, *order, order.Subtotal, deliveryFee, now)
+	if err != nil {
+		return nil, err
+	}
+	order.Discounts = []AppliedDiscount{discount}
+	return &promo, nil
+}
+
+// List all promo codes
+func getPromoCodes(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	promos, err := store.ListPromoCodes()
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	if promos == nil {
+		promos = []PromoCode{}
+	}
+	json.NewEncoder(w).Encode(promos)
+}
+
+// Get a promo code
+func getPromoCode(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	promo, err := store.GetPromoCode(normalisePromoCode(mux.Vars(r)["code"]))
+	if errors.Is(err, ErrPromoNotFound) {
+		http.Error(w, "Promo code not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	json.NewEncoder(w).Encode(promo)
+}
+
+// Create a promo code
+func createPromoCode(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	var promo PromoCode
+	if err := json.NewDecoder(r.Body).Decode(&promo); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	promo.Code = normalisePromoCode(promo.Code)
+	if err := validatePromoCode(promo); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	_, err := store.GetPromoCode(promo.Code)
+	if err == nil {
+		http.Error(w, "Promo code already exists", http.StatusConflict)
+		return
+	}
+	if !errors.Is(err, ErrPromoNotFound) {
+		writeStoreError(w, err)
+		return
+	}
+
+	now := time.Now()
+	promo.CreatedAt = now
+	promo.UpdatedAt = now
+	if err := store.SavePromoCode(promo); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(promo)
+}
+
+// Replace a promo code
+func updatePromoCode(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	code := normalisePromoCode(mux.Vars(r)["code"])
+	existing, err := store.GetPromoCode(code)
+	if errors.Is(err, ErrPromoNotFound) {
+		http.Error(w, "Promo code not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	var promo PromoCode
+	if err := json.NewDecoder(r.Body).Decode(&promo); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	promo.Code = code
+	if err := validatePromoCode(promo); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	promo.CreatedAt = existing.CreatedAt
+	promo.UpdatedAt = time.Now()
+	if err := store.SavePromoCode(promo); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	json.NewEncoder(w).Encode(promo)
+}
+
+// Delete a promo code. Orders that used it keep their itemised discount.
+func deletePromoCode(w http.ResponseWriter, r *http.Request) {
+	err := store.DeletePromoCode(normalisePromoCode(mux.Vars(r)["code"]))
+	if errors.Is(err, ErrPromoNotFound) {
+		http.Error(w, "Promo code not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
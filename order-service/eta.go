@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// What an order's ETA is based on, from roughest to most precise
+const (
+	etaEstimated  = "estimated"  // default prep and delivery times
+	etaScheduled  = "scheduled"  // the delivery time the customer asked for
+	etaRestaurant = "restaurant" // the restaurant quoted a prep time
+	etaInTransit  = "in_transit" // the courier has the food
+	etaDelivered  = "delivered"
+)
+
+// OrderETA is when an order should arrive. It combines the restaurant's prep
+// time with the courier's delivery estimate and is updated as the order moves on.
+type OrderETA struct {
+	EstimatedAt     time.Time  `json:"estimatedAt"`     // when the order should arrive
+	ReadyAt         time.Time  `json:"readyAt"`         // when the food should be ready for pickup
+	DeliveryMinutes int        `json:"deliveryMinutes"` // from pickup to the door
+	CourierAssigned bool       `json:"courierAssigned"` // DeliveryMinutes is the courier's own estimate
+	Basis           string     `json:"basis"`           // "estimated", "scheduled", "restaurant", "in_transit", "delivered"
+	PickedUpAt      *time.Time `json:"pickedUpAt,omitempty"`
+	DeliveredAt     *time.Time `json:"deliveredAt,omitempty"`
+	UpdatedAt       time.Time  `json:"updatedAt"`
+}
+
+// updateETA works out the ETA for the order's current status. It runs on
+// every status change and whenever a new estimate comes in.
+func updateETA(order *Order, now time.Time) {
+	if order.Status == "cancelled" {
+		order.ETA = nil
+		return
+	}
+	eta := order.ETA
+	if eta == nil {
+		eta = &OrderETA{DeliveryMinutes: int(config.DefaultDeliveryTime.Minutes())}
+		order.ETA = eta
+	}
+	eta.UpdatedAt = now
+	delivery := time.Duration(eta.DeliveryMinutes) * time.Minute
+
+	switch order.Status {
+	case "scheduled":
+		eta.Basis = etaScheduled
+		eta.EstimatedAt = *order.ScheduledFor
+		eta.ReadyAt = eta.EstimatedAt.Add(-delivery)
+		return
+	case "out_for_delivery":
+		if eta.PickedUpAt == nil {
+			pickedUpAt := now
+			eta.PickedUpAt = &pickedUpAt
+		}
+		eta.Basis = etaInTransit
+		eta.EstimatedAt = eta.PickedUpAt.Add(delivery)
+		return
+	case "delivered":
+		deliveredAt := now
+		eta.DeliveredAt = &deliveredAt
+		eta.Basis = etaDelivered
+		return
+	}
+
+	eta.Basis = etaEstimated
+	eta.ReadyAt = now.Add(config.DefaultPrepTime)
+	if order.Status == "preparing" && order.Acceptance != nil && order.Acceptance.ReadyAt != nil {
+		eta.Basis = etaRestaurant
+		eta.ReadyAt = *order.Acceptance.ReadyAt
+	}
+	// A kitchen running late is ready no earlier than now
+	if eta.ReadyAt.Before(now) {
+		eta.ReadyAt = now
+	}
+	eta.EstimatedAt = eta.ReadyAt.Add(delivery)
+	// Scheduled orders are never brought early
+	if order.ScheduledFor != nil && eta.EstimatedAt.Before(*order.ScheduledFor) {
+		eta.EstimatedAt = *order.ScheduledFor
+	}
+}
+
+// recordDeliveryEstimate takes delivery-service's estimate once a delivery
+// is created for the order
+func recordDeliveryEstimate(order *Order, minutes int, courierAssigned bool, now time.Time) {
+	if order.ETA == nil || order.Status == "cancelled" || order.Status == "delivered" {
+		return
+	}
+	if minutes > 0 {
+		order.ETA.DeliveryMinutes = minutes
+	}
+	order.ETA.CourierAssigned = courierAssigned
+	updateETA(order, now)
+}
+
+// etaMessage is the sentence notifications add about when the order arrives
+func etaMessage(order Order) string {
+	if order.ETA == nil || order.ETA.Basis == etaDelivered {
+		return ""
+	}
+	minutes := int(math.Ceil(time.Until(order.ETA.EstimatedAt).Minutes()))
+	if minutes <= 1 {
+		return " It should arrive any minute now."
+	}
+	return fmt.Sprintf(" It should arrive in about %d minutes.", minutes)
+}
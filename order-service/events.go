@@ -0,0 +1,276 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Buffered events per subscriber. A client that falls this far behind is
+// disconnected and resumes with Last-Event-ID when it reconnects.
+const statusSubscriberBuffer = 32
+
+// StatusEvent is a status change as sent on the event streams. Its ID is the
+// ID of the change in the order's history, which the store hands out in
+// commit order, so streams resume from the history after a restart.
+type StatusEvent struct {
+	ID      int64     `json:"id"`
+	OrderID int       `json:"orderId"`
+	UserID  int       `json:"userId"`
+	From    string    `json:"from"`
+	Status  string    `json:"status"`
+	Actor   string    `json:"actor"`
+	Reason  string    `json:"reason,omitempty"`
+	At      time.Time `json:"at"`
+}
+
+func newStatusEvent(change StatusChange, userID int) StatusEvent {
+	return StatusEvent{
+		ID:      change.ID,
+		OrderID: change.OrderID,
+		UserID:  userID,
+		From:    change.From,
+		Status:  change.To,
+		Actor:   change.Actor,
+		Reason:  change.Reason,
+		At:      change.At,
+	}
+}
+
+// StatusBroker fans committed status changes out to the open event streams
+type StatusBroker struct {
+	mutex       sync.Mutex
+	subscribers map[*statusSubscriber]bool
+}
+
+// statusSubscriber is one open stream, for an order or for all orders of a user
+type statusSubscriber struct {
+	orderID int // 0 for a user stream
+	userID  int // 0 for an order stream
+	events  chan StatusEvent
+}
+
+func newStatusBroker() *StatusBroker {
+	return &StatusBroker{subscribers: make(map[*statusSubscriber]bool)}
+}
+
+// Subscribe opens a subscription to the changes of one order or of one user's orders
+func (b *StatusBroker) Subscribe(orderID, userID int) *statusSubscriber {
+	sub := &statusSubscriber{orderID: orderID, userID: userID, events: make(chan StatusEvent, statusSubscriberBuffer)}
+	b.mutex.Lock()
+	b.subscribers[sub] = true
+	b.mutex.Unlock()
+	return sub
+}
+
+// Unsubscribe closes a subscription; it is safe to call more than once
+func (b *StatusBroker) Unsubscribe(sub *statusSubscriber) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.subscribers[sub] {
+		delete(b.subscribers, sub)
+		close(sub.events)
+	}
+}
+
+// Publish sends an event to the matching subscribers without blocking. It is
+// called with the store locked, so a subscriber with a full buffer is dropped
+// rather than waited for.
+func (b *StatusBroker) Publish(event StatusEvent) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for sub := range b.subscribers {
+		if sub.orderID != 0 && sub.orderID != event.OrderID || sub.userID != 0 && sub.userID != event.UserID {
+			continue
+		}
+		select {
+		case sub.events <- event:
+		default:
+			log.Printf("Dropping slow status stream subscriber (order %d, user %d)", sub.orderID, sub.userID)
+			delete(b.subscribers, sub)
+			close(sub.events)
+		}
+	}
+}
+
+// committed publishes the status changes of a transaction once the store has
+// written it
+func (tx *OrderTx) committed(order Order) {
+	if statusEvents == nil {
+		return
+	}
+	for _, change := range tx.transitions {
+		statusEvents.Publish(newStatusEvent(change, order.UserID))
+	}
+}
+
+// lastEventID reads where a client wants to resume: the Last-Event-ID header
+// browsers send when reconnecting, or ?lastEventId= for the first connection
+func lastEventID(r *http.Request) (int64, error) {
+	value := r.Header.Get("Last-Event-ID")
+	if value == "" {
+		value = r.URL.Query().Get("lastEventId")
+	}
+	if value == "" {
+		return 0, nil
+	}
+	return strconv.ParseInt(value, 10, 64)
+}
+
+// missedEvents returns the status changes of the orders after lastID, oldest first
+func missedEvents(orders []Order, lastID int64) ([]StatusEvent, error) {
+	var missed []StatusEvent
+	for _, order := range orders {
+		transitions, err := store.History(order.ID)
+		if err != nil {
+			return nil, err
+		}
+		for _, change := range transitions {
+			if change.ID > lastID {
+				missed = append(missed, newStatusEvent(change, order.UserID))
+			}
+		}
+	}
+	sort.Slice(missed, func(i, j int) bool { return missed[i].ID < missed[j].ID })
+	return missed, nil
+}
+
+// streamStatusEvents sends the missed events, then live ones, until the
+// client goes away. Subscribing happens before the missed events are read so
+// nothing falls in between; live events that were also replayed are skipped.
+func streamStatusEvents(w http.ResponseWriter, r *http.Request, sub *statusSubscriber, missed func() ([]StatusEvent, error)) {
+	defer statusEvents.Unsubscribe(sub)
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	events, err := missed()
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	// Stops proxies like nginx from buffering the stream
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	// Tells EventSource how long to wait before reconnecting
+	fmt.Fprintf(w, "retry: %d\n\n", config.StreamRetry.Milliseconds())
+
+	send := func(event StatusEvent) bool {
+		data, err := json.Marshal(event)
+		if err != nil {
+			log.Printf("Error marshaling status event: %v", err)
+			return true
+		}
+		_, err = fmt.Fprintf(w, "id: %d\nevent: status\ndata: %s\n\n", event.ID, data)
+		return err == nil
+	}
+	replayed := make(map[int64]bool, len(events))
+	for _, event := range events {
+		if !send(event) {
+			return
+		}
+		replayed[event.ID] = true
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(config.StreamHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case event, open := <-sub.events:
+			if !open {
+				// Dropped for falling behind; the client reconnects and resumes
+				return
+			}
+			if replayed[event.ID] {
+				continue
+			}
+			if !send(event) {
+				return
+			}
+			flusher.Flush()
+		case <-heartbeat.C:
+			// A comment line keeps proxies from closing an idle connection
+			if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// Stream the status changes of an order as Server-Sent Events. Without a
+// Last-Event-ID the whole history is sent first, so the client starts from
+// the current status.
+func getOrderEvents(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	id, err := strconv.Atoi(params["id"])
+	if err != nil {
+		http.Error(w, "Invalid order ID", http.StatusBadRequest)
+		return
+	}
+	lastID, err := lastEventID(r)
+	if err != nil {
+		http.Error(w, "Invalid Last-Event-ID", http.StatusBadRequest)
+		return
+	}
+
+	if _, err := store.Get(id); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	sub := statusEvents.Subscribe(id, 0)
+	streamStatusEvents(w, r, sub, func() ([]StatusEvent, error) {
+		// Read again now that changes are being collected
+		order, err := store.Get(id)
+		if err != nil {
+			return nil, err
+		}
+		return missedEvents([]Order{order}, lastID)
+	})
+}
+
+// Stream the status changes of all orders of a user as Server-Sent Events.
+// Only changes after Last-Event-ID are replayed; without one the stream
+// starts with the next change.
+func getUserOrderEvents(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	userID, err := strconv.Atoi(params["userId"])
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+	lastID, err := lastEventID(r)
+	if err != nil {
+		http.Error(w, "Invalid Last-Event-ID", http.StatusBadRequest)
+		return
+	}
+
+	sub := statusEvents.Subscribe(0, userID)
+	streamStatusEvents(w, r, sub, func() ([]StatusEvent, error) {
+		if lastID == 0 {
+			return nil, nil
+		}
+		orders, err := store.Query(OrderQuery{UserID: userID})
+		if err != nil {
+			return nil, err
+		}
+		return missedEvents(orders, lastID)
+	})
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"quickbite/shared/money"
+)
+
+// Export file formats
+const (
+	exportCSV    = "csv"
+	exportNDJSON = "ndjson"
+)
+
+// Orders read from the store per page while exporting
+const exportPageSize = maxPageSize
+
+// orderExportColumns is the CSV header of the order export. Columns are only
+// ever added at the end so finance's imports keep working.
+var orderExportColumns = []string{
+	"order_id", "created_at", "user_id", "restaurant_id", "status", "currency",
+	"subtotal", "discounts", "fees", "tip", "vat", "total",
+	"line_no", "menu_item_id", "item_name", "unit_price", "quantity", "line_total",
+	"options", "instructions",
+}
+
+// OrderExportLine is one item line of an exported order, with the order's
+// columns repeated on each line. An order without items has a single line
+// with LineNo 0.
+type OrderExportLine struct {
+	OrderID      int         `json:"order_id"`
+	CreatedAt    time.Time   `json:"created_at"`
+	UserID       int         `json:"user_id"`
+	RestaurantID int         `json:"restaurant_id"`
+	Status       string      `json:"status"`
+	Currency     string      `json:"currency"`
+	Subtotal     money.Money `json:"subtotal"`  // items before discounts
+	Discounts    money.Money `json:"discounts"` // positive
+	Fees         money.Money `json:"fees"`      // delivery, small basket and service fees
+	Tip          money.Money `json:"tip"`
+	VAT          money.Money `json:"vat"` // included in the total
+	Total        money.Money `json:"total"`
+	LineNo       int         `json:"line_no"`
+	MenuItemID   int         `json:"menu_item_id"`
+	ItemName     string      `json:"item_name"`
+	UnitPrice    money.Money `json:"unit_price"` // options included
+	Quantity     int         `json:"quantity"`
+	LineTotal    money.Money `json:"line_total"`
+	Options      string      `json:"options"` // chosen option names separated by "; "
+	Instructions string      `json:"instructions"`
+}
+
+// exportLines flattens an order into one line per item
+func exportLines(order Order, location *time.Location) []OrderExportLine {
+	zero := money.New(0, order.Currency)
+	base := OrderExportLine{
+		OrderID:      order.ID,
+		CreatedAt:    order.CreatedAt.In(location),
+		UserID:       order.UserID,
+		RestaurantID: order.RestaurantID,
+		Status:       order.Status,
+		Currency:     order.Currency,
+		Subtotal:     order.Subtotal,
+		Discounts:    zero,
+		Fees:         zero,
+		Tip:          order.Tip,
+		VAT:          zero,
+		Total:        order.TotalAmount,
+		UnitPrice:    zero,
+		LineTotal:    zero,
+	}
+	for _, discount := range order.Discounts {
+		base.Discounts = base.Discounts.Add(discount.Amount)
+	}
+	if order.Pricing != nil {
+		for _, line := range order.Pricing.Lines {
+			switch line.Type {
+			case lineDeliveryFee, lineSmallBasketFee, lineServiceFee:
+				base.Fees = base.Fees.Add(line.Amount)
+			}
+		}
+		for _, tax := range order.Pricing.Taxes {
+			base.VAT = base.VAT.Add(tax.VAT)
+		}
+	}
+
+	if len(order.Items) == 0 {
+		return []OrderExportLine{base}
+	}
+	lines := make([]OrderExportLine, 0, len(order.Items))
+	for i, item := range order.Items {
+		line := base
+		line.LineNo = i + 1
+		line.MenuItemID = item.MenuItemID
+		line.ItemName = item.Name
+		line.UnitPrice = item.Price
+		line.Quantity = item.Quantity
+		line.LineTotal = item.Price.Mul(item.Quantity)
+		line.Options = optionsSummary(item)
+		line.Instructions = item.Instructions
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// record is the line as CSV fields, in orderExportColumns order
+func (l OrderExportLine) record() []string {
+	return []string{
+		strconv.Itoa(l.OrderID),
+		l.CreatedAt.Format(time.RFC3339),
+		strconv.Itoa(l.UserID),
+		strconv.Itoa(l.RestaurantID),
+		l.Status,
+		l.Currency,
+		l.Subtotal.Decimal(),
+		l.Discounts.Decimal(),
+		l.Fees.Decimal(),
+		l.Tip.Decimal(),
+		l.VAT.Decimal(),
+		l.Total.Decimal(),
+		strconv.Itoa(l.LineNo),
+		strconv.Itoa(l.MenuItemID),
+		l.ItemName,
+		l.UnitPrice.Decimal(),
+		strconv.Itoa(l.Quantity),
+		l.LineTotal.Decimal(),
+		l.Options,
+		l.Instructions,
+	}
+}
+
+// exportWriter writes export rows as CSV or JSON Lines
+type exportWriter struct {
+	format  string
+	csv     *csv.Writer
+	json    *json.Encoder
+	flusher http.Flusher
+}
+
+func newExportWriter(w http.ResponseWriter, format string, header []string) (*exportWriter, error) {
+	e := &exportWriter{format: format}
+	e.flusher, _ = w.(http.Flusher)
+	switch format {
+	case exportCSV:
+		e.csv = csv.NewWriter(w)
+		return e, e.csv.Write(header)
+	case exportNDJSON:
+		e.json = json.NewEncoder(w)
+		return e, nil
+	}
+	return nil, fmt.Errorf("unknown export format %q", format)
+}
+
+// write adds one row; v is encoded for JSON Lines, record for CSV
+func (e *exportWriter) write(v interface{}, record []string) error {
+	if e.format == exportCSV {
+		return e.csv.Write(record)
+	}
+	return e.json.Encode(v)
+}
+
+// flush sends what was written so far to the client
+func (e *exportWriter) flush() error {
+	if e.csv != nil {
+		e.csv.Flush()
+		if err := e.csv.Error(); err != nil {
+			return err
+		}
+	}
+	if e.flusher != nil {
+		e.flusher.Flush()
+	}
+	return nil
+}
+
+// parseExportFormat reads ?format=, csv unless asked otherwise
+func parseExportFormat(r *http.Request) (string, error) {
+	format := r.URL.Query().Get("format")
+	switch format {
+	case "":
+		return exportCSV, nil
+	case exportCSV, exportNDJSON:
+		return format, nil
+	}
+	return "", &ValidationError{Message: "format must be \"csv\" or \"ndjson\""}
+}
+
+// setExportHeaders marks the response as a file download
+func setExportHeaders(w http.ResponseWriter, format, name string, from, to time.Time) {
+	contentType := "text/csv; charset=utf-8"
+	if format == exportNDJSON {
+		contentType = "application/x-ndjson"
+	}
+	w.Header().Set("Content-Type", contentType)
+	filename := fmt.Sprintf("%s-%s-%s.%s", name, from.Format("2006-01-02"), to.AddDate(0, 0, -1).Format("2006-01-02"), format)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+}
+
+func writeOrderLines(out *exportWriter, orders []Order, location *time.Location) error {
+	for _, order := range orders {
+		for _, line := range exportLines(order, location) {
+			if err := out.write(line, line.record()); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Export the orders placed in a date range, one line per item. Takes
+// ?from=&to= (dates, to inclusive), ?tz=, ?restaurantId= and ?format=csv|ndjson.
+// Orders are read a page at a time and streamed, so large exports neither
+// hold the store nor sit in memory.
+func exportOrders(w http.ResponseWriter, r *http.Request) {
+	values := r.URL.Query()
+	format, err := parseExportFormat(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	from, to, location, err := parseDateRange(values)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	q := OrderQuery{CreatedFrom: from, CreatedTo: to, SortBy: sortByCreatedAt, Limit: exportPageSize}
+	if v := values.Get("restaurantId"); v != "" {
+		q.RestaurantID, err = strconv.Atoi(v)
+		if err != nil || q.RestaurantID <= 0 {
+			http.Error(w, "Invalid restaurantId", http.StatusBadRequest)
+			return
+		}
+	}
+
+	// The first page is read before the headers go out so a store error
+	// still gets a proper status
+	orders, err := store.Query(q)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	setExportHeaders(w, format, "orders", from, to)
+	out, err := newExportWriter(w, format, orderExportColumns)
+	for err == nil && len(orders) > 0 {
+		err = writeOrderLines(out, orders, location)
+		if err == nil {
+			err = out.flush()
+		}
+		if err != nil || len(orders) < q.Limit {
+			break
+		}
+		q.After = cursorFor(q, orders[len(orders)-1])
+		orders, err = store.Query(q)
+	}
+	if err == nil {
+		err = out.flush()
+	}
+	if err != nil {
+		// Too late for an error status, the client sees a truncated file
+		log.Printf("Error exporting orders: %v", err)
+	}
+}
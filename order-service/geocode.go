@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// How precisely an address was located, from a pin the customer dropped to
+// the middle of their city
+const (
+	precisionClient   = "client"
+	precisionStreet   = "street"
+	precisionPostcode = "postcode"
+	precisionCity     = "city"
+)
+
+// ErrNotGeocoded means the geocoder doesn't know where an address is
+var ErrNotGeocoded = errors.New("address not found by the geocoder")
+
+// GeoLocation is where a geocoder placed an address
+type GeoLocation struct {
+	Lat       float64 `json:"lat"`
+	Lng       float64 `json:"lng"`
+	Precision string  `json:"precision"` // precisionStreet, precisionPostcode or precisionCity
+}
+
+// Geocoder finds the coordinates of an address without leaving the service,
+// so placing an order never waits on an outside API
+type Geocoder interface {
+	// Geocode returns the most precise location it has for the address, or ErrNotGeocoded
+	Geocode(address DeliveryAddress) (GeoLocation, error)
+}
+
+// gazetteer is a Geocoder backed by a CSV file of known places with the
+// header city,postcode,street,lat,lng. Rows with a street locate that street
+// in its city, rows with only a postcode or only a city locate its centre.
+// House numbers are not resolved.
+type gazetteer struct {
+	streets   map[string]GeoLocation // by city and street
+	postcodes map[string]GeoLocation
+	cities    map[string]GeoLocation
+}
+
+func newGazetteer() *gazetteer {
+	return &gazetteer{
+		streets:   make(map[string]GeoLocation),
+		postcodes: make(map[string]GeoLocation),
+		cities:    make(map[string]GeoLocation),
+	}
+}
+
+// loadGazetteer reads the gazetteer file at path
+func loadGazetteer(path string) (*gazetteer, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return readGazetteer(file)
+}
+
+func readGazetteer(r io.Reader) (*gazetteer, error) {
+	g := newGazetteer()
+	reader := csv.NewReader(r)
+	reader.Comment = '#'
+	reader.FieldsPerRecord = 5
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("reading gazetteer header: %w", err)
+	}
+	if strings.Join(header, ",") != "city,postcode,street,lat,lng" {
+		return nil, fmt.Errorf("gazetteer header must be city,postcode,street,lat,lng, got %s", strings.Join(header, ","))
+	}
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return g, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("reading gazetteer: %w", err)
+		}
+		line, _ := reader.FieldPos(0)
+		city, postcode, street := normalizePlace(record[0]), normalizePlace(record[1]), normalizeStreet(record[2])
+		lat, latErr := strconv.ParseFloat(strings.TrimSpace(record[3]), 64)
+		lng, lngErr := strconv.ParseFloat(strings.TrimSpace(record[4]), 64)
+		if latErr != nil || lngErr != nil {
+			return nil, fmt.Errorf("gazetteer line %d: invalid coordinates", line)
+		}
+		switch {
+		case street != "" && city != "":
+			g.streets[city+"|"+street] = GeoLocation{Lat: lat, Lng: lng, Precision: precisionStreet}
+		case street == "" && postcode != "":
+			g.postcodes[postcode] = GeoLocation{Lat: lat, Lng: lng, Precision: precisionPostcode}
+		case street == "" && city != "":
+			g.cities[city] = GeoLocation{Lat: lat, Lng: lng, Precision: precisionCity}
+		default:
+			return nil, fmt.Errorf("gazetteer line %d: a street needs a city, other rows a postcode or a city", line)
+		}
+	}
+}
+
+func (g *gazetteer) Geocode(address DeliveryAddress) (GeoLocation, error) {
+	city := normalizePlace(address.City)
+	if location, ok := g.streets[city+"|"+normalizeStreet(address.Street)]; ok && city != "" {
+		return location, nil
+	}
+	if location, ok := g.postcodes[normalizePlace(address.Postcode)]; ok {
+		return location, nil
+	}
+	if location, ok := g.cities[city]; ok {
+		return location, nil
+	}
+	return GeoLocation{}, ErrNotGeocoded
+}
+
+// normalizePlace makes names compare regardless of case and spacing
+func normalizePlace(name string) string {
+	return strings.ToLower(strings.Join(strings.Fields(name), " "))
+}
+
+// streetSuffixes maps spelled-out street types to the abbreviations the
+// gazetteer is matched with
+var streetSuffixes = map[string]string{
+	"street":    "st",
+	"st.":       "st",
+	"avenue":    "ave",
+	"ave.":      "ave",
+	"road":      "rd",
+	"rd.":       "rd",
+	"boulevard": "blvd",
+	"blvd.":     "blvd",
+	"drive":     "dr",
+	"dr.":       "dr",
+	"lane":      "ln",
+	"ln.":       "ln",
+}
+
+// normalizeStreet is normalizePlace that also treats "Main Street" and "Main St" alike
+func normalizeStreet(street string) string {
+	fields := strings.Fields(normalizePlace(street))
+	if len(fields) == 0 {
+		return ""
+	}
+	if short, ok := streetSuffixes[fields[len(fields)-1]]; ok {
+		fields[len(fields)-1] = short
+	}
+	return strings.Join(fields, " ")
+}
@@ -0,0 +1,628 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"quickbite/shared/money"
+)
+
+// Group session states
+const (
+	groupOpen      = "open"   // participants join and pick their items
+	groupLocked    = "locked" // the host closed the cart and is reviewing it
+	groupSubmitted = "submitted"
+)
+
+// Share codes leave out letters and digits that are easy to mix up
+const (
+	groupCodeAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+	groupCodeLength   = 6
+)
+
+var (
+	// ErrGroupNotFound is returned by a GroupStore when no session has the requested code
+	ErrGroupNotFound = errors.New("group order not found")
+	// ErrGroupCodeTaken means a new session drew a share code that is in use
+	ErrGroupCodeTaken = errors.New("group order code already in use")
+	// ErrGroupChanged means the session changed between loading and submitting it
+	ErrGroupChanged = errors.New("group order changed while it was being submitted")
+	// ErrGroupNotOpen means the cart is locked or already submitted
+	ErrGroupNotOpen = errors.New("group order is no longer open")
+	// ErrNotGroupHost means someone other than the host tried a host-only action
+	ErrNotGroupHost = errors.New("only the host can do this")
+	// ErrNotGroupParticipant means the user never joined the session
+	ErrNotGroupParticipant = errors.New("user is not part of this group order")
+	// ErrGroupOrderItems means an item change on an order whose total is split into shares
+	ErrGroupOrderItems = errors.New("the items of a group order are split into payment shares and can't be changed once submitted")
+)
+
+// GroupSession is a shared cart: participants add their own items and the
+// host submits them as a single order for one restaurant
+type GroupSession struct {
+	Code         string             `json:"code"` // what participants join with
+	HostUserID   int                `json:"hostUserId"`
+	RestaurantID int                `json:"restaurantId"`
+	Address      DeliveryAddress    `json:"address"`
+	AddressID    int                `json:"addressId,omitempty"` // the host's saved address, if one was picked
+	Status       string             `json:"status"`              // "open", "locked", "submitted"
+	Participants []GroupParticipant `json:"participants"`
+	OrderID      int                `json:"orderId,omitempty"` // set once submitted
+	CreatedAt    time.Time          `json:"createdAt"`
+	UpdatedAt    time.Time          `json:"updatedAt"`
+}
+
+// GroupParticipant is one person in a group session and what they picked
+type GroupParticipant struct {
+	UserID   int         `json:"userId"`
+	Name     string      `json:"name,omitempty"`
+	Items    []OrderItem `json:"items"`
+	Subtotal money.Money `json:"subtotal"`
+	JoinedAt time.Time   `json:"joinedAt"`
+}
+
+// OrderGroup links an order to the group session it was submitted from
+type OrderGroup struct {
+	Code       string         `json:"code"`
+	HostUserID int            `json:"hostUserId"`
+	Shares     []PaymentShare `json:"shares"`
+}
+
+// PaymentShare is what one participant pays for a group order
+type PaymentShare struct {
+	UserID   int         `json:"userId"`
+	Subtotal money.Money `json:"subtotal"` // their items
+	Amount   money.Money `json:"amount"`   // their part of the order total
+}
+
+// GroupStore persists group sessions. It is part of OrderStore so a session
+// is marked submitted in the same transaction that creates its order.
+type GroupStore interface {
+	// CreateGroup stores a new session or returns ErrGroupCodeTaken
+	CreateGroup(group GroupSession) error
+	// GetGroup returns a session or ErrGroupNotFound
+	GetGroup(code string) (GroupSession, error)
+	// UpdateGroup loads a session, applies fn to it and saves the result
+	// atomically. If fn returns an error nothing is written.
+	UpdateGroup(code string, fn func(group *GroupSession) error) (GroupSession, error)
+}
+
+// groupWrite is a session saved along with an order, if it wasn't changed since expectedUpdatedAt
+type groupWrite struct {
+	group             GroupSession
+	expectedUpdatedAt time.Time
+}
+
+// SaveGroup writes a group session in the current transaction. The store
+// fails the transaction with ErrGroupChanged if the session was updated
+// after expectedUpdatedAt.
+func (tx *OrderTx) SaveGroup(group GroupSession, expectedUpdatedAt time.Time) {
+	tx.groups = append(tx.groups, groupWrite{group: group, expectedUpdatedAt: expectedUpdatedAt})
+}
+
+// cloneGroup copies the slices inside a session so callers can't mutate stored state
+func cloneGroup(group GroupSession) GroupSession {
+	participants := make([]GroupParticipant, len(group.Participants))
+	for i, participant := range group.Participants {
+		participant.Items = append([]OrderItem(nil), participant.Items...)
+		participants[i] = participant
+	}
+	group.Participants = participants
+	return group
+}
+
+// participant returns the index of a user in the session, or -1
+func (g *GroupSession) participant(userID int) int {
+	for i, participant := range g.Participants {
+		if participant.UserID == userID {
+			return i
+		}
+	}
+	return -1
+}
+
+// newGroupCode draws a random share code
+func newGroupCode() (string, error) {
+	code := make([]byte, groupCodeLength)
+	for i := range code {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(groupCodeAlphabet))))
+		if err != nil {
+			return "", err
+		}
+		code[i] = groupCodeAlphabet[n.Int64()]
+	}
+	return string(code), nil
+}
+
+// itemsSubtotal adds up priced items
+func itemsSubtotal(items []OrderItem) money.Money {
+	subtotal := money.New(0, config.Currency)
+	for _, item := range items {
+		subtotal = subtotal.Add(item.Price.Mul(item.Quantity))
+	}
+	return subtotal
+}
+
+// splitShares divides an order total between the participants in proportion
+// to what their items cost, so fees, discounts and the tip are shared the
+// same way. Amounts are rounded down and the cents left over go to the host.
+// Participants without items don't get a share.
+func splitShares(total money.Money, participants []GroupParticipant, hostUserID int) []PaymentShare {
+	var itemsTotal int64
+	for _, participant := range participants {
+		itemsTotal += participant.Subtotal.Amount
+	}
+
+	shares := []PaymentShare{}
+	host := -1
+	allocated := money.New(0, total.Currency)
+	for _, participant := range participants {
+		if !participant.Subtotal.IsPositive() {
+			continue
+		}
+		amount := money.New(total.Amount*participant.Subtotal.Amount/itemsTotal, total.Currency)
+		allocated = allocated.Add(amount)
+		if participant.UserID == hostUserID {
+			host = len(shares)
+		}
+		shares = append(shares, PaymentShare{UserID: participant.UserID, Subtotal: participant.Subtotal, Amount: amount})
+	}
+
+	remainder := total.Sub(allocated)
+	if !remainder.IsPositive() {
+		return shares
+	}
+	if host < 0 {
+		host = len(shares)
+		shares = append(shares, PaymentShare{UserID: hostUserID, Subtotal: money.New(0, total.Currency), Amount: money.New(0, total.Currency)})
+	}
+	shares[host].Amount = shares[host].Amount.Add(remainder)
+	return shares
+}
+
+// Write the HTTP error matching a group session error
+func writeGroupError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, ErrGroupNotFound):
+		http.Error(w, "Group order not found", http.StatusNotFound)
+	case errors.Is(err, ErrNotGroupHost):
+		http.Error(w, "Only the host of the group order can do this", http.StatusForbidden)
+	case errors.Is(err, ErrNotGroupParticipant):
+		http.Error(w, "You haven't joined this group order", http.StatusForbidden)
+	case errors.Is(err, ErrGroupNotOpen):
+		http.Error(w, "The group order is locked, ask the host to unlock it", http.StatusConflict)
+	case errors.Is(err, ErrGroupChanged):
+		http.Error(w, "The group order was changed while it was being submitted, please review and retry", http.StatusConflict)
+	default:
+		writeStoreError(w, err)
+	}
+}
+
+// hostOnly decodes a {"hostUserId": ...} body
+func hostOnly(r *http.Request) (int, error) {
+	var hostRequest struct {
+		HostUserID int `json:"hostUserId"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&hostRequest); err != nil {
+		return 0, err
+	}
+	if hostRequest.HostUserID == 0 {
+		return 0, errors.New("hostUserId is required")
+	}
+	return hostRequest.HostUserID, nil
+}
+
+// Open a group session. The host joins it right away and shares the code
+// with the others.
+func createGroupOrder(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	var groupRequest struct {
+		HostUserID   int             `json:"hostUserId"`
+		Name         string          `json:"name"`
+		RestaurantID int             `json:"restaurantId"`
+		Address      DeliveryAddress `json:"address"`
+		AddressID    int             `json:"addressId"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&groupRequest)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if groupRequest.HostUserID == 0 || groupRequest.RestaurantID == 0 {
+		http.Error(w, "hostUserId and restaurantId are required", http.StatusBadRequest)
+		return
+	}
+
+	// Resolved now so participants see where the order goes
+	address, addressID, err := resolveAddress(groupRequest.HostUserID, groupRequest.AddressID, groupRequest.Address)
+	if err != nil {
+		writeAddressError(w, err)
+		return
+	}
+
+	// Makes sure the restaurant exists before anyone starts picking items
+	if _, err := fetchMenu(groupRequest.RestaurantID); err != nil {
+		writePricingError(w, err)
+		return
+	}
+
+	now := time.Now()
+	group := GroupSession{
+		HostUserID:   groupRequest.HostUserID,
+		RestaurantID: groupRequest.RestaurantID,
+		Address:      address,
+		AddressID:    addressID,
+		Status:       groupOpen,
+		Participants: []GroupParticipant{{
+			UserID:   groupRequest.HostUserID,
+			Name:     groupRequest.Name,
+			Items:    []OrderItem{},
+			Subtotal: money.New(0, config.Currency),
+			JoinedAt: now,
+		}},
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	// A clash is unlikely with 32^6 codes, but a few draws make it harmless
+	for attempt := 0; attempt < 5; attempt++ {
+		group.Code, err = newGroupCode()
+		if err != nil {
+			break
+		}
+		err = store.CreateGroup(group)
+		if !errors.Is(err, ErrGroupCodeTaken) {
+			break
+		}
+	}
+	if err != nil {
+		writeGroupError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(group)
+}
+
+// Get a group session with everyone's items
+func getGroupOrder(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	params := mux.Vars(r)
+
+	group, err := store.GetGroup(params["code"])
+	if err != nil {
+		writeGroupError(w, err)
+		return
+	}
+	json.NewEncoder(w).Encode(group)
+}
+
+// Join a group session with its share code. Joining twice is harmless.
+func joinGroupOrder(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	params := mux.Vars(r)
+
+	var joinRequest struct {
+		UserID int    `json:"userId"`
+		Name   string `json:"name"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&joinRequest)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if joinRequest.UserID == 0 {
+		http.Error(w, "userId is required", http.StatusBadRequest)
+		return
+	}
+
+	group, err := store.UpdateGroup(params["code"], func(group *GroupSession) error {
+		if group.participant(joinRequest.UserID) >= 0 {
+			return nil
+		}
+		if group.Status != groupOpen {
+			return ErrGroupNotOpen
+		}
+		now := time.Now()
+		group.Participants = append(group.Participants, GroupParticipant{
+			UserID:   joinRequest.UserID,
+			Name:     joinRequest.Name,
+			Items:    []OrderItem{},
+			Subtotal: money.New(0, config.Currency),
+			JoinedAt: now,
+		})
+		group.UpdatedAt = now
+		return nil
+	})
+	if err != nil {
+		writeGroupError(w, err)
+		return
+	}
+	json.NewEncoder(w).Encode(group)
+}
+
+// Replace a participant's items. They are priced from the menu right away so
+// everyone sees what the cart costs; an empty list clears them.
+func setGroupParticipantItems(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	params := mux.Vars(r)
+	userID, err := strconv.Atoi(params["userId"])
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	var itemsRequest struct {
+		Items []OrderItem `json:"items"`
+	}
+	err = json.NewDecoder(r.Body).Decode(&itemsRequest)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	group, err := store.GetGroup(params["code"])
+	if err != nil {
+		writeGroupError(w, err)
+		return
+	}
+	items := []OrderItem{}
+	if len(itemsRequest.Items) > 0 {
+		// Priced before taking the store lock, the menu is a network call away
+		items, err = priceOrderItems(group.RestaurantID, itemsRequest.Items)
+		if err != nil {
+			writePricingError(w, err)
+			return
+		}
+	}
+
+	group, err = store.UpdateGroup(params["code"], func(group *GroupSession) error {
+		i := group.participant(userID)
+		if i < 0 {
+			return ErrNotGroupParticipant
+		}
+		if group.Status != groupOpen {
+			return ErrGroupNotOpen
+		}
+		group.Participants[i].Items = items
+		group.Participants[i].Subtotal = itemsSubtotal(items)
+		group.UpdatedAt = time.Now()
+		return nil
+	})
+	if err != nil {
+		writeGroupError(w, err)
+		return
+	}
+	json.NewEncoder(w).Encode(group)
+}
+
+// setGroupStatus moves a session between open and locked on behalf of the host
+func setGroupStatus(w http.ResponseWriter, r *http.Request, from, to string) {
+	w.Header().Set("Content-Type", "application/json")
+	params := mux.Vars(r)
+	hostUserID, err := hostOnly(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	group, err := store.UpdateGroup(params["code"], func(group *GroupSession) error {
+		if group.HostUserID != hostUserID {
+			return ErrNotGroupHost
+		}
+		if group.Status == to {
+			return nil
+		}
+		if group.Status != from {
+			return ErrGroupNotOpen
+		}
+		group.Status = to
+		group.UpdatedAt = time.Now()
+		return nil
+	})
+	if err != nil {
+		writeGroupError(w, err)
+		return
+	}
+	json.NewEncoder(w).Encode(group)
+}
+
+// Lock the cart so the host can review it before submitting
+func lockGroupOrder(w http.ResponseWriter, r *http.Request) {
+	setGroupStatus(w, r, groupOpen, groupLocked)
+}
+
+// Open a locked cart again for changes
+func unlockGroupOrder(w http.ResponseWriter, r *http.Request) {
+	setGroupStatus(w, r, groupLocked, groupOpen)
+}
+
+// Submit a locked group session as one order. Items are priced again from
+// the menu, and each participant gets a payment share; the order waits until
+// every share is paid or the host covers the rest.
+func submitGroupOrder(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	params := mux.Vars(r)
+
+	var submitRequest struct {
+		HostUserID int         `json:"hostUserId"`
+		Tip        money.Money `json:"tip"`
+		PromoCode  string      `json:"promoCode"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&submitRequest)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	group, err := store.GetGroup(params["code"])
+	if err != nil {
+		writeGroupError(w, err)
+		return
+	}
+	if group.HostUserID != submitRequest.HostUserID {
+		writeGroupError(w, ErrNotGroupHost)
+		return
+	}
+	if group.Status == groupSubmitted {
+		http.Error(w, fmt.Sprintf("The group order was already submitted as order #%d", group.OrderID), http.StatusConflict)
+		return
+	}
+	if group.Status != groupLocked {
+		http.Error(w, "Lock the group order before submitting it", http.StatusConflict)
+		return
+	}
+
+	// Menu prices may have changed since the items were picked
+	menu, err := fetchMenu(group.RestaurantID)
+	if err != nil {
+		writePricingError(w, err)
+		return
+	}
+	items := []OrderItem{}
+	for i, participant := range group.Participants {
+		priced, err := priceItemsFromMenu(group.RestaurantID, participant.Items, menu)
+		if err != nil {
+			writePricingError(w, err)
+			return
+		}
+		group.Participants[i].Items = priced
+		group.Participants[i].Subtotal = itemsSubtotal(priced)
+		items = append(items, priced...)
+	}
+	if len(items) == 0 {
+		http.Error(w, "Nobody in the group has picked any items", http.StatusUnprocessableEntity)
+		return
+	}
+
+	now := time.Now()
+	order := Order{
+		UserID:       group.HostUserID,
+		RestaurantID: group.RestaurantID,
+		Items:        items,
+		PromoCode:    submitRequest.PromoCode,
+		Currency:     config.Currency,
+		Tip:          submitRequest.Tip,
+		Address:      group.Address,
+		AddressID:    group.AddressID,
+	}
+	promo, err := priceOrder(&order, config.Fees, now)
+	var validationErr *ValidationError
+	if errors.As(err, &validationErr) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	order.Group = &OrderGroup{
+		Code:       group.Code,
+		HostUserID: group.HostUserID,
+		Shares:     splitShares(order.TotalAmount, group.Participants, group.HostUserID),
+	}
+	order.Status = "created"
+	order.CreatedAt = now
+	order.UpdatedAt = now
+	// The saga creates one payment per share
+	order.Saga = newOrderSaga(now)
+	updateETA(&order, now)
+
+	actor := requestActor(r, "", "customer")
+	err = store.Create(&order, func(order *Order, tx *OrderTx) error {
+		tx.RecordTransition(StatusChange{OrderID: order.ID, To: order.Status, Actor: actor, Reason: "group order " + group.Code, At: order.CreatedAt})
+		if promo != nil {
+			tx.RedeemPromo(PromoRedemption{
+				Code:           promo.Code,
+				UserID:         order.UserID,
+				OrderID:        order.ID,
+				MaxUsesPerUser: promo.MaxUsesPerUser,
+				MaxUses:        promo.MaxUses,
+				RedeemedAt:     order.CreatedAt,
+			})
+		}
+		submitted := group
+		submitted.Status = groupSubmitted
+		submitted.OrderID = order.ID
+		submitted.UpdatedAt = now
+		tx.SaveGroup(submitted, group.UpdatedAt)
+		return nil
+	})
+	if errors.As(err, &validationErr) {
+		// A usage limit was reached by the time the order was stored
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		writeGroupError(w, err)
+		return
+	}
+	sagas.Wake()
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(order)
+}
+
+// Pay the shares that are still unpaid: payment-service voids them and
+// creates one payment for the host, and the order proceeds once it is paid
+func coverGroupOrder(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	params := mux.Vars(r)
+	hostUserID, err := hostOnly(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	group, err := store.GetGroup(params["code"])
+	if err != nil {
+		writeGroupError(w, err)
+		return
+	}
+	if group.HostUserID != hostUserID {
+		writeGroupError(w, ErrNotGroupHost)
+		return
+	}
+	if group.Status != groupSubmitted {
+		http.Error(w, "The group order hasn't been submitted yet", http.StatusConflict)
+		return
+	}
+	order, err := store.Get(group.OrderID)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	if order.Status != "created" {
+		http.Error(w, fmt.Sprintf("Order #%d is %s, there is nothing left to pay", order.ID, order.Status), http.StatusConflict)
+		return
+	}
+
+	coverData, err := json.Marshal(map[string]interface{}{"userId": hostUserID})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	coverURL := fmt.Sprintf("%s/order/%d/cover", config.PaymentServiceURL, order.ID)
+	resp, err := httpClient.Post(coverURL, "application/json", bytes.NewReader(coverData))
+	if err != nil {
+		log.Printf("Error covering payments of order #%d: %v", order.ID, err)
+		http.Error(w, "Could not reach the payment service, please retry", http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	// payment-service's answer is the cover payment, or why there is none
+	w.Header().Set("Content-Type", resp.Header.Get("Content-Type"))
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
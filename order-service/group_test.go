@@ -0,0 +1,93 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitShares(t *testing.T) {
+	participant := func(userID int, subtotal int64) GroupParticipant {
+		return GroupParticipant{UserID: userID, Subtotal: usd(subtotal)}
+	}
+	share := func(userID int, subtotal, amount int64) PaymentShare {
+		return PaymentShare{UserID: userID, Subtotal: usd(subtotal), Amount: usd(amount)}
+	}
+
+	tests := []struct {
+		name         string
+		total        int64
+		participants []GroupParticipant
+		host         int
+		want         []PaymentShare
+	}{
+		{
+			name:         "even split",
+			total:        3000,
+			participants: []GroupParticipant{participant(1, 1000), participant(2, 1000), participant(3, 1000)},
+			host:         1,
+			want:         []PaymentShare{share(1, 1000, 1000), share(2, 1000, 1000), share(3, 1000, 1000)},
+		},
+		{
+			name:         "proportional to the items",
+			total:        3300,
+			participants: []GroupParticipant{participant(1, 1000), participant(2, 2000)},
+			host:         1,
+			want:         []PaymentShare{share(1, 1000, 1100), share(2, 2000, 2200)},
+		},
+		{
+			name:         "the cents left over go to the host",
+			total:        1000,
+			participants: []GroupParticipant{participant(1, 500), participant(2, 500), participant(3, 500)},
+			host:         2,
+			want:         []PaymentShare{share(1, 500, 333), share(2, 500, 334), share(3, 500, 333)},
+		},
+		{
+			name:         "rounded down, never up",
+			total:        1001,
+			participants: []GroupParticipant{participant(1, 100), participant(2, 200), participant(3, 700)},
+			host:         3,
+			want:         []PaymentShare{share(1, 100, 100), share(2, 200, 200), share(3, 700, 701)},
+		},
+		{
+			name:         "participants without items pay nothing",
+			total:        2000,
+			participants: []GroupParticipant{participant(1, 1000), participant(2, 0), participant(3, 1000)},
+			host:         1,
+			want:         []PaymentShare{share(1, 1000, 1000), share(3, 1000, 1000)},
+		},
+		{
+			name:         "a host without items pays the remainder",
+			total:        1000,
+			participants: []GroupParticipant{participant(1, 0), participant(2, 500), participant(3, 500), participant(4, 500)},
+			host:         1,
+			want:         []PaymentShare{share(2, 500, 333), share(3, 500, 333), share(4, 500, 333), share(1, 0, 1)},
+		},
+		{
+			name:         "a host without items and no remainder has no share",
+			total:        1000,
+			participants: []GroupParticipant{participant(1, 0), participant(2, 500), participant(3, 500)},
+			host:         1,
+			want:         []PaymentShare{share(2, 500, 500), share(3, 500, 500)},
+		},
+		{
+			name:         "nobody ordered",
+			total:        0,
+			participants: []GroupParticipant{participant(1, 0)},
+			host:         1,
+			want:         []PaymentShare{},
+		},
+	}
+	for _, tt := range tests {
+		got := splitShares(usd(tt.total), tt.participants, tt.host)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %+v, want %+v", tt.name, got, tt.want)
+		}
+		sum := usd(0)
+		for _, share := range got {
+			sum = sum.Add(share.Amount)
+		}
+		if sum != usd(tt.total) {
+			t.Errorf("%s: shares add up to %s, want %s", tt.name, sum, usd(tt.total))
+		}
+	}
+}
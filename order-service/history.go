@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// StatusChange is one entry in an order's audit trail
+type StatusChange struct {
+	ID      int64     `json:"id"` // set by the store, increasing across all orders
+	OrderID int       `json:"orderId"`
+	From    string    `json:"from"` // empty for the creation of the order
+	To      string    `json:"to"`
+	Actor   string    `json:"actor"` // who made the change, e.g. "customer" or "payment-service"
+	Reason  string    `json:"reason,omitempty"`
+	At      time.Time `json:"at"`
+}
+
+// StatusStage is the time an order spent in one status
+type StatusStage struct {
+	Status          string     `json:"status"`
+	EnteredAt       time.Time  `json:"enteredAt"`
+	LeftAt          *time.Time `json:"leftAt,omitempty"` // nil while the order is still in this status
+	DurationSeconds float64    `json:"durationSeconds"`
+}
+
+// OrderHistory is the response of GET /api/orders/{id}/history
+type OrderHistory struct {
+	OrderID       int            `json:"orderId"`
+	CurrentStatus string         `json:"currentStatus"`
+	Transitions   []StatusChange `json:"transitions"`
+	Stages        []StatusStage  `json:"stages"`
+}
+
+// RecordTransition adds a status change to the audit trail of the current transaction
+func (tx *OrderTx) RecordTransition(change StatusChange) {
+	tx.transitions = append(tx.transitions, change)
+}
+
+// requestActor works out who is making a change: an explicit actor in the
+// request body wins, then the X-Source-Service header other services send,
+// then the fallback
+func requestActor(r *http.Request, bodyActor, fallback string) string {
+	if bodyActor != "" {
+		return bodyActor
+	}
+	if source := r.Header.Get("X-Source-Service"); source != "" {
+		return source
+	}
+	return fallback
+}
+
+// statusStages turns the transitions into the time spent in each status.
+// The last stage of an order that is not finished runs until now.
+func statusStages(transitions []StatusChange, now time.Time) []StatusStage {
+	stages := make([]StatusStage, 0, len(transitions))
+	for i, change := range transitions {
+		stage := StatusStage{Status: change.To, EnteredAt: change.At}
+		end := now
+		if i+1 < len(transitions) {
+			leftAt := transitions[i+1].At
+			stage.LeftAt = &leftAt
+			end = leftAt
+		} else if len(orderTransitions[change.To]) == 0 {
+			// A final status has no duration
+			end = change.At
+		}
+		stage.DurationSeconds = end.Sub(change.At).Seconds()
+		stages = append(stages, stage)
+	}
+	return stages
+}
+
+// Get the status history of an order with the time spent in each stage
+func getOrderHistory(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	params := mux.Vars(r)
+	id, err := strconv.Atoi(params["id"])
+	if err != nil {
+		http.Error(w, "Invalid order ID", http.StatusBadRequest)
+		return
+	}
+
+	order, err := store.Get(id)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	transitions, err := store.History(id)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	if transitions == nil {
+		transitions = []StatusChange{}
+	}
+
+	json.NewEncoder(w).Encode(OrderHistory{
+		OrderID:       order.ID,
+		CurrentStatus: order.Status,
+		Transitions:   transitions,
+		Stages:        statusStages(transitions, time.Now()),
+	})
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"quickbite/shared/idempotency"
+)
+
+// newIdempotencyStore keeps idempotency keys next to the orders they belong to
+func newIdempotencyStore(orders OrderStore) idempotency.Store {
+	if s, ok := orders.(*sqliteOrderStore); ok {
+		return &sqliteIdempotencyStore{db: s.db}
+	}
+	return idempotency.NewMemoryStore()
+}
+
+// sqliteIdempotencyStore keeps keys in the idempotency_keys table
+type sqliteIdempotencyStore struct {
+	db *sql.DB
+}
+
+func (s *sqliteIdempotencyStore) Reserve(key, fingerprint string) (idempotency.Record, bool, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return idempotency.Record{}, false, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	if _, err := tx.Exec(`DELETE FROM idempotency_keys WHERE created_at < ?`, now.Add(-idempotency.KeyTTL).UnixNano()); err != nil {
+		return idempotency.Record{}, false, err
+	}
+
+	var record idempotency.Record
+	var createdAt, reservedAt int64
+	err = tx.QueryRow(`SELECT key, fingerprint, status_code, body, created_at, reserved_at FROM idempotency_keys WHERE key = ?`, key).
+		Scan(&record.Key, &record.Fingerprint, &record.StatusCode, &record.Body, &createdAt, &reservedAt)
+	switch {
+	case err == nil:
+		record.CreatedAt = time.Unix(0, createdAt)
+		record.ReservedAt = time.Unix(0, reservedAt)
+		if !record.Stale(now) || record.Fingerprint != fingerprint {
+			return record, false, nil
+		}
+		// The request holding the key died with its process; this retry takes over
+		_, err = tx.Exec(`UPDATE idempotency_keys SET reserved_at = ? WHERE key = ?`, now.UnixNano(), key)
+	case errors.Is(err, sql.ErrNoRows):
+		_, err = tx.Exec(`INSERT INTO idempotency_keys (key, fingerprint, status_code, body, created_at, reserved_at) VALUES (?, ?, 0, NULL, ?, ?)`,
+			key, fingerprint, now.UnixNano(), now.UnixNano())
+	}
+	if err != nil {
+		return idempotency.Record{}, false, err
+	}
+	if err := tx.Commit(); err != nil {
+		return idempotency.Record{}, false, err
+	}
+	return idempotency.Record{}, true, nil
+}
+
+func (s *sqliteIdempotencyStore) Complete(key string, statusCode int, body []byte) error {
+	_, err := s.db.Exec(`UPDATE idempotency_keys SET status_code = ?, body = ? WHERE key = ?`, statusCode, body, key)
+	return err
+}
+
+func (s *sqliteIdempotencyStore) Release(key string) error {
+	_, err := s.db.Exec(`DELETE FROM idempotency_keys WHERE key = ?`, key)
+	return err
+}
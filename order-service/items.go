@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// ErrOrderChanged means an order changed between being read and written
+var ErrOrderChanged = errors.New("order was changed by another request, please retry")
+
+// ItemsLockedError reports an item change on an order that is past "created"
+type ItemsLockedError struct {
+	Status string
+}
+
+func (e *ItemsLockedError) Error() string {
+	return fmt.Sprintf("Items can only be changed while the order is created, this order is %s", e.Status)
+}
+
+// Replace the items of an order that hasn't been paid yet and re-price it.
+// The pending payment in payment-service is updated to the new total.
+func updateOrderItems(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	params := mux.Vars(r)
+	id, err := strconv.Atoi(params["id"])
+	if err != nil {
+		http.Error(w, "Invalid order ID", http.StatusBadRequest)
+		return
+	}
+
+	var itemsUpdate struct {
+		Items []OrderItem `json:"items"`
+	}
+	err = json.NewDecoder(r.Body).Decode(&itemsUpdate)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	order, err := store.Get(id)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	if order.Status != "created" {
+		http.Error(w, (&ItemsLockedError{Status: order.Status}).Error(), http.StatusConflict)
+		return
+	}
+	if order.Group != nil {
+		http.Error(w, ErrGroupOrderItems.Error(), http.StatusConflict)
+		return
+	}
+
+	// Pricing talks to restaurant-service and the promo store, so it happens
+	// before the update; the update then checks nothing changed meanwhile
+	repriced := cloneOrder(order)
+	repriced.Items, err = priceOrderItems(order.RestaurantID, itemsUpdate.Items)
+	if err != nil {
+		writePricingError(w, err)
+		return
+	}
+	// The promo code was redeemed when the order was placed, so its validity
+	// window is checked against that time and it isn't redeemed again
+	_, err = priceOrder(&repriced, config.Fees, order.CreatedAt)
+	var validationErr *ValidationError
+	if errors.As(err, &validationErr) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	repriced.UpdatedAt = time.Now()
+
+	updated, err := store.Update(id, func(current *Order, tx *OrderTx) error {
+		if current.Status != "created" {
+			return &ItemsLockedError{Status: current.Status}
+		}
+		if !current.UpdatedAt.Equal(order.UpdatedAt) {
+			return ErrOrderChanged
+		}
+		*current = repriced
+		return notifyPaymentAmountChanged(tx, *current)
+	})
+	var lockedErr *ItemsLockedError
+	if errors.As(err, &lockedErr) || errors.Is(err, ErrOrderChanged) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	outbox.Wake()
+
+	json.NewEncoder(w).Encode(updated)
+}
+
+// notifyPaymentAmountChanged queues the new total for the order's pending
+// payment. The revision lets payment-service ignore updates that arrive late.
+func notifyPaymentAmountChanged(tx *OrderTx, order Order) error {
+	revision := order.UpdatedAt.UnixNano()
+	paymentData := map[string]interface{}{
+		"amount":        order.TotalAmount,
+		"currency":      order.Currency,
+		"breakdown":     order.Pricing,
+		"orderRevision": revision,
+	}
+
+	return tx.Enqueue(OutboxEvent{
+		OrderID:        order.ID,
+		Destination:    "payment",
+		Method:         "PUT",
+		Path:           fmt.Sprintf("/order/%d/pending", order.ID),
+		IdempotencyKey: fmt.Sprintf("order-%d-payment-amount-%d", order.ID, revision),
+	}, paymentData)
+}
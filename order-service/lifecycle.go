@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// orderTransitions is the order lifecycle: for every status, the statuses an
+// order may move to next. Statuses with no entries are final.
+var orderTransitions = map[string][]string{
+	"scheduled":           {"created", "cancelled"},
+	"created":             {"paid", "cancelled"},
+	"paid":                {"awaiting_restaurant", "cancelled"},
+	"awaiting_restaurant": {"preparing", "cancelled"}, // accepted or rejected by the restaurant
+	"preparing":           {"out_for_delivery", "cancelled"},
+	"out_for_delivery":    {"delivered"},
+	"delivered":           {},
+	"cancelled":           {},
+}
+
+// acceptanceTransitions are the steps only the restaurant accept endpoint may
+// take, because it records the acceptance and prep time that go with them
+var acceptanceTransitions = map[string]string{
+	"awaiting_restaurant": "preparing",
+}
+
+// TransitionError reports a status change the lifecycle does not allow
+type TransitionError struct {
+	From    string
+	To      string
+	Allowed []string
+	Hint    string // how to make the change instead, if another endpoint can
+}
+
+func (e *TransitionError) Error() string {
+	return fmt.Sprintf("cannot change order status from %q to %q", e.From, e.To)
+}
+
+// isKnownStatus reports whether status is part of the order lifecycle
+func isKnownStatus(status string) bool {
+	_, ok := orderTransitions[status]
+	return ok
+}
+
+// checkTransition returns a *TransitionError if an order in status from may not move to status to
+func checkTransition(from, to string) error {
+	for _, next := range orderTransitions[from] {
+		if next == to {
+			return nil
+		}
+	}
+	return &TransitionError{From: from, To: to, Allowed: orderTransitions[from]}
+}
+
+// checkStatusUpdate is checkTransition for PUT /api/orders/{id}/status, which
+// leaves acceptance to the restaurant endpoints
+func checkStatusUpdate(from, to string) error {
+	var allowed []string
+	for _, next := range orderTransitions[from] {
+		if acceptanceTransitions[from] != next {
+			allowed = append(allowed, next)
+		}
+	}
+	if acceptanceTransitions[from] == to {
+		return &TransitionError{
+			From:    from,
+			To:      to,
+			Allowed: allowed,
+			Hint:    "the restaurant accepts orders with PUT /api/restaurants/{restaurantId}/orders/{id}/accept",
+		}
+	}
+	if err := checkTransition(from, to); err != nil {
+		return &TransitionError{From: from, To: to, Allowed: allowed}
+	}
+	return nil
+}
+
+// changeStatus moves an order to a new status if the lifecycle allows it,
+// records the change in the order's history and moves its saga along
+func changeStatus(order *Order, tx *OrderTx, to, actor, reason string) error {
+	if err := checkTransition(order.Status, to); err != nil {
+		return err
+	}
+	now := time.Now()
+	tx.RecordTransition(StatusChange{
+		OrderID: order.ID,
+		From:    order.Status,
+		To:      to,
+		Actor:   actor,
+		Reason:  reason,
+		At:      now,
+	})
+	order.Status = to
+	order.UpdatedAt = now
+	advanceSaga(order, reason, now)
+	updateETA(order, now)
+	return nil
+}
+
+// Write a 409 Conflict describing an illegal transition and the allowed next states
+func writeTransitionError(w http.ResponseWriter, err *TransitionError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusConflict)
+	body := map[string]interface{}{
+		"error":             err.Error(),
+		"currentStatus":     err.From,
+		"requestedStatus":   err.To,
+		"allowedNextStates": err.Allowed,
+	}
+	if err.Hint != "" {
+		body["hint"] = err.Hint
+	}
+	json.NewEncoder(w).Encode(body)
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestCheckTransition(t *testing.T) {
+	tests := []struct {
+		from, to string
+		ok       bool
+	}{
+		{"scheduled", "created", true},
+		{"scheduled", "paid", false},
+		{"created", "paid", true},
+		{"created", "preparing", false},
+		{"paid", "awaiting_restaurant", true},
+		{"paid", "preparing", false},
+		{"awaiting_restaurant", "preparing", true},
+		{"awaiting_restaurant", "cancelled", true},
+		{"preparing", "out_for_delivery", true},
+		{"preparing", "delivered", false},
+		{"out_for_delivery", "delivered", true},
+		{"out_for_delivery", "cancelled", false},
+		{"delivered", "cancelled", false},
+		{"cancelled", "created", false},
+		{"created", "created", false},
+		{"unknown", "created", false},
+	}
+	for _, tt := range tests {
+		err := checkTransition(tt.from, tt.to)
+		if (err == nil) != tt.ok {
+			t.Errorf("checkTransition(%q, %q) = %v, want ok %v", tt.from, tt.to, err, tt.ok)
+		}
+		var transitionErr *TransitionError
+		if err != nil && !errors.As(err, &transitionErr) {
+			t.Errorf("checkTransition(%q, %q) returned %T, want *TransitionError", tt.from, tt.to, err)
+		}
+	}
+}
+
+func TestCheckStatusUpdate(t *testing.T) {
+	tests := []struct {
+		from, to string
+		ok       bool
+		allowed  []string
+		hint     bool
+	}{
+		{"created", "paid", true, nil, false},
+		{"paid", "awaiting_restaurant", true, nil, false},
+		// Acceptance goes through the restaurant endpoint
+		{"awaiting_restaurant", "preparing", false, []string{"cancelled"}, true},
+		{"awaiting_restaurant", "cancelled", true, nil, false},
+		{"awaiting_restaurant", "delivered", false, []string{"cancelled"}, false},
+		{"preparing", "out_for_delivery", true, nil, false},
+		{"created", "delivered", false, []string{"paid", "cancelled"}, false},
+		{"delivered", "cancelled", false, nil, false},
+	}
+	for _, tt := range tests {
+		err := checkStatusUpdate(tt.from, tt.to)
+		if tt.ok {
+			if err != nil {
+				t.Errorf("checkStatusUpdate(%q, %q) = %v, want nil", tt.from, tt.to, err)
+			}
+			continue
+		}
+		var transitionErr *TransitionError
+		if !errors.As(err, &transitionErr) {
+			t.Errorf("checkStatusUpdate(%q, %q) = %v, want a *TransitionError", tt.from, tt.to, err)
+			continue
+		}
+		if !reflect.DeepEqual(transitionErr.Allowed, tt.allowed) {
+			t.Errorf("checkStatusUpdate(%q, %q) allows %v, want %v", tt.from, tt.to, transitionErr.Allowed, tt.allowed)
+		}
+		if (transitionErr.Hint != "") != tt.hint {
+			t.Errorf("checkStatusUpdate(%q, %q) hint %q, want hint %v", tt.from, tt.to, transitionErr.Hint, tt.hint)
+		}
+	}
+}
+
+// Every status an order can reach must be part of the lifecycle
+func TestOrderTransitionsAreClosed(t *testing.T) {
+	for from, nexts := range orderTransitions {
+		for _, next := range nexts {
+			if !isKnownStatus(next) {
+				t.Errorf("%s leads to unknown status %s", from, next)
+			}
+		}
+	}
+	for from, to := range acceptanceTransitions {
+		if checkTransition(from, to) != nil {
+			t.Errorf("acceptance %s -> %s is not in the lifecycle", from, to)
+		}
+	}
+}
+
+func TestChangeStatus(t *testing.T) {
+	tests := []struct {
+		from, to string
+		ok       bool
+	}{
+		{"created", "paid", true},
+		{"created", "cancelled", true},
+		{"preparing", "out_for_delivery", true},
+		{"created", "delivered", false},
+		{"delivered", "cancelled", false},
+	}
+	for _, tt := range tests {
+		order := &Order{ID: 7, Status: tt.from}
+		tx := &OrderTx{}
+		err := changeStatus(order, tx, tt.to, "test", "because")
+		if !tt.ok {
+			if err == nil {
+				t.Errorf("changeStatus %s -> %s succeeded", tt.from, tt.to)
+			}
+			if order.Status != tt.from || len(tx.transitions) != 0 {
+				t.Errorf("rejected change %s -> %s still changed the order", tt.from, tt.to)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("changeStatus %s -> %s: %v", tt.from, tt.to, err)
+			continue
+		}
+		if order.Status != tt.to {
+			t.Errorf("changeStatus %s -> %s left status %s", tt.from, tt.to, order.Status)
+		}
+		want := StatusChange{OrderID: 7, From: tt.from, To: tt.to, Actor: "test", Reason: "because", At: order.UpdatedAt}
+		if len(tx.transitions) != 1 || tx.transitions[0] != want {
+			t.Errorf("changeStatus %s -> %s recorded %+v, want %+v", tt.from, tt.to, tx.transitions, want)
+		}
+	}
+}
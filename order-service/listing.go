@@ -0,0 +1,291 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"quickbite/shared/money"
+)
+
+// Page sizes for order listings
+const (
+	defaultPageSize = 50
+	maxPageSize     = 200
+)
+
+// Sort keys accepted by order listings
+const (
+	sortByCreatedAt   = "createdAt"
+	sortByTotalAmount = "totalAmount"
+)
+
+// OrderQuery selects a page of orders. Zero values mean "no filter".
+type OrderQuery struct {
+	UserID       int
+	RestaurantID int
+	Statuses     []string
+	CreatedFrom  time.Time // inclusive
+	CreatedTo    time.Time // exclusive
+	MinTotal     *money.Money
+	MaxTotal     *money.Money
+	SortBy       string // sortByCreatedAt or sortByTotalAmount
+	Descending   bool
+	After        *orderCursor // continue after this position
+	Limit        int
+}
+
+// orderCursor is the position of the last order of a page. It carries the
+// sort it was made for so it can't be replayed against a different ordering.
+type orderCursor struct {
+	SortBy      string `json:"s"`
+	Descending  bool   `json:"d"`
+	CreatedAt   int64  `json:"c,omitempty"` // unix nanoseconds
+	TotalAmount int64  `json:"t,omitempty"` // minor units
+	ID          int    `json:"i"`
+}
+
+// OrderPage is the response envelope of the order listing endpoints
+type OrderPage struct {
+	Items      []Order `json:"items"`
+	NextCursor *string `json:"nextCursor"`
+}
+
+func cursorFor(q OrderQuery, order Order) *orderCursor {
+	return &orderCursor{
+		SortBy:      q.SortBy,
+		Descending:  q.Descending,
+		CreatedAt:   order.CreatedAt.UnixNano(),
+		TotalAmount: order.TotalAmount.Amount,
+		ID:          order.ID,
+	}
+}
+
+func (c *orderCursor) encode() string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeCursor(value string) (*orderCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+	var c orderCursor
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// parseOrderQuery reads filters, sorting and paging from the query string:
+// status (comma separated), userId, restaurantId, createdFrom, createdTo
+// (RFC 3339), minTotal, maxTotal, sort (createdAt|totalAmount),
+// order (asc|desc), limit and cursor
+func parseOrderQuery(r *http.Request) (OrderQuery, error) {
+	values := r.URL.Query()
+	q := OrderQuery{SortBy: sortByCreatedAt, Descending: true, Limit: defaultPageSize}
+
+	if v := values.Get("status"); v != "" {
+		for _, status := range strings.Split(v, ",") {
+			status = strings.TrimSpace(status)
+			if !isKnownStatus(status) {
+				return q, &ValidationError{Message: fmt.Sprintf("Invalid status value %q", status)}
+			}
+			q.Statuses = append(q.Statuses, status)
+		}
+	}
+
+	for name, dest := range map[string]*int{"userId": &q.UserID, "restaurantId": &q.RestaurantID} {
+		if v := values.Get(name); v != "" {
+			id, err := strconv.Atoi(v)
+			if err != nil || id <= 0 {
+				return q, &ValidationError{Message: fmt.Sprintf("Invalid %s", name)}
+			}
+			*dest = id
+		}
+	}
+
+	for name, dest := range map[string]*time.Time{"createdFrom": &q.CreatedFrom, "createdTo": &q.CreatedTo} {
+		if v := values.Get(name); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				return q, &ValidationError{Message: fmt.Sprintf("Invalid %s, expected an RFC 3339 timestamp", name)}
+			}
+			*dest = t
+		}
+	}
+
+	for name, dest := range map[string]**money.Money{"minTotal": &q.MinTotal, "maxTotal": &q.MaxTotal} {
+		if v := values.Get(name); v != "" {
+			amount, err := money.Parse(v, config.Currency)
+			if err != nil {
+				return q, &ValidationError{Message: fmt.Sprintf("Invalid %s", name)}
+			}
+			*dest = &amount
+		}
+	}
+
+	switch v := values.Get("sort"); v {
+	case "", sortByCreatedAt:
+	case sortByTotalAmount:
+		q.SortBy = sortByTotalAmount
+	default:
+		return q, &ValidationError{Message: "Invalid sort, expected createdAt or totalAmount"}
+	}
+
+	switch v := values.Get("order"); v {
+	case "", "desc":
+	case "asc":
+		q.Descending = false
+	default:
+		return q, &ValidationError{Message: "Invalid order, expected asc or desc"}
+	}
+
+	if v := values.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit <= 0 || limit > maxPageSize {
+			return q, &ValidationError{Message: fmt.Sprintf("Invalid limit, expected 1 to %d", maxPageSize)}
+		}
+		q.Limit = limit
+	}
+
+	if v := values.Get("cursor"); v != "" {
+		cursor, err := decodeCursor(v)
+		if err != nil || cursor.SortBy != q.SortBy || cursor.Descending != q.Descending {
+			return q, &ValidationError{Message: "Invalid cursor for this sort order"}
+		}
+		q.After = cursor
+	}
+
+	return q, nil
+}
+
+// writeOrderPage runs the query and writes one page with the cursor of the next
+func writeOrderPage(w http.ResponseWriter, q OrderQuery) {
+	pageSize := q.Limit
+	q.Limit = pageSize + 1 // one extra row tells us whether there is a next page
+	orders, err := store.Query(q)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	page := OrderPage{Items: orders}
+	if len(orders) > pageSize {
+		page.Items = orders[:pageSize]
+		next := cursorFor(q, page.Items[pageSize-1]).encode()
+		page.NextCursor = &next
+	}
+	if page.Items == nil {
+		page.Items = []Order{}
+	}
+	json.NewEncoder(w).Encode(page)
+}
+
+// List orders with the filters, sorting and paging from the query string
+// plus the given fixed filters
+func listOrders(w http.ResponseWriter, r *http.Request, fixed OrderQuery) {
+	w.Header().Set("Content-Type", "application/json")
+	q, err := parseOrderQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if fixed.UserID != 0 {
+		q.UserID = fixed.UserID
+	}
+	if fixed.RestaurantID != 0 {
+		q.RestaurantID = fixed.RestaurantID
+	}
+	writeOrderPage(w, q)
+}
+
+// matchesQuery applies the filters of q (not the cursor) to one order
+func matchesQuery(q OrderQuery, order Order) bool {
+	if q.UserID != 0 && order.UserID != q.UserID {
+		return false
+	}
+	if q.RestaurantID != 0 && order.RestaurantID != q.RestaurantID {
+		return false
+	}
+	if len(q.Statuses) > 0 {
+		found := false
+		for _, status := range q.Statuses {
+			if order.Status == status {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if !q.CreatedFrom.IsZero() && order.CreatedAt.Before(q.CreatedFrom) {
+		return false
+	}
+	if !q.CreatedTo.IsZero() && !order.CreatedAt.Before(q.CreatedTo) {
+		return false
+	}
+	if q.MinTotal != nil && order.TotalAmount.Amount < q.MinTotal.Amount {
+		return false
+	}
+	if q.MaxTotal != nil && order.TotalAmount.Amount > q.MaxTotal.Amount {
+		return false
+	}
+	return true
+}
+
+// compareOrders orders two orders by the sort key of q, then by ID, ascending
+func compareOrders(q OrderQuery, a, b *orderCursor) int {
+	switch {
+	case q.SortBy == sortByTotalAmount && a.TotalAmount != b.TotalAmount:
+		if a.TotalAmount < b.TotalAmount {
+			return -1
+		}
+		return 1
+	case q.SortBy == sortByCreatedAt && a.CreatedAt != b.CreatedAt:
+		if a.CreatedAt < b.CreatedAt {
+			return -1
+		}
+		return 1
+	}
+	return a.ID - b.ID
+}
+
+// applyOrderQuery filters, sorts and pages a list of orders in memory
+func applyOrderQuery(q OrderQuery, orders []Order) []Order {
+	var matched []Order
+	for _, order := range orders {
+		if matchesQuery(q, order) {
+			matched = append(matched, order)
+		}
+	}
+
+	less := func(a, b *orderCursor) bool {
+		if q.Descending {
+			return compareOrders(q, a, b) > 0
+		}
+		return compareOrders(q, a, b) < 0
+	}
+	sort.Slice(matched, func(i, j int) bool {
+		return less(cursorFor(q, matched[i]), cursorFor(q, matched[j]))
+	})
+
+	var page []Order
+	for _, order := range matched {
+		if q.After != nil && !less(q.After, cursorFor(q, order)) {
+			continue
+		}
+		page = append(page, order)
+		if q.Limit > 0 && len(page) == q.Limit {
+			break
+		}
+	}
+	return page
+}
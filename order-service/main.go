@@ -1,56 +1,94 @@
 package main
 
 import (
-	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"os"
 	"strconv"
-	"sync"
 	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/joho/godotenv" // Adăugat pentru încărcarea fișierului .env
+	"quickbite/shared/idempotency"
+	"quickbite/shared/money"
 )
 
 // Order represents a food order
 type Order struct {
-	ID           int         `json:"id"`
-	UserID       int         `json:"userId"`
-	RestaurantID int         `json:"restaurantId"`
-	Items        []OrderItem `json:"items"`
-	TotalAmount  float64     `json:"totalAmount"`
-	Status       string      `json:"status"` // "created", "paid", "preparing", "out_for_delivery", "delivered", "cancelled"
-	Address      string      `json:"address"`
-	CreatedAt    time.Time   `json:"createdAt"`
-	UpdatedAt    time.Time   `json:"updatedAt"`
+	ID             int                   `json:"id"`
+	UserID         int                   `json:"userId"`
+	RestaurantID   int                   `json:"restaurantId"`
+	Items          []OrderItem           `json:"items"`
+	PromoCode      string                `json:"promoCode,omitempty"`
+	Currency       string                `json:"currency"` // ISO 4217 code of every amount in the order
+	Subtotal       money.Money           `json:"subtotal"` // sum of the items before discounts
+	Discounts      []AppliedDiscount     `json:"discounts,omitempty"`
+	Tip            money.Money           `json:"tip"`
+	Pricing        *PriceBreakdown       `json:"pricing,omitempty"`        // how TotalAmount adds up
+	CancelledItems []ItemCancellation    `json:"cancelledItems,omitempty"` // items taken off after the order was placed
+	Saga           *OrderSaga            `json:"saga,omitempty"`           // payment and delivery progress, nil for scheduled orders
+	Group          *OrderGroup           `json:"group,omitempty"`          // set for orders submitted from a group session
+	TotalAmount    money.Money           `json:"totalAmount"`
+	Status         string                `json:"status"`               // "scheduled", "created", "paid", "awaiting_restaurant", "preparing", "out_for_delivery", "delivered", "cancelled"
+	Acceptance     *RestaurantAcceptance `json:"acceptance,omitempty"` // the restaurant's decision, once the order is paid
+	ETA            *OrderETA             `json:"eta,omitempty"`        // when the order should arrive, nil once cancelled
+	Address        DeliveryAddress       `json:"address"`
+	AddressID      int                   `json:"addressId,omitempty"`    // the saved address it was delivered to, if any
+	ScheduledFor   *time.Time            `json:"scheduledFor,omitempty"` // requested delivery time, nil for "as soon as possible"
+	CreatedAt      time.Time             `json:"createdAt"`
+	UpdatedAt      time.Time             `json:"updatedAt"`
 }
 
 // OrderItem represents an item in the order
 type OrderItem struct {
-	MenuItemID int     `json:"menuItemId"`
-	Name       string  `json:"name"`
-	Price      float64 `json:"price"`
-	Quantity   int     `json:"quantity"`
+	MenuItemID   int              `json:"menuItemId"`
+	Name         string           `json:"name"`
+	Price        money.Money      `json:"price"` // of one unit, options included
+	Quantity     int              `json:"quantity"`
+	Options      []SelectedOption `json:"options,omitempty"`      // size, extras and removals chosen from the menu
+	Instructions string           `json:"instructions,omitempty"` // free text for the kitchen, e.g. "well done"
 }
 
 // Config holds service configuration from environment variables
 type Config struct {
 	Port                   string
+	RestaurantServiceURL   string
 	PaymentServiceURL      string
 	DeliveryServiceURL     string
 	NotificationServiceURL string
 	AllowedOrigins         string
+	OrderStore             string // "sqlite" or "memory"
+	DatabasePath           string
+	OutboxPollInterval     time.Duration
+	OutboxMaxAttempts      int
+	ScheduleLeadTime       time.Duration // how long before the requested time a scheduled order is released
+	ScheduleMaxAhead       time.Duration
+	SchedulerInterval      time.Duration
+	AcceptanceTimeout      time.Duration // how long restaurants have to accept a paid order
+	StreamHeartbeat        time.Duration // idle time after which event streams send a heartbeat
+	StreamRetry            time.Duration // how long clients wait before reconnecting to an event stream
+	CartTTL                time.Duration // carts untouched for this long are emptied
+	DefaultPrepTime        time.Duration // assumed prep time until the restaurant quotes one
+	DefaultDeliveryTime    time.Duration // assumed delivery time until delivery-service gives one
+	AnalyticsTimeZone      string        // IANA zone analytics are bucketed in unless a request asks for another
+	GazetteerPath          string        // CSV of known places delivery addresses are geocoded with
+	Currency               string        // ISO 4217 code orders are priced in
+	Fees                   FeeRules
 }
 
 // Global variables
 var (
-	orders []Order
-	nextID int = 1
-	mutex  sync.Mutex
-	config Config
+	store           OrderStore
+	idempotencyKeys idempotency.Store
+	outbox          *OutboxDispatcher
+	sagas           *SagaCoordinator
+	statusEvents    *StatusBroker
+	geocoder        Geocoder
+	config          Config
 )
 
 // Initialize with sample data and load config
@@ -64,37 +102,109 @@ func init() {
 		log.Println("Successfully loaded .env file")
 	}
 
+	// Amounts in JSON and the settings below are in this currency
+	money.DefaultCurrency = getEnv("CURRENCY", "USD")
+
 	// Load configuration
 	config = Config{
 		// Default values
 		Port:                   getEnv("ORDER_SERVICE_PORT", "8082"),
+		RestaurantServiceURL:   getEnv("RESTAURANT_SERVICE_URL", "http://restaurant-service:8081/api/restaurants"),
 		PaymentServiceURL:      getEnv("PAYMENT_SERVICE_URL", "http://payment-service:8083/api/payments"),
 		DeliveryServiceURL:     getEnv("DELIVERY_SERVICE_URL", "http://delivery-service:8084/api/deliveries"),
 		NotificationServiceURL: getEnv("NOTIFICATION_SERVICE_URL", "http://notification-service:8085/api/notifications"),
 		AllowedOrigins:         getEnv("ALLOWED_ORIGINS", "http://localhost:3205"),
+		OrderStore:             getEnv("ORDER_STORE", "sqlite"),
+		DatabasePath:           getEnv("ORDER_DB_PATH", "data/orders.db"),
+		OutboxPollInterval:     getEnvDuration("OUTBOX_POLL_INTERVAL", 2*time.Second),
+		OutboxMaxAttempts:      getEnvInt("OUTBOX_MAX_ATTEMPTS", 10),
+		ScheduleLeadTime:       getEnvDuration("SCHEDULE_LEAD_TIME", 45*time.Minute),
+		ScheduleMaxAhead:       getEnvDuration("SCHEDULE_MAX_AHEAD", 7*24*time.Hour),
+		SchedulerInterval:      getEnvDuration("SCHEDULER_INTERVAL", 30*time.Second),
+		AcceptanceTimeout:      getEnvDuration("ACCEPTANCE_TIMEOUT", 10*time.Minute),
+		StreamHeartbeat:        getEnvDuration("STREAM_HEARTBEAT_INTERVAL", 15*time.Second),
+		StreamRetry:            getEnvDuration("STREAM_RETRY", 3*time.Second),
+		CartTTL:                getEnvDuration("CART_TTL", 72*time.Hour),
+		DefaultPrepTime:        getEnvDuration("ETA_DEFAULT_PREP_TIME", 20*time.Minute),
+		DefaultDeliveryTime:    getEnvDuration("ETA_DEFAULT_DELIVERY_TIME", 30*time.Minute),
+		AnalyticsTimeZone:      getEnv("ANALYTICS_TIME_ZONE", "UTC"),
+		GazetteerPath:          getEnv("GAZETTEER_FILE", "gazetteer.csv"),
+		Currency:               money.DefaultCurrency,
+		Fees: FeeRules{
+			DeliveryFee:          getEnvMoney("DELIVERY_FEE", "2.99"),
+			FreeDeliveryOver:     getEnvMoney("FREE_DELIVERY_OVER", "0"),
+			SmallBasketThreshold: getEnvMoney("SMALL_BASKET_THRESHOLD", "10"),
+			SmallBasketFee:       getEnvMoney("SMALL_BASKET_FEE", "1.50"),
+			ServiceFeePercent:    getEnvFloat("SERVICE_FEE_PERCENT", 5),
+			ServiceFeeMin:        getEnvMoney("SERVICE_FEE_MIN", "0.50"),
+			ServiceFeeMax:        getEnvMoney("SERVICE_FEE_MAX", "3"),
+			FoodVATRate:          getEnvFloat("FOOD_VAT_RATE", 9),
+			StandardVATRate:      getEnvFloat("STANDARD_VAT_RATE", 19),
+		},
+	}
+}
+
+// openStore opens the order store and everything built on it, and seeds a
+// sample order into an empty store. It runs from main rather than init so
+// tests get the configuration without a database.
+func openStore() {
+	var err error
+	store, err = newOrderStore(config)
+	if err != nil {
+		log.Fatalf("Error opening order store: %v", err)
+	}
+	idempotencyKeys = newIdempotencyStore(store)
+	outbox = newOutboxDispatcher(store, config.OutboxPollInterval, config.OutboxMaxAttempts)
+	sagas = newSagaCoordinator(store, config.OutboxPollInterval, config.OutboxMaxAttempts)
+	statusEvents = newStatusBroker()
+
+	// Without a gazetteer addresses are still accepted, just not located
+	places, err := loadGazetteer(config.GazetteerPath)
+	if err != nil {
+		log.Printf("Warning: not geocoding addresses: %v", err)
+		places = newGazetteer()
 	}
+	geocoder = places
 
-	// Sample order
+	// Sample order, only on an empty store so restarts don't duplicate it
+	existing, err := store.List()
+	if err != nil {
+		log.Fatalf("Error reading order store: %v", err)
+	}
+	if len(existing) > 0 {
+		return
+	}
 	now := time.Now()
-	orders = append(orders, Order{
-		ID:           nextID,
+	sample := Order{
 		UserID:       1,
 		RestaurantID: 1,
 		Items: []OrderItem{
 			{
 				MenuItemID: 1,
 				Name:       "Margherita Pizza",
-				Price:      12.99,
+				Price:      money.New(1299, config.Currency),
 				Quantity:   2,
 			},
 		},
-		TotalAmount: 25.98,
-		Status:      "created",
-		Address:     "123 Main St, City",
-		CreatedAt:   now,
-		UpdatedAt:   now,
+		Status:    "created",
+		Currency:  config.Currency,
+		Address:   DeliveryAddress{Street: "Main St", Number: "123", City: "City"},
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	if err := locateAddress(&sample.Address); err != nil {
+		log.Fatalf("Error locating sample order: %v", err)
+	}
+	if _, err := priceOrder(&sample, config.Fees, now); err != nil {
+		log.Fatalf("Error pricing sample order: %v", err)
+	}
+	err = store.Create(&sample, func(order *Order, tx *OrderTx) error {
+		tx.RecordTransition(StatusChange{OrderID: order.ID, To: order.Status, Actor: "seed", At: now})
+		return nil
 	})
-	nextID++
+	if err != nil {
+		log.Fatalf("Error creating sample order: %v", err)
+	}
 }
 
 // Helper function to get environment variable with fallback
@@ -106,10 +216,59 @@ func getEnv(key, fallback string) string {
 	return value
 }
 
-// Get all orders
+// Helper function to get an integer environment variable with fallback
+func getEnvInt(key string, fallback int) int {
+	value, err := strconv.Atoi(os.Getenv(key))
+	if err != nil {
+		return fallback
+	}
+	return value
+}
+
+// Helper function to get a decimal environment variable with fallback
+func getEnvFloat(key string, fallback float64) float64 {
+	value, err := strconv.ParseFloat(os.Getenv(key), 64)
+	if err != nil {
+		return fallback
+	}
+	return value
+}
+
+// Helper function to get an amount environment variable (e.g. "2.99") with
+// fallback, in the service's currency
+func getEnvMoney(key, fallback string) money.Money {
+	value, err := money.Parse(os.Getenv(key), money.DefaultCurrency)
+	if err != nil {
+		value, err = money.Parse(fallback, money.DefaultCurrency)
+		if err != nil {
+			log.Fatalf("Invalid default for %s: %v", key, err)
+		}
+	}
+	return value
+}
+
+// Helper function to get a duration environment variable (e.g. "2s") with fallback
+func getEnvDuration(key string, fallback time.Duration) time.Duration {
+	value, err := time.ParseDuration(os.Getenv(key))
+	if err != nil {
+		return fallback
+	}
+	return value
+}
+
+// Write the HTTP error matching a store error
+func writeStoreError(w http.ResponseWriter, err error) {
+	if errors.Is(err, ErrOrderNotFound) {
+		http.Error(w, "Order not found", http.StatusNotFound)
+		return
+	}
+	log.Printf("Order store error: %v", err)
+	http.Error(w, "Internal server error", http.StatusInternalServerError)
+}
+
+// Get all orders, filtered, sorted and paginated by the query string
 func getOrders(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(orders)
+	listOrders(w, r, OrderQuery{})
 }
 
 // Get order by ID
@@ -122,13 +281,12 @@ func getOrder(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	for _, order := range orders {
-		if order.ID == id {
-			json.NewEncoder(w).Encode(order)
-			return
-		}
+	order, err := store.Get(id)
+	if err != nil {
+		writeStoreError(w, err)
+		return
 	}
-	http.Error(w, "Order not found", http.StatusNotFound)
+	json.NewEncoder(w).Encode(order)
 }
 
 // Create a new order
@@ -140,27 +298,96 @@ func createOrder(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	placeOrder(w, r, order, nil)
+}
 
-	// Calculate total amount from items
-	totalAmount := 0.0
-	for _, item := range order.Items {
-		totalAmount += item.Price * float64(item.Quantity)
+// placeOrder prices and stores a new order. fn, if not nil, runs in the
+// transaction that creates the order.
+func placeOrder(w http.ResponseWriter, r *http.Request, order Order, fn func(order *Order, tx *OrderTx) error) {
+	var err error
+	if order.Currency != "" && order.Currency != config.Currency {
+		http.Error(w, fmt.Sprintf("Orders are priced in %s", config.Currency), http.StatusBadRequest)
+		return
 	}
+	order.Currency = config.Currency
 
+	// Deliver to the address sent, a saved one or the user's default
+	order.Address, order.AddressID, err = resolveAddress(order.UserID, order.AddressID, order.Address)
+	if err != nil {
+		writeAddressError(w, err)
+		return
+	}
+
+	// Take names and prices from the restaurant's menu, never from the client
+	order.Items, err = priceOrderItems(order.RestaurantID, order.Items)
+	if err != nil {
+		writePricingError(w, err)
+		return
+	}
+
+	// Work out the total from the items, promo code, fees and tip
 	now := time.Now()
-	mutex.Lock()
-	order.ID = nextID
-	nextID++
-	order.TotalAmount = totalAmount
+	promo, err := priceOrder(&order, config.Fees, now)
+	var validationErr *ValidationError
+	if errors.As(err, &validationErr) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
 	order.Status = "created"
 	order.CreatedAt = now
 	order.UpdatedAt = now
-	orders = append(orders, order)
-	mutex.Unlock()
 
-	// Notify payment service about new order
-	go notifyPaymentService(order)
-	
+	// Orders for later are held until the scheduler releases them
+	if order.ScheduledFor != nil {
+		if err := validateSchedule(*order.ScheduledFor, now); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		order.Status = "scheduled"
+	} else {
+		// The saga creates the payment, then assigns a courier once it is paid
+		order.Saga = newOrderSaga(now)
+	}
+	updateETA(&order, now)
+
+	actor := requestActor(r, "", "customer")
+	err = store.Create(&order, func(order *Order, tx *OrderTx) error {
+		tx.RecordTransition(StatusChange{OrderID: order.ID, To: order.Status, Actor: actor, At: order.CreatedAt})
+		if promo != nil {
+			tx.RedeemPromo(PromoRedemption{
+				Code:           promo.Code,
+				UserID:         order.UserID,
+				OrderID:        order.ID,
+				MaxUsesPerUser: promo.MaxUsesPerUser,
+				MaxUses:        promo.MaxUses,
+				RedeemedAt:     order.CreatedAt,
+			})
+		}
+		if fn != nil {
+			return fn(order, tx)
+		}
+		return nil
+	})
+	if errors.As(err, &validationErr) {
+		// A usage limit was reached by the time the order was stored
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if errors.Is(err, ErrCartChanged) {
+		http.Error(w, "The cart changed while checking out, please review it and retry", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	sagas.Wake()
+
 	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(order)
 }
@@ -177,6 +404,8 @@ func updateOrderStatus(w http.ResponseWriter, r *http.Request) {
 
 	var statusUpdate struct {
 		Status string `json:"status"`
+		Actor  string `json:"actor"`
+		Reason string `json:"reason"`
 	}
 	err = json.NewDecoder(r.Body).Decode(&statusUpdate)
 	if err != nil {
@@ -185,42 +414,46 @@ func updateOrderStatus(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Validate status
-	validStatuses := map[string]bool{
-		"created":          true,
-		"paid":             true,
-		"preparing":        true,
-		"out_for_delivery": true,
-		"delivered":        true,
-		"cancelled":        true,
-	}
-	if !validStatuses[statusUpdate.Status] {
+	if !isKnownStatus(statusUpdate.Status) {
 		http.Error(w, "Invalid status value", http.StatusBadRequest)
 		return
 	}
 
-	mutex.Lock()
-	for i, order := range orders {
-		if order.ID == id {
-			orders[i].Status = statusUpdate.Status
-			orders[i].UpdatedAt = time.Now()
-			
-			// If status changed to paid, notify delivery service
-			if statusUpdate.Status == "paid" {
-				go notifyDeliveryService(orders[i])
-			}
-			
-			// If status changed to preparing or out_for_delivery or delivered, notify notification service
-			if statusUpdate.Status == "preparing" || statusUpdate.Status == "out_for_delivery" || statusUpdate.Status == "delivered" {
-				go notifyNotificationService(orders[i])
-			}
-			
-			mutex.Unlock()
-			json.NewEncoder(w).Encode(orders[i])
-			return
+	actor := requestActor(r, statusUpdate.Actor, "api")
+	order, err := store.Update(id, func(order *Order, tx *OrderTx) error {
+		if err := checkStatusUpdate(order.Status, statusUpdate.Status); err != nil {
+			return err
+		}
+		if err := changeStatus(order, tx, statusUpdate.Status, actor, statusUpdate.Reason); err != nil {
+			return err
+		}
+
+		// A paid order waits for the restaurant to accept it; the saga assigns a
+		// courier once it is accepted
+		if order.Status == "paid" {
+			return awaitRestaurant(order, tx)
 		}
+
+		// If status changed to out_for_delivery or delivered, notify notification service.
+		// Accepted orders are announced by acceptRestaurantOrder.
+		if order.Status == "out_for_delivery" || order.Status == "delivered" {
+			return notifyNotificationService(tx, *order)
+		}
+		return nil
+	})
+	var transitionErr *TransitionError
+	if errors.As(err, &transitionErr) {
+		writeTransitionError(w, transitionErr)
+		return
 	}
-	mutex.Unlock()
-	http.Error(w, "Order not found", http.StatusNotFound)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	outbox.Wake()
+	sagas.Wake()
+
+	json.NewEncoder(w).Encode(order)
 }
 
 // Get orders by user ID
@@ -233,13 +466,7 @@ func getOrdersByUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var userOrders []Order
-	for _, order := range orders {
-		if order.UserID == userID {
-			userOrders = append(userOrders, order)
-		}
-	}
-	json.NewEncoder(w).Encode(userOrders)
+	listOrders(w, r, OrderQuery{UserID: userID})
 }
 
 // Get orders by restaurant ID
@@ -252,13 +479,7 @@ func getOrdersByRestaurant(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var restaurantOrders []Order
-	for _, order := range orders {
-		if order.RestaurantID == restaurantID {
-			restaurantOrders = append(restaurantOrders, order)
-		}
-	}
-	json.NewEncoder(w).Encode(restaurantOrders)
+	listOrders(w, r, OrderQuery{RestaurantID: restaurantID})
 }
 
 // Cancel an order
@@ -271,108 +492,61 @@ func cancelOrder(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	mutex.Lock()
-	for i, order := range orders {
-		if order.ID == id {
-			// Only allow cancellation if order is not out for delivery or delivered
-			if order.Status == "out_for_delivery" || order.Status == "delivered" {
-				mutex.Unlock()
-				http.Error(w, "Cannot cancel order that is out for delivery or already delivered", http.StatusBadRequest)
-				return
-			}
-			orders[i].Status = "cancelled"
-			orders[i].UpdatedAt = time.Now()
-			
-			// Notify notification service about cancelled order
-			go notifyNotificationService(orders[i])
-			
-			mutex.Unlock()
-			json.NewEncoder(w).Encode(orders[i])
-			return
-		}
+	// The body is optional: {"reason": "...", "actor": "..."}
+	var cancelRequest struct {
+		Actor  string `json:"actor"`
+		Reason string `json:"reason"`
 	}
-	mutex.Unlock()
-	http.Error(w, "Order not found", http.StatusNotFound)
-}
-
-// Notify payment service about new order
-func notifyPaymentService(order Order) {
-	paymentURL := config.PaymentServiceURL
-	paymentData := map[string]interface{}{
-		"orderId":     order.ID,
-		"userId":      order.UserID,
-		"amount":      order.TotalAmount,
-		"description": fmt.Sprintf("Payment for order #%d", order.ID),
-	}
-	
-	jsonData, err := json.Marshal(paymentData)
-	if err != nil {
-		log.Printf("Error marshaling payment data: %v", err)
-		return
-	}
-	
-	resp, err := http.Post(paymentURL, "application/json", bytes.NewBuffer(jsonData))
-	if err != nil {
-		log.Printf("Error notifying payment service: %v", err)
+	if err := json.NewDecoder(r.Body).Decode(&cancelRequest); err != nil && err != io.EOF {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	defer resp.Body.Close()
-	
-	log.Printf("Payment service notification status: %d", resp.StatusCode)
-}
 
-// Notify delivery service about paid order
-func notifyDeliveryService(order Order) {
-	deliveryURL := config.DeliveryServiceURL
-	deliveryData := map[string]interface{}{
-		"orderId":      order.ID,
-		"userId":       order.UserID,
-		"restaurantId": order.RestaurantID,
-		"address":      order.Address,
-		"status":       "pending",
-	}
-	
-	jsonData, err := json.Marshal(deliveryData)
-	if err != nil {
-		log.Printf("Error marshaling delivery data: %v", err)
+	actor := requestActor(r, cancelRequest.Actor, "customer")
+	order, err := store.Update(id, func(order *Order, tx *OrderTx) error {
+		// Cancellation follows the same lifecycle rules as any other status change.
+		// It turns the saga around to cancel the delivery and refund the payment.
+		if err := changeStatus(order, tx, "cancelled", actor, cancelRequest.Reason); err != nil {
+			return err
+		}
+
+		// Notify notification service about cancelled order
+		return notifyNotificationService(tx, *order)
+	})
+	var transitionErr *TransitionError
+	if errors.As(err, &transitionErr) {
+		writeTransitionError(w, transitionErr)
 		return
 	}
-	
-	resp, err := http.Post(deliveryURL, "application/json", bytes.NewBuffer(jsonData))
 	if err != nil {
-		log.Printf("Error notifying delivery service: %v", err)
+		writeStoreError(w, err)
 		return
 	}
-	defer resp.Body.Close()
-	
-	log.Printf("Delivery service notification status: %d", resp.StatusCode)
+	outbox.Wake()
+	sagas.Wake()
+
+	json.NewEncoder(w).Encode(order)
 }
 
 // Notify notification service about order status changes
-func notifyNotificationService(order Order) {
-	notificationURL := config.NotificationServiceURL
+func notifyNotificationService(tx *OrderTx, order Order) error {
 	notificationData := map[string]interface{}{
-		"userId":    order.UserID,
-		"type":      "order_update",
-		"message":   fmt.Sprintf("Your order #%d status has been updated to: %s", order.ID, order.Status),
-		"orderId":   order.ID,
-		"status":    order.Status,
+		"userId":  order.UserID,
+		"type":    "order_update",
+		"message": fmt.Sprintf("Your order #%d status has been updated to: %s.%s", order.ID, order.Status, etaMessage(order)),
+		"orderId": order.ID,
+		"status":  order.Status,
 	}
-	
-	jsonData, err := json.Marshal(notificationData)
-	if err != nil {
-		log.Printf("Error marshaling notification data: %v", err)
-		return
-	}
-	
-	resp, err := http.Post(notificationURL, "application/json", bytes.NewBuffer(jsonData))
-	if err != nil {
-		log.Printf("Error notifying notification service: %v", err)
-		return
+	if order.ETA != nil && order.ETA.Basis != etaDelivered {
+		notificationData["eta"] = order.ETA.EstimatedAt
 	}
-	defer resp.Body.Close()
-	
-	log.Printf("Notification service notification status: %d", resp.StatusCode)
+
+	return tx.Enqueue(OutboxEvent{
+		OrderID:        order.ID,
+		Destination:    "notification",
+		Method:         "POST",
+		IdempotencyKey: fmt.Sprintf("order-%d-status-%s", order.ID, order.Status),
+	}, notificationData)
 }
 
 // Health check endpoint
@@ -385,8 +559,8 @@ func healthCheck(w http.ResponseWriter, r *http.Request) {
 func enableCORS(next http.Handler) http.Handler {
     return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
         w.Header().Set("Access-Control-Allow-Origin", config.AllowedOrigins)
-        w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-        w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+        w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE, OPTIONS")
+        w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, Idempotency-Key, X-Source-Service")
         
         if r.Method == "OPTIONS" {
             w.WriteHeader(http.StatusOK)
@@ -398,6 +572,7 @@ func enableCORS(next http.Handler) http.Handler {
 }
 
 func main() {
+	openStore()
 	r := mux.NewRouter()
 
 	// Health check route
@@ -406,23 +581,92 @@ func main() {
 	// Order routes
 	r.HandleFunc("/api/orders", getOrders).Methods("GET")
 	r.HandleFunc("/api/orders/{id}", getOrder).Methods("GET")
-	r.HandleFunc("/api/orders", createOrder).Methods("POST")
+	r.HandleFunc("/api/orders", idempotency.Wrap(idempotencyKeys, createOrder)).Methods("POST")
 	r.HandleFunc("/api/orders/{id}/status", updateOrderStatus).Methods("PUT")
 	r.HandleFunc("/api/orders/{id}/cancel", cancelOrder).Methods("PUT")
+	r.HandleFunc("/api/orders/{id}/items", updateOrderItems).Methods("PATCH")
+	r.HandleFunc("/api/orders/{id}/items/{menuItemId}/cancel", cancelOrderItem).Methods("POST")
+	r.HandleFunc("/api/orders/{id}/history", getOrderHistory).Methods("GET")
+	r.HandleFunc("/api/orders/{id}/reorder", reorderOrder).Methods("POST")
+	r.HandleFunc("/api/orders/{id}/events", getOrderEvents).Methods("GET")
 	
 	// Filtered orders
 	r.HandleFunc("/api/orders/user/{userId}/orders", getOrdersByUser).Methods("GET")
+	r.HandleFunc("/api/orders/user/{userId}/events", getUserOrderEvents).Methods("GET")
 	r.HandleFunc("/api/restaurants/{restaurantId}/orders", getOrdersByRestaurant).Methods("GET")
+	r.HandleFunc("/api/restaurants/{restaurantId}/orders/{id}/accept", acceptRestaurantOrder).Methods("PUT")
+	r.HandleFunc("/api/restaurants/{restaurantId}/orders/{id}/reject", rejectRestaurantOrder).Methods("PUT")
+	r.HandleFunc("/api/restaurants/{restaurantId}/analytics/sales", getSalesAnalytics).Methods("GET")
+	r.HandleFunc("/api/restaurants/{restaurantId}/analytics/top-items", getTopItemsAnalytics).Methods("GET")
+	r.HandleFunc("/api/restaurants/{restaurantId}/analytics/heatmap", getHeatmapAnalytics).Methods("GET")
+
+	// Carts
+	r.HandleFunc("/api/carts/{userId}", getCart).Methods("GET")
+	r.HandleFunc("/api/carts/{userId}", clearCart).Methods("DELETE")
+	r.HandleFunc("/api/carts/{userId}/items/{menuItemId}", setCartItem).Methods("PUT")
+	r.HandleFunc("/api/carts/{userId}/items/{menuItemId}", removeCartItem).Methods("DELETE")
+	r.HandleFunc("/api/carts/{userId}/checkout", idempotency.Wrap(idempotencyKeys, checkoutCart)).Methods("POST")
+
+	// Address book
+	r.HandleFunc("/api/address-book/{userId}", getSavedAddresses).Methods("GET")
+	r.HandleFunc("/api/address-book/{userId}", createSavedAddress).Methods("POST")
+	r.HandleFunc("/api/address-book/{userId}/{id}", updateSavedAddress).Methods("PUT")
+	r.HandleFunc("/api/address-book/{userId}/{id}", deleteSavedAddress).Methods("DELETE")
+	r.HandleFunc("/api/geocode", geocodeAddress).Methods("POST")
+
+	// Group orders
+	r.HandleFunc("/api/group-orders", createGroupOrder).Methods("POST")
+	r.HandleFunc("/api/group-orders/{code}", getGroupOrder).Methods("GET")
+	r.HandleFunc("/api/group-orders/{code}/join", joinGroupOrder).Methods("POST")
+	r.HandleFunc("/api/group-orders/{code}/participants/{userId}/items", setGroupParticipantItems).Methods("PUT")
+	r.HandleFunc("/api/group-orders/{code}/lock", lockGroupOrder).Methods("PUT")
+	r.HandleFunc("/api/group-orders/{code}/unlock", unlockGroupOrder).Methods("PUT")
+	r.HandleFunc("/api/group-orders/{code}/submit", idempotency.Wrap(idempotencyKeys, submitGroupOrder)).Methods("POST")
+	r.HandleFunc("/api/group-orders/{code}/cover", coverGroupOrder).Methods("POST")
+
+	// Outbox administration
+	r.HandleFunc("/api/admin/outbox", getOutboxEvents).Methods("GET")
+	r.HandleFunc("/api/admin/outbox/{id}/replay", replayOutboxEvent).Methods("PUT")
+	r.HandleFunc("/api/admin/sagas", getSagas).Methods("GET")
+	r.HandleFunc("/api/admin/sagas/{orderId}/retry", retrySaga).Methods("PUT")
+	r.HandleFunc("/api/admin/analytics/sales", getSalesAnalytics).Methods("GET")
+	r.HandleFunc("/api/admin/analytics/top-items", getTopItemsAnalytics).Methods("GET")
+	r.HandleFunc("/api/admin/analytics/heatmap", getHeatmapAnalytics).Methods("GET")
+	r.HandleFunc("/api/admin/exports/orders", exportOrders).Methods("GET")
+	r.HandleFunc("/api/admin/promo-codes", getPromoCodes).Methods("GET")
+	r.HandleFunc("/api/admin/promo-codes", createPromoCode).Methods("POST")
+	r.HandleFunc("/api/admin/promo-codes/{code}", getPromoCode).Methods("GET")
+	r.HandleFunc("/api/admin/promo-codes/{code}", updatePromoCode).Methods("PUT")
+	r.HandleFunc("/api/admin/promo-codes/{code}", deletePromoCode).Methods("DELETE")
 
 	// Apply CORS middleware
 	handler := enableCORS(r)
 
 	log.Printf("Order service configuration:")
 	log.Printf("- Port: %s", config.Port)
+	log.Printf("- Restaurant Service URL: %s", config.RestaurantServiceURL)
 	log.Printf("- Payment Service URL: %s", config.PaymentServiceURL)
 	log.Printf("- Delivery Service URL: %s", config.DeliveryServiceURL)
 	log.Printf("- Notification Service URL: %s", config.NotificationServiceURL)
 	log.Printf("- Allowed Origins: %s", config.AllowedOrigins)
+	log.Printf("- Order Store: %s (%s)", config.OrderStore, config.DatabasePath)
+	log.Printf("- Outbox: poll every %s, max %d attempts", config.OutboxPollInterval, config.OutboxMaxAttempts)
+
+	log.Printf("- Scheduled orders: lead time %s, up to %s ahead", config.ScheduleLeadTime, config.ScheduleMaxAhead)
+	log.Printf("- Restaurants accept orders within %s", config.AcceptanceTimeout)
+	log.Printf("- Carts expire after %s", config.CartTTL)
+	log.Printf("- Gazetteer: %s", config.GazetteerPath)
+	log.Printf("- Event streams: heartbeat every %s", config.StreamHeartbeat)
+	log.Printf("- Fees: delivery %s, service %g%%, VAT %g%% food / %g%% standard",
+		config.Fees.DeliveryFee, config.Fees.ServiceFeePercent, config.Fees.FoodVATRate, config.Fees.StandardVATRate)
+
+	// Deliver outbound notifications in the background
+	go outbox.Run()
+	// Drive orders through payment and delivery, and undo both on cancellation
+	go sagas.Run()
+	// Release scheduled orders when their time comes and reject orders restaurants didn't accept
+	scheduler := &OrderScheduler{interval: config.SchedulerInterval}
+	go scheduler.Run()
 
 	log.Printf("Order service started on port %s", config.Port)
 	log.Fatal(http.ListenAndServe(":"+config.Port, handler))
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"quickbite/shared/money"
+)
+
+// MenuItem is a menu entry as served by restaurant-service
+type MenuItem struct {
+	ID           int           `json:"id"`
+	Name         string        `json:"name"`
+	Description  string        `json:"description"`
+	Price        money.Money   `json:"price"`
+	Currency     string        `json:"currency"`
+	Category     string        `json:"category"`
+	OptionGroups []OptionGroup `json:"optionGroups,omitempty"`
+}
+
+// ErrMenuUnavailable means the menu could not be loaded from restaurant-service
+var ErrMenuUnavailable = errors.New("restaurant service unavailable")
+
+// ValidationError is a problem with the client's request that it can fix
+type ValidationError struct {
+	Message string
+}
+
+func (e *ValidationError) Error() string {
+	return e.Message
+}
+
+// Client used for calls whose answer the request handler waits for
+var httpClient = &http.Client{Timeout: 5 * time.Second}
+
+// fetchMenu loads a restaurant's menu from restaurant-service
+func fetchMenu(restaurantID int) ([]MenuItem, error) {
+	menuURL := fmt.Sprintf("%s/%d/menu", config.RestaurantServiceURL, restaurantID)
+	resp, err := httpClient.Get(menuURL)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrMenuUnavailable, err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, &ValidationError{Message: fmt.Sprintf("Restaurant %d not found", restaurantID)}
+	default:
+		return nil, fmt.Errorf("%w: menu request returned %d", ErrMenuUnavailable, resp.StatusCode)
+	}
+
+	var menu []MenuItem
+	if err := json.NewDecoder(resp.Body).Decode(&menu); err != nil {
+		return nil, fmt.Errorf("%w: decoding menu: %v", ErrMenuUnavailable, err)
+	}
+	return menu, nil
+}
+
+// priceOrderItems checks every item against the restaurant's menu and returns
+// the items with name, price and options taken from the menu, ignoring what
+// the client sent. Items that are not on this restaurant's menu are rejected.
+func priceOrderItems(restaurantID int, items []OrderItem) ([]OrderItem, error) {
+	if len(items) == 0 {
+		return nil, &ValidationError{Message: "Order must contain at least one item"}
+	}
+
+	menu, err := fetchMenu(restaurantID)
+	if err != nil {
+		return nil, err
+	}
+	return priceItemsFromMenu(restaurantID, items, menu)
+}
+
+// priceItemsFromMenu is priceOrderItems with a menu that is already loaded
+func priceItemsFromMenu(restaurantID int, items []OrderItem, menu []MenuItem) ([]OrderItem, error) {
+	byID := make(map[int]MenuItem, len(menu))
+	for _, menuItem := range menu {
+		byID[menuItem.ID] = menuItem
+	}
+
+	priced := make([]OrderItem, 0, len(items))
+	for _, item := range items {
+		if item.Quantity <= 0 {
+			return nil, &ValidationError{Message: fmt.Sprintf("Invalid quantity %d for menu item %d", item.Quantity, item.MenuItemID)}
+		}
+		menuItem, ok := byID[item.MenuItemID]
+		if !ok {
+			return nil, &ValidationError{Message: fmt.Sprintf("Menu item %d is not on the menu of restaurant %d", item.MenuItemID, restaurantID)}
+		}
+		if menuItem.Currency != "" && menuItem.Currency != config.Currency {
+			return nil, fmt.Errorf("%w: menu item %d is priced in %s, orders are in %s",
+				ErrMenuUnavailable, menuItem.ID, menuItem.Currency, config.Currency)
+		}
+		item, err := priceItem(item, menuItem)
+		if err != nil {
+			return nil, err
+		}
+		priced = append(priced, item)
+	}
+	return priced, nil
+}
+
+// Write the HTTP error matching a pricing error
+func writePricingError(w http.ResponseWriter, err error) {
+	var validationErr *ValidationError
+	if errors.As(err, &validationErr) {
+		http.Error(w, validationErr.Message, http.StatusBadRequest)
+		return
+	}
+	if errors.Is(err, ErrMenuUnavailable) {
+		log.Printf("Error loading menu: %v", err)
+		http.Error(w, "Could not verify menu prices, please retry", http.StatusBadGateway)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"quickbite/shared/money"
+)
+
+// Longest special instructions accepted on an order line, in characters
+const maxInstructionsLength = 200
+
+// OptionGroup is a choice offered on a menu item, like its size, extras or
+// ingredients to leave out, as served by restaurant-service
+type OptionGroup struct {
+	ID        int          `json:"id"`
+	Name      string       `json:"name"`
+	MinSelect int          `json:"minSelect"`
+	MaxSelect int          `json:"maxSelect"` // 0 for no limit
+	Options   []MenuOption `json:"options"`
+}
+
+// MenuOption is one option of a group
+type MenuOption struct {
+	ID         int         `json:"id"`
+	Name       string      `json:"name"`
+	PriceDelta money.Money `json:"priceDelta"`        // added to the item's price, negative for cheaper variants
+	Default    bool        `json:"default,omitempty"` // chosen when nothing is picked from the group
+}
+
+// SelectedOption is an option chosen on an order line. Clients send the
+// group and option IDs; the names and PriceDelta are filled in from the menu.
+type SelectedOption struct {
+	GroupID    int         `json:"groupId"`
+	OptionID   int         `json:"optionId"`
+	Group      string      `json:"group"`
+	Name       string      `json:"name"`
+	PriceDelta money.Money `json:"priceDelta"`
+}
+
+// priceItem checks the options and instructions of an order line against its
+// menu item and returns the line with the menu's name and a Price that is the
+// menu price plus the deltas of the chosen options. Groups the customer
+// picked nothing from get their default options.
+func priceItem(item OrderItem, menuItem MenuItem) (OrderItem, error) {
+	invalid := func(format string, args ...interface{}) (OrderItem, error) {
+		return OrderItem{}, &ValidationError{Message: fmt.Sprintf(format, args...)}
+	}
+
+	chosen := map[int]map[int]bool{}
+	for _, selected := range item.Options {
+		group := findOptionGroup(menuItem, selected.GroupID)
+		if group == nil {
+			return invalid("Menu item %d has no option group %d", menuItem.ID, selected.GroupID)
+		}
+		if findOption(*group, selected.OptionID) == nil {
+			return invalid("%s of %s has no option %d", group.Name, menuItem.Name, selected.OptionID)
+		}
+		if chosen[group.ID] == nil {
+			chosen[group.ID] = map[int]bool{}
+		}
+		if chosen[group.ID][selected.OptionID] {
+			return invalid("Option %d of %s is chosen twice", selected.OptionID, menuItem.Name)
+		}
+		chosen[group.ID][selected.OptionID] = true
+	}
+
+	price := menuItem.Price
+	var options []SelectedOption
+	for _, group := range menuItem.OptionGroups {
+		picked := chosen[group.ID]
+		if len(picked) == 0 {
+			picked = map[int]bool{}
+			for _, option := range group.Options {
+				if option.Default {
+					picked[option.ID] = true
+				}
+			}
+		}
+		if len(picked) < group.MinSelect {
+			return invalid("Choose at least %d of %s for %s", group.MinSelect, group.Name, menuItem.Name)
+		}
+		if group.MaxSelect > 0 && len(picked) > group.MaxSelect {
+			return invalid("Choose at most %d of %s for %s", group.MaxSelect, group.Name, menuItem.Name)
+		}
+		// In menu order so the same choice always reads the same
+		for _, option := range group.Options {
+			if !picked[option.ID] {
+				continue
+			}
+			options = append(options, SelectedOption{
+				GroupID:    group.ID,
+				OptionID:   option.ID,
+				Group:      group.Name,
+				Name:       option.Name,
+				PriceDelta: option.PriceDelta,
+			})
+			price = price.Add(option.PriceDelta)
+		}
+	}
+	if price.Amount < 0 {
+		return invalid("These options price %s below zero", menuItem.Name)
+	}
+
+	item.Instructions = strings.TrimSpace(item.Instructions)
+	if utf8.RuneCountInString(item.Instructions) > maxInstructionsLength {
+		return invalid("Instructions for %s must be at most %d characters", menuItem.Name, maxInstructionsLength)
+	}
+	item.Name = menuItem.Name
+	item.Price = price
+	item.Options = options
+	return item, nil
+}
+
+func findOptionGroup(menuItem MenuItem, groupID int) *OptionGroup {
+	for i := range menuItem.OptionGroups {
+		if menuItem.OptionGroups[i].ID == groupID {
+			return &menuItem.OptionGroups[i]
+		}
+	}
+	return nil
+}
+
+func findOption(group OptionGroup, optionID int) *MenuOption {
+	for i := range group.Options {
+		if group.Options[i].ID == optionID {
+			return &group.Options[i]
+		}
+	}
+	return nil
+}
+
+// sameLine reports whether two lines are the same menu item prepared the
+// same way, so their quantities can be combined
+func sameLine(a, b OrderItem) bool {
+	if a.MenuItemID != b.MenuItemID || a.Instructions != b.Instructions || len(a.Options) != len(b.Options) {
+		return false
+	}
+	for i := range a.Options {
+		if a.Options[i].GroupID != b.Options[i].GroupID || a.Options[i].OptionID != b.Options[i].OptionID {
+			return false
+		}
+	}
+	return true
+}
+
+// optionsSummary lists the chosen options of a line, e.g. "Large; Extra cheese"
+func optionsSummary(item OrderItem) string {
+	names := make([]string, len(item.Options))
+	for i, option := range item.Options {
+		names[i] = option.Name
+	}
+	return strings.Join(names, "; ")
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Outbox event states
+const (
+	outboxPending   = "pending"
+	outboxDelivered = "delivered"
+	outboxDead      = "dead" // gave up retrying, waiting for an admin replay
+)
+
+// Backoff between delivery attempts: outboxBaseDelay doubled per attempt, capped at outboxMaxDelay
+const (
+	outboxBaseDelay = 1 * time.Second
+	outboxMaxDelay  = 5 * time.Minute
+)
+
+// Delivered events are kept this long for inspection, then purged
+const outboxRetention = 7 * 24 * time.Hour
+
+// Errors returned by ReplayEvent
+var (
+	ErrEventNotFound = errors.New("outbox event not found")
+	ErrEventNotDead  = errors.New("outbox event is not dead")
+)
+
+// OutboxEvent is a call to another service recorded in the same transaction as
+// the order change that caused it, and delivered later by the dispatcher
+type OutboxEvent struct {
+	ID             int             `json:"id"`
+	OrderID        int             `json:"orderId"`
+	Destination    string          `json:"destination"` // "payment", "delivery", "notification"
+	Method         string          `json:"method"`
+	Path           string          `json:"path"` // appended to the destination's base URL
+	Payload        json.RawMessage `json:"payload"`
+	IdempotencyKey string          `json:"idempotencyKey"`
+	Status         string          `json:"status"`
+	Attempts       int             `json:"attempts"`
+	LastError      string          `json:"lastError,omitempty"`
+	NextAttemptAt  time.Time       `json:"nextAttemptAt"`
+	CreatedAt      time.Time       `json:"createdAt"`
+	DeliveredAt    *time.Time      `json:"deliveredAt,omitempty"`
+}
+
+// OutboxStore is the outbox side of an OrderStore. Events are added through
+// OrderTx so they are committed together with the order change.
+type OutboxStore interface {
+	// DueEvents returns pending events whose next attempt is due, oldest first
+	DueEvents(now time.Time, limit int) ([]OutboxEvent, error)
+	// ListEvents returns events in the given status, or all events if status is empty
+	ListEvents(status string) ([]OutboxEvent, error)
+	// SaveEventAttempt stores the outcome of a delivery attempt
+	SaveEventAttempt(event OutboxEvent) error
+	// ReplayEvent puts a dead event back in the queue with a fresh attempt count
+	ReplayEvent(id int) (OutboxEvent, error)
+	// PurgeDelivered removes events delivered before the given time
+	PurgeDelivered(before time.Time) error
+}
+
+// Enqueue adds an outbound call to the outbox of the current transaction
+func (tx *OrderTx) Enqueue(event OutboxEvent, payload interface{}) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("marshaling %s event: %w", event.Destination, err)
+	}
+	now := time.Now()
+	event.Payload = data
+	event.Status = outboxPending
+	event.NextAttemptAt = now
+	event.CreatedAt = now
+	tx.events = append(tx.events, event)
+	return nil
+}
+
+// OutboxDispatcher delivers outbox events in the background
+type OutboxDispatcher struct {
+	store       OutboxStore
+	client      *http.Client
+	interval    time.Duration
+	maxAttempts int
+	wake        chan struct{}
+}
+
+func newOutboxDispatcher(store OutboxStore, interval time.Duration, maxAttempts int) *OutboxDispatcher {
+	return &OutboxDispatcher{
+		store:       store,
+		client:      &http.Client{Timeout: 10 * time.Second},
+		interval:    interval,
+		maxAttempts: maxAttempts,
+		wake:        make(chan struct{}, 1),
+	}
+}
+
+// Wake makes the dispatcher look for due events now instead of at the next tick
+func (d *OutboxDispatcher) Wake() {
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run delivers due events until the process exits
+func (d *OutboxDispatcher) Run() {
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+	lastPurge := time.Time{}
+
+	for {
+		d.dispatchDue()
+
+		if time.Since(lastPurge) > time.Hour {
+			if err := d.store.PurgeDelivered(time.Now().Add(-outboxRetention)); err != nil {
+				log.Printf("Error purging delivered outbox events: %v", err)
+			}
+			lastPurge = time.Now()
+		}
+
+		select {
+		case <-ticker.C:
+		case <-d.wake:
+		}
+	}
+}
+
+func (d *OutboxDispatcher) dispatchDue() {
+	const batchSize = 50
+	for {
+		events, err := d.store.DueEvents(time.Now(), batchSize)
+		if err != nil {
+			log.Printf("Error loading outbox events: %v", err)
+			return
+		}
+		for _, event := range events {
+			if err := d.attempt(event); err != nil {
+				log.Printf("Error saving outbox event %d: %v", event.ID, err)
+				return
+			}
+		}
+		if len(events) < batchSize {
+			return
+		}
+	}
+}
+
+// attempt delivers one event and records the outcome
+func (d *OutboxDispatcher) attempt(event OutboxEvent) error {
+	event.Attempts++
+	retryable, err := d.deliver(event)
+	now := time.Now()
+
+	switch {
+	case err == nil:
+		event.Status = outboxDelivered
+		event.LastError = ""
+		event.DeliveredAt = &now
+	case !retryable || event.Attempts >= d.maxAttempts:
+		event.Status = outboxDead
+		event.LastError = err.Error()
+		log.Printf("Outbox event %d (%s for order #%d) moved to dead letters after %d attempts: %v",
+			event.ID, event.Destination, event.OrderID, event.Attempts, err)
+	default:
+		event.LastError = err.Error()
+		event.NextAttemptAt = now.Add(outboxBackoff(event.Attempts))
+		log.Printf("Outbox event %d (%s for order #%d) failed, attempt %d, retrying at %s: %v",
+			event.ID, event.Destination, event.OrderID, event.Attempts, event.NextAttemptAt.Format(time.RFC3339), err)
+	}
+
+	return d.store.SaveEventAttempt(event)
+}
+
+// deliver sends the event. The bool reports whether a failure is worth retrying.
+func (d *OutboxDispatcher) deliver(event OutboxEvent) (bool, error) {
+	baseURL, ok := outboxDestinationURL(event.Destination)
+	if !ok {
+		return false, fmt.Errorf("unknown destination %q", event.Destination)
+	}
+
+	req, err := http.NewRequest(event.Method, baseURL+event.Path, bytes.NewReader(event.Payload))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if event.IdempotencyKey != "" {
+		req.Header.Set("Idempotency-Key", event.IdempotencyKey)
+	}
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		log.Printf("Outbox event %d (%s for order #%d) delivered, status: %d", event.ID, event.Destination, event.OrderID, resp.StatusCode)
+		return false, nil
+	}
+
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	err = fmt.Errorf("%s %s returned %d: %s", event.Method, req.URL, resp.StatusCode, bytes.TrimSpace(body))
+	switch resp.StatusCode {
+	case http.StatusRequestTimeout, http.StatusConflict, http.StatusTooManyRequests:
+		return true, err
+	}
+	// Other client errors will fail the same way every time
+	return resp.StatusCode >= 500, err
+}
+
+// outboxDestinationURL resolves a destination name against the current config
+func outboxDestinationURL(destination string) (string, bool) {
+	switch destination {
+	case "payment":
+		return config.PaymentServiceURL, true
+	case "delivery":
+		return config.DeliveryServiceURL, true
+	case "notification":
+		return config.NotificationServiceURL, true
+	}
+	return "", false
+}
+
+// outboxBackoff is the delay before the next attempt, with up to 20% jitter
+func outboxBackoff(attempts int) time.Duration {
+	delay := outboxMaxDelay
+	if attempts < 20 {
+		delay = outboxBaseDelay << uint(attempts-1)
+		if delay > outboxMaxDelay {
+			delay = outboxMaxDelay
+		}
+	}
+	return delay + time.Duration(rand.Int63n(int64(delay)/5+1))
+}
+
+// List outbox events, optionally filtered by ?status=pending|delivered|dead
+func getOutboxEvents(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	status := r.URL.Query().Get("status")
+	if status != "" && status != outboxPending && status != outboxDelivered && status != outboxDead {
+		http.Error(w, "Invalid status value", http.StatusBadRequest)
+		return
+	}
+
+	events, err := store.ListEvents(status)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	if events == nil {
+		events = []OutboxEvent{}
+	}
+	json.NewEncoder(w).Encode(events)
+}
+
+// Put a dead-lettered event back in the delivery queue
+func replayOutboxEvent(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	params := mux.Vars(r)
+	id, err := strconv.Atoi(params["id"])
+	if err != nil {
+		http.Error(w, "Invalid event ID", http.StatusBadRequest)
+		return
+	}
+
+	event, err := store.ReplayEvent(id)
+	if errors.Is(err, ErrEventNotFound) {
+		http.Error(w, "Event not found", http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, ErrEventNotDead) {
+		http.Error(w, "Only dead events can be replayed", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	outbox.Wake()
+	json.NewEncoder(w).Encode(event)
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"quickbite/shared/money"
+)
+
+// Price line types of an order breakdown
+const (
+	lineItems          = "items"
+	lineDiscount       = "discount"
+	lineDeliveryFee    = "delivery_fee"
+	lineSmallBasketFee = "small_basket_fee"
+	lineServiceFee     = "service_fee"
+	lineTip            = "tip"
+)
+
+// FeeRules are the configurable fees added on top of the items
+type FeeRules struct {
+	DeliveryFee          money.Money
+	FreeDeliveryOver     money.Money // items subtotal from which delivery is free, 0 to always charge
+	SmallBasketThreshold money.Money // baskets below this pay SmallBasketFee
+	SmallBasketFee       money.Money
+	ServiceFeePercent    float64 // of the items subtotal, clamped to ServiceFeeMin..ServiceFeeMax
+	ServiceFeeMin        money.Money
+	ServiceFeeMax        money.Money // 0 for no cap
+	FoodVATRate          float64     // percent, applies to items and their discounts
+	StandardVATRate      float64     // percent, applies to fees
+}
+
+// PriceLine is one line of an order's price. Discounts are negative. Prices
+// include VAT; VATRate is 0 for lines that carry none, like the tip.
+type PriceLine struct {
+	Type        string      `json:"type"`
+	Description string      `json:"description"`
+	Amount      money.Money `json:"amount"`
+	VATRate     float64     `json:"vatRate"`
+}
+
+// TaxLine is the VAT included in the lines that share a rate
+type TaxLine struct {
+	Rate  float64     `json:"rate"`
+	Net   money.Money `json:"net"`
+	VAT   money.Money `json:"vat"`
+	Gross money.Money `json:"gross"`
+}
+
+// PriceBreakdown explains an order's TotalAmount, which is the sum of Lines
+type PriceBreakdown struct {
+	Lines []PriceLine `json:"lines"`
+	Taxes []TaxLine   `json:"taxes"`
+	Total money.Money `json:"total"`
+}
+
+// deliveryFee is what delivering an order with this items subtotal costs
+func (f FeeRules) deliveryFee(subtotal money.Money) money.Money {
+	if f.FreeDeliveryOver.IsPositive() && subtotal.Cmp(f.FreeDeliveryOver) >= 0 {
+		return money.New(0, subtotal.Currency)
+	}
+	return f.DeliveryFee
+}
+
+// serviceFee is the platform's share, a percentage of the items subtotal
+func (f FeeRules) serviceFee(subtotal money.Money) money.Money {
+	fee := subtotal.Percent(f.ServiceFeePercent)
+	if fee.Cmp(f.ServiceFeeMin) < 0 {
+		fee = f.ServiceFeeMin
+	}
+	if f.ServiceFeeMax.IsPositive() && fee.Cmp(f.ServiceFeeMax) > 0 {
+		fee = f.ServiceFeeMax
+	}
+	return fee
+}
+
+// priceOrder works out everything a customer pays for an order whose items
+// are already priced: it applies the promo code, adds the fees and tip, and
+// sets Subtotal, Discounts, Pricing and TotalAmount. It returns the promo
+// code that was applied, nil if there is none, so the caller can redeem it.
+func priceOrder(order *Order, fees FeeRules, now time.Time) (*PromoCode, error) {
+	if order.Tip.Amount < 0 {
+		return nil, &ValidationError{Message: "Tip can't be negative"}
+	}
+	order.Tip.Currency = order.Currency
+
+	order.Subtotal = money.New(0, order.Currency)
+	for _, item := range order.Items {
+		order.Subtotal = order.Subtotal.Add(item.Price.Mul(item.Quantity))
+	}
+	deliveryFee := fees.deliveryFee(order.Subtotal)
+
+	promo, err := applyPromoCode(order, deliveryFee, now)
+	if err != nil {
+		return nil, err
+	}
+
+	lines := []PriceLine{{
+		Type:        lineItems,
+		Description: fmt.Sprintf("Items (%d)", countItems(order.Items)),
+		Amount:      order.Subtotal,
+		VATRate:     fees.FoodVATRate,
+	}}
+	for _, discount := range order.Discounts {
+		rate := fees.FoodVATRate
+		if discount.Type == promoFreeDelivery {
+			rate = fees.StandardVATRate
+		}
+		lines = append(lines, PriceLine{Type: lineDiscount, Description: discount.Description, Amount: discount.Amount.Neg(), VATRate: rate})
+	}
+	if deliveryFee.IsPositive() {
+		lines = append(lines, PriceLine{Type: lineDeliveryFee, Description: "Delivery fee", Amount: deliveryFee, VATRate: fees.StandardVATRate})
+	}
+	if order.Subtotal.Cmp(fees.SmallBasketThreshold) < 0 && fees.SmallBasketFee.IsPositive() {
+		lines = append(lines, PriceLine{
+			Type:        lineSmallBasketFee,
+			Description: fmt.Sprintf("Small basket fee (orders under %s)", fees.SmallBasketThreshold),
+			Amount:      fees.SmallBasketFee,
+			VATRate:     fees.StandardVATRate,
+		})
+	}
+	if fee := fees.serviceFee(order.Subtotal); fee.IsPositive() {
+		lines = append(lines, PriceLine{Type: lineServiceFee, Description: "Service fee", Amount: fee, VATRate: fees.StandardVATRate})
+	}
+	if order.Tip.IsPositive() {
+		lines = append(lines, PriceLine{Type: lineTip, Description: "Tip for the courier", Amount: order.Tip})
+	}
+
+	order.Pricing = newPriceBreakdown(lines, order.Currency)
+	order.TotalAmount = order.Pricing.Total
+	return promo, nil
+}
+
+// newPriceBreakdown totals the lines and works out the VAT included per
+// rate. VAT is rounded once per rate, not per line.
+func newPriceBreakdown(lines []PriceLine, currency string) *PriceBreakdown {
+	breakdown := &PriceBreakdown{Lines: lines, Taxes: []TaxLine{}, Total: money.New(0, currency)}
+	gross := make(map[float64]money.Money)
+	for _, line := range lines {
+		breakdown.Total = breakdown.Total.Add(line.Amount)
+		if line.VATRate > 0 {
+			gross[line.VATRate] = gross[line.VATRate].Add(line.Amount)
+		}
+	}
+	for rate, amount := range gross {
+		vat := amount.IncludedVAT(rate)
+		breakdown.Taxes = append(breakdown.Taxes, TaxLine{Rate: rate, Net: amount.Sub(vat), VAT: vat, Gross: amount})
+	}
+	sort.Slice(breakdown.Taxes, func(i, j int) bool { return breakdown.Taxes[i].Rate < breakdown.Taxes[j].Rate })
+	return breakdown
+}
+
+func countItems(items []OrderItem) int {
+	count := 0
+	for _, item := range items {
+		count += item.Quantity
+	}
+	return count
+}
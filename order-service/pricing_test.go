@@ -0,0 +1,208 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"quickbite/shared/money"
+)
+
+// useMemoryStore points the package's store at a fresh memory store for one test
+func useMemoryStore(t *testing.T) *memoryOrderStore {
+	t.Helper()
+	previous := store
+	memory := newMemoryOrderStore()
+	store = memory
+	t.Cleanup(func() { store = previous })
+	return memory
+}
+
+func usd(amount int64) money.Money {
+	return money.New(amount, "USD")
+}
+
+var testFees = FeeRules{
+	DeliveryFee:          usd(299),
+	FreeDeliveryOver:     usd(3000),
+	SmallBasketThreshold: usd(1000),
+	SmallBasketFee:       usd(150),
+	ServiceFeePercent:    5,
+	ServiceFeeMin:        usd(50),
+	ServiceFeeMax:        usd(300),
+	FoodVATRate:          9,
+	StandardVATRate:      19,
+}
+
+func TestPriceOrder(t *testing.T) {
+	memory := useMemoryStore(t)
+	now := time.Now()
+	for _, promo := range []PromoCode{
+		{Code: "TENOFF", Type: promoPercent, Percent: 10, Active: true},
+		{Code: "FREEDEL", Type: promoFreeDelivery, Active: true},
+		{Code: "OLD", Type: promoPercent, Percent: 10, Active: false},
+	} {
+		if err := memory.SavePromoCode(promo); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	pizza := func(quantity int) OrderItem {
+		return OrderItem{MenuItemID: 1, Name: "Pizza", Price: usd(1299), Quantity: quantity}
+	}
+	tests := []struct {
+		name      string
+		items     []OrderItem
+		promo     string
+		tip       int64
+		lines     []string
+		total     int64
+		vat       map[float64]int64
+		wantError bool
+	}{
+		{
+			name:  "delivery and service fee",
+			items: []OrderItem{pizza(2)},
+			lines: []string{lineItems, lineDeliveryFee, lineServiceFee},
+			total: 2598 + 299 + 130,
+			vat:   map[float64]int64{9: 215, 19: 68},
+		},
+		{
+			name:  "small basket, service fee at its minimum",
+			items: []OrderItem{{MenuItemID: 2, Name: "Soup", Price: usd(500), Quantity: 1}},
+			lines: []string{lineItems, lineDeliveryFee, lineSmallBasketFee, lineServiceFee},
+			total: 500 + 299 + 150 + 50,
+			vat:   map[float64]int64{9: 41, 19: 80},
+		},
+		{
+			name:  "free delivery over the threshold",
+			items: []OrderItem{{MenuItemID: 3, Name: "Platter", Price: usd(4000), Quantity: 1}},
+			lines: []string{lineItems, lineServiceFee},
+			total: 4000 + 200,
+			vat:   map[float64]int64{9: 330, 19: 32},
+		},
+		{
+			name:  "service fee at its maximum",
+			items: []OrderItem{{MenuItemID: 3, Name: "Platter", Price: usd(10000), Quantity: 1}},
+			lines: []string{lineItems, lineServiceFee},
+			total: 10000 + 300,
+			vat:   map[float64]int64{9: 826, 19: 48},
+		},
+		{
+			name:  "tip carries no VAT",
+			items: []OrderItem{pizza(2)},
+			tip:   200,
+			lines: []string{lineItems, lineDeliveryFee, lineServiceFee, lineTip},
+			total: 2598 + 299 + 130 + 200,
+			vat:   map[float64]int64{9: 215, 19: 68},
+		},
+		{
+			name:  "percent promo code, service fee on the full subtotal",
+			items: []OrderItem{pizza(2)},
+			promo: "tenoff",
+			lines: []string{lineItems, lineDiscount, lineDeliveryFee, lineServiceFee},
+			total: 2598 - 260 + 299 + 130,
+			vat:   map[float64]int64{9: 193, 19: 68},
+		},
+		{
+			name:  "free delivery promo code",
+			items: []OrderItem{pizza(2)},
+			promo: "FREEDEL",
+			lines: []string{lineItems, lineDiscount, lineDeliveryFee, lineServiceFee},
+			total: 2598 + 130,
+			vat:   map[float64]int64{9: 215, 19: 21},
+		},
+		{name: "inactive promo code", items: []OrderItem{pizza(2)}, promo: "OLD", wantError: true},
+		{name: "unknown promo code", items: []OrderItem{pizza(2)}, promo: "NOPE", wantError: true},
+		{name: "negative tip", items: []OrderItem{pizza(2)}, tip: -100, wantError: true},
+	}
+	for _, tt := range tests {
+		order := Order{RestaurantID: 1, Items: tt.items, PromoCode: tt.promo, Tip: usd(tt.tip), Currency: "USD"}
+		promo, err := priceOrder(&order, testFees, now)
+		if tt.wantError {
+			var validationErr *ValidationError
+			if !errors.As(err, &validationErr) {
+				t.Errorf("%s: got %v, want a validation error", tt.name, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if (promo != nil) != (tt.promo != "") {
+			t.Errorf("%s: applied promo %v", tt.name, promo)
+		}
+
+		var types []string
+		for _, line := range order.Pricing.Lines {
+			types = append(types, line.Type)
+		}
+		if !reflect.DeepEqual(types, tt.lines) {
+			t.Errorf("%s: lines %v, want %v", tt.name, types, tt.lines)
+		}
+		if order.TotalAmount != usd(tt.total) || order.Pricing.Total != order.TotalAmount {
+			t.Errorf("%s: total %s (breakdown %s), want %s", tt.name, order.TotalAmount, order.Pricing.Total, usd(tt.total))
+		}
+		vat := map[float64]int64{}
+		for _, tax := range order.Pricing.Taxes {
+			vat[tax.Rate] = tax.VAT.Amount
+			if tax.Net.Add(tax.VAT) != tax.Gross {
+				t.Errorf("%s: %g%% net %s + VAT %s != gross %s", tt.name, tax.Rate, tax.Net, tax.VAT, tax.Gross)
+			}
+		}
+		if !reflect.DeepEqual(vat, tt.vat) {
+			t.Errorf("%s: VAT %v, want %v", tt.name, vat, tt.vat)
+		}
+	}
+}
+
+func TestNewPriceBreakdown(t *testing.T) {
+	tests := []struct {
+		name  string
+		lines []PriceLine
+		total int64
+		taxes []TaxLine
+	}{
+		{
+			name:  "no lines",
+			total: 0,
+			taxes: []TaxLine{},
+		},
+		{
+			// Per line the VAT would round to 3 x 0.01
+			name: "VAT rounded once per rate",
+			lines: []PriceLine{
+				{Type: lineDeliveryFee, Amount: usd(4), VATRate: 19},
+				{Type: lineSmallBasketFee, Amount: usd(4), VATRate: 19},
+				{Type: lineServiceFee, Amount: usd(4), VATRate: 19},
+			},
+			total: 12,
+			taxes: []TaxLine{{Rate: 19, Net: usd(10), VAT: usd(2), Gross: usd(12)}},
+		},
+		{
+			name: "discounts lower the taxed amount, rates sorted",
+			lines: []PriceLine{
+				{Type: lineServiceFee, Amount: usd(119), VATRate: 19},
+				{Type: lineItems, Amount: usd(2180), VATRate: 9},
+				{Type: lineDiscount, Amount: usd(-1090), VATRate: 9},
+				{Type: lineTip, Amount: usd(100)},
+			},
+			total: 119 + 2180 - 1090 + 100,
+			taxes: []TaxLine{
+				{Rate: 9, Net: usd(1000), VAT: usd(90), Gross: usd(1090)},
+				{Rate: 19, Net: usd(100), VAT: usd(19), Gross: usd(119)},
+			},
+		},
+	}
+	for _, tt := range tests {
+		breakdown := newPriceBreakdown(tt.lines, "USD")
+		if breakdown.Total != usd(tt.total) {
+			t.Errorf("%s: total %s, want %s", tt.name, breakdown.Total, usd(tt.total))
+		}
+		if !reflect.DeepEqual(breakdown.Taxes, tt.taxes) {
+			t.Errorf("%s: taxes %+v, want %+v", tt.name, breakdown.Taxes, tt.taxes)
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"quickbite/shared/money"
+)
+
+// How an item of a reorder differs from the original order
+const (
+	reorderUnavailable  = "unavailable" // no longer on the menu, left out of the draft
+	reorderPriceChanged = "price_changed"
+	reorderRenamed      = "renamed"
+	reorderOptions      = "options_unavailable" // an option is no longer offered, left out of the draft
+)
+
+// ReorderChange is one difference between a past order and its reorder
+type ReorderChange struct {
+	MenuItemID int          `json:"menuItemId"`
+	Name       string       `json:"name"` // as it was ordered
+	Quantity   int          `json:"quantity"`
+	Change     string       `json:"change"`
+	OldPrice   *money.Money `json:"oldPrice,omitempty"`
+	NewPrice   *money.Money `json:"newPrice,omitempty"`
+	NewName    string       `json:"newName,omitempty"`
+}
+
+// ReorderDraft is the response of POST /api/orders/{id}/reorder. The draft
+// is not stored: the client shows the changes and places it with POST /api/orders.
+type ReorderDraft struct {
+	Order         Order           `json:"order"`
+	Changes       []ReorderChange `json:"changes"`
+	PreviousTotal money.Money     `json:"previousTotal"`
+}
+
+// reorderItems checks the items of a past order against the current menu.
+// Items still on the menu are kept at today's name and price, options
+// included; the others, and those with options no longer offered, are dropped. Every difference is reported.
+func reorderItems(items []OrderItem, menu []MenuItem) ([]OrderItem, []ReorderChange, error) {
+	byID := make(map[int]MenuItem, len(menu))
+	for _, menuItem := range menu {
+		byID[menuItem.ID] = menuItem
+	}
+
+	kept := []OrderItem{}
+	changes := []ReorderChange{}
+	for _, item := range items {
+		change := ReorderChange{MenuItemID: item.MenuItemID, Name: item.Name, Quantity: item.Quantity}
+		menuItem, ok := byID[item.MenuItemID]
+		if !ok {
+			change.Change = reorderUnavailable
+			changes = append(changes, change)
+			continue
+		}
+		if menuItem.Currency != "" && menuItem.Currency != config.Currency {
+			return nil, nil, fmt.Errorf("%w: menu item %d is priced in %s, orders are in %s",
+				ErrMenuUnavailable, menuItem.ID, menuItem.Currency, config.Currency)
+		}
+
+		repriced, err := priceItem(item, menuItem)
+		if err != nil {
+			change.Change = reorderOptions
+			changes = append(changes, change)
+			continue
+		}
+
+		if menuItem.Name != item.Name {
+			renamed := change
+			renamed.Change = reorderRenamed
+			renamed.NewName = menuItem.Name
+			changes = append(changes, renamed)
+		}
+		if repriced.Price.Cmp(item.Price) != 0 {
+			oldPrice, newPrice := item.Price, repriced.Price
+			repriced := change
+			repriced.Change = reorderPriceChanged
+			repriced.OldPrice = &oldPrice
+			repriced.NewPrice = &newPrice
+			changes = append(changes, repriced)
+		}
+		kept = append(kept, repriced)
+	}
+	return kept, changes, nil
+}
+
+// Build a new order with the items of a past one, checked against the
+// restaurant's current menu. Promo codes and the requested delivery time are
+// not copied; the tip and address are.
+func reorderOrder(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	params := mux.Vars(r)
+	id, err := strconv.Atoi(params["id"])
+	if err != nil {
+		http.Error(w, "Invalid order ID", http.StatusBadRequest)
+		return
+	}
+
+	// The body is optional: {"userId": 1} makes sure the order is the caller's
+	var reorderRequest struct {
+		UserID int `json:"userId"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&reorderRequest); err != nil && err != io.EOF {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	previous, err := store.Get(id)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	if reorderRequest.UserID != 0 && reorderRequest.UserID != previous.UserID {
+		http.Error(w, "Orders can only be reordered by the user who placed them", http.StatusForbidden)
+		return
+	}
+
+	menu, err := fetchMenu(previous.RestaurantID)
+	if err != nil {
+		writePricingError(w, err)
+		return
+	}
+	items, changes, err := reorderItems(previous.Items, menu)
+	if err != nil {
+		writePricingError(w, err)
+		return
+	}
+	if len(items) == 0 {
+		http.Error(w, fmt.Sprintf("None of the items of order #%d are on the menu anymore", previous.ID), http.StatusUnprocessableEntity)
+		return
+	}
+
+	draft := Order{
+		UserID:       previous.UserID,
+		RestaurantID: previous.RestaurantID,
+		Items:        items,
+		Currency:     config.Currency,
+		Address:      previous.Address,
+	}
+	if previous.Currency == config.Currency {
+		draft.Tip = previous.Tip
+	}
+	_, err = priceOrder(&draft, config.Fees, time.Now())
+	var validationErr *ValidationError
+	if errors.As(err, &validationErr) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+
+	json.NewEncoder(w).Encode(ReorderDraft{
+		Order:         draft,
+		Changes:       changes,
+		PreviousTotal: previous.TotalAmount,
+	})
+}
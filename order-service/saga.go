@@ -0,0 +1,669 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Saga states
+const (
+	sagaRunning      = "running"
+	sagaCompleted    = "completed"    // the order was delivered
+	sagaCompensating = "compensating" // undoing what was done after a cancellation or failure
+	sagaCompensated  = "compensated"
+	sagaFailed       = "failed" // a compensation gave up retrying, waiting for an admin retry
+)
+
+// Saga steps. The forward steps are create_payment and assign_delivery; in
+// between the saga waits for the customer to pay, the restaurant to accept
+// and the courier to deliver, which reach it as status changes. Compensations
+// run in reverse order.
+const (
+	sagaCreatePayment  = "create_payment"
+	sagaAssignDelivery = "assign_delivery"
+	sagaCancelDelivery = "cancel_delivery"
+	sagaRefundPayment  = "refund_payment"
+)
+
+// ErrSagaNotFailed is returned when retrying a saga that hasn't failed
+var ErrSagaNotFailed = errors.New("saga has not failed")
+
+// OrderSaga drives an order through payment and delivery and undoes both if
+// the order is cancelled or a step fails for good. It is stored with the
+// order, so every change to it is committed together with the status change
+// that caused it, and sagas pick up where they were after a restart.
+type OrderSaga struct {
+	State         string         `json:"state"`
+	Step          string         `json:"step,omitempty"`          // next forward step, empty while waiting on another service
+	Compensations []string       `json:"compensations,omitempty"` // still to run, in order
+	PaymentID     int            `json:"paymentId,omitempty"`
+	DeliveryID    int            `json:"deliveryId,omitempty"`
+	Attempts      int            `json:"attempts"` // of the current step
+	LastError     string         `json:"lastError,omitempty"`
+	NextAttemptAt *time.Time     `json:"nextAttemptAt,omitempty"` // nil when nothing is due
+	Log           []SagaLogEntry `json:"log"`
+}
+
+// SagaLogEntry records a step that finished or a change of direction
+type SagaLogEntry struct {
+	Step   string    `json:"step"`
+	Result string    `json:"result"` // "done", "failed", "started"
+	Detail string    `json:"detail,omitempty"`
+	At     time.Time `json:"at"`
+}
+
+// SagaStore is the saga side of an OrderStore. Sagas are written with their
+// order through Create and Update.
+type SagaStore interface {
+	// DueSagas returns orders whose saga has a step due, most overdue first
+	DueSagas(now time.Time, limit int) ([]Order, error)
+	// ListSagas returns orders whose saga is in state, or every order with a saga if state is empty
+	ListSagas(state string) ([]Order, error)
+}
+
+func newOrderSaga(now time.Time) *OrderSaga {
+	saga := &OrderSaga{State: sagaRunning, Log: []SagaLogEntry{}}
+	saga.schedule(sagaCreatePayment, now)
+	return saga
+}
+
+// next is the step the coordinator runs next, "" if there is none
+func (s *OrderSaga) next() string {
+	if s.State == sagaCompensating {
+		if len(s.Compensations) > 0 {
+			return s.Compensations[0]
+		}
+		return ""
+	}
+	if s.State == sagaRunning {
+		return s.Step
+	}
+	return ""
+}
+
+// due reports whether the saga has a step to run at now
+func (s *OrderSaga) due(now time.Time) bool {
+	return s.NextAttemptAt != nil && !s.NextAttemptAt.After(now)
+}
+
+// schedule makes step the next forward step, due now
+func (s *OrderSaga) schedule(step string, now time.Time) {
+	s.Step = step
+	s.Attempts = 0
+	s.LastError = ""
+	s.NextAttemptAt = &now
+}
+
+// wait stops running steps until a status change or an admin wakes the saga
+func (s *OrderSaga) wait() {
+	s.Step = ""
+	s.Attempts = 0
+	s.LastError = ""
+	s.NextAttemptAt = nil
+}
+
+func (s *OrderSaga) record(step, result, detail string, at time.Time) {
+	s.Log = append(s.Log, SagaLogEntry{Step: step, Result: result, Detail: detail, At: at})
+}
+
+// compensate turns the saga around. Both compensations always run: they look
+// up what exists in the other services, so nothing that was created while
+// the saga wasn't looking (or before it existed) is missed.
+func (s *OrderSaga) compensate(reason string, now time.Time) {
+	s.wait()
+	s.State = sagaCompensating
+	s.Compensations = []string{sagaCancelDelivery, sagaRefundPayment}
+	s.NextAttemptAt = &now
+	s.record("compensate", "started", reason, now)
+}
+
+// advanceSaga moves an order's saga along after its status changed. Orders
+// placed before sagas existed get one as they move on.
+func advanceSaga(order *Order, reason string, now time.Time) {
+	saga := order.Saga
+	if saga == nil {
+		switch order.Status {
+		case "created":
+			order.Saga = newOrderSaga(now)
+			return
+		case "scheduled", "delivered":
+			return
+		}
+		saga = &OrderSaga{State: sagaRunning, Log: []SagaLogEntry{}}
+		order.Saga = saga
+	}
+
+	switch order.Status {
+	case "paid":
+		if saga.State == sagaRunning {
+			saga.record("payment", "done", "", now)
+		}
+	case "preparing":
+		// Accepted by the restaurant; orders paid before acceptance existed
+		// already have their delivery step
+		if saga.State == sagaRunning && saga.Step == "" && saga.DeliveryID == 0 {
+			saga.schedule(sagaAssignDelivery, now)
+		}
+	case "delivered":
+		if saga.State == sagaRunning {
+			saga.wait()
+			saga.State = sagaCompleted
+			saga.record("delivery", "done", "", now)
+		}
+	case "cancelled":
+		if reason == "" {
+			reason = "order cancelled"
+		}
+		saga.compensate(reason, now)
+	}
+}
+
+// SagaCoordinator runs due saga steps in the background. Steps run one at a
+// time, so a forward step and the compensations of the same order never
+// overlap.
+type SagaCoordinator struct {
+	store       OrderStore
+	client      *http.Client
+	interval    time.Duration
+	maxAttempts int
+	wake        chan struct{}
+}
+
+func newSagaCoordinator(store OrderStore, interval time.Duration, maxAttempts int) *SagaCoordinator {
+	return &SagaCoordinator{
+		store:       store,
+		client:      &http.Client{Timeout: 10 * time.Second},
+		interval:    interval,
+		maxAttempts: maxAttempts,
+		wake:        make(chan struct{}, 1),
+	}
+}
+
+// Wake makes the coordinator look for due steps now instead of at the next tick
+func (c *SagaCoordinator) Wake() {
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run executes due saga steps until the process exits
+func (c *SagaCoordinator) Run() {
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+
+	for {
+		c.runDue()
+
+		select {
+		case <-ticker.C:
+		case <-c.wake:
+		}
+	}
+}
+
+func (c *SagaCoordinator) runDue() {
+	const batchSize = 50
+	for {
+		orders, err := c.store.DueSagas(time.Now(), batchSize)
+		if err != nil {
+			log.Printf("Error loading due sagas: %v", err)
+			return
+		}
+		for _, order := range orders {
+			if err := c.attempt(order); err != nil {
+				log.Printf("Error saving saga of order #%d: %v", order.ID, err)
+				return
+			}
+		}
+		if len(orders) < batchSize {
+			return
+		}
+	}
+}
+
+// stepResult is what a step learned from the other service
+type stepResult struct {
+	paymentID       int
+	deliveryID      int
+	deliveryMinutes int  // delivery-service's estimate
+	courierAssigned bool // the delivery got a courier right away
+	detail          string
+}
+
+// attempt runs the next step of an order's saga and records the outcome. The
+// call happens outside the store; the outcome is applied to the order as it
+// is by then, which may have been cancelled meanwhile.
+func (c *SagaCoordinator) attempt(order Order) error {
+	step := order.Saga.next()
+	if step == "" {
+		// Nothing to run, only clear the due time
+		_, err := c.store.Update(order.ID, func(current *Order, tx *OrderTx) error {
+			if current.Saga != nil && current.Saga.next() == "" {
+				current.Saga.NextAttemptAt = nil
+			}
+			return nil
+		})
+		return err
+	}
+
+	result, retryable, stepErr := c.run(step, order)
+	failedForward := false
+	_, err := c.store.Update(order.ID, func(current *Order, tx *OrderTx) error {
+		saga := current.Saga
+		if saga == nil {
+			return nil
+		}
+		now := time.Now()
+		if result.paymentID != 0 {
+			saga.PaymentID = result.paymentID
+		}
+		if result.deliveryID != 0 {
+			saga.DeliveryID = result.deliveryID
+			recordDeliveryEstimate(current, result.deliveryMinutes, result.courierAssigned, now)
+		}
+		if saga.next() != step {
+			// The saga moved on while the step ran (paid, cancelled...);
+			// compensations look up whatever this step created
+			return nil
+		}
+
+		switch {
+		case stepErr == nil:
+			saga.record(step, "done", result.detail, now)
+			if saga.State == sagaCompensating {
+				saga.Compensations = saga.Compensations[1:]
+				saga.Attempts = 0
+				saga.LastError = ""
+				if len(saga.Compensations) == 0 {
+					saga.State = sagaCompensated
+					saga.NextAttemptAt = nil
+				} else {
+					saga.NextAttemptAt = &now
+				}
+				return nil
+			}
+			// Wait for the customer to pay or the courier to deliver
+			saga.wait()
+			return nil
+
+		case retryable && saga.Attempts+1 < c.maxAttempts:
+			saga.Attempts++
+			saga.LastError = stepErr.Error()
+			next := now.Add(outboxBackoff(saga.Attempts))
+			saga.NextAttemptAt = &next
+			return nil
+
+		case saga.State == sagaCompensating:
+			saga.Attempts++
+			saga.LastError = stepErr.Error()
+			saga.NextAttemptAt = nil
+			saga.State = sagaFailed
+			saga.record(step, "failed", stepErr.Error(), now)
+			return nil
+		}
+
+		// A forward step failed for good: the order can't go ahead
+		saga.Attempts++
+		saga.record(step, "failed", stepErr.Error(), now)
+		failedForward = true
+		reason := fmt.Sprintf("%s failed: %v", step, stepErr)
+		if err := changeStatus(current, tx, "cancelled", "saga", reason); err != nil {
+			return err
+		}
+		return notifyNotificationService(tx, *current)
+	})
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case stepErr == nil:
+		log.Printf("Saga of order #%d: %s done", order.ID, step)
+		// The next compensation may already be due
+		c.Wake()
+	case failedForward:
+		log.Printf("Saga of order #%d: %s failed, cancelling the order: %v", order.ID, step, stepErr)
+		outbox.Wake()
+		c.Wake()
+	default:
+		log.Printf("Saga of order #%d: %s failed: %v", order.ID, step, stepErr)
+	}
+	return nil
+}
+
+// run calls the services a step needs. The bool reports whether a failure is worth retrying.
+func (c *SagaCoordinator) run(step string, order Order) (stepResult, bool, error) {
+	switch step {
+	case sagaCreatePayment:
+		return c.createPayment(order)
+	case sagaAssignDelivery:
+		return c.assignDelivery(order)
+	case sagaCancelDelivery:
+		return c.cancelDeliveries(order)
+	case sagaRefundPayment:
+		return c.refundPayments(order)
+	}
+	return stepResult{}, false, fmt.Errorf("unknown saga step %q", step)
+}
+
+// createPayment asks payment-service for the order's payment. The
+// idempotency key makes a retry return the payment created the first time.
+// If the items changed since, the retry sends another total and the key is
+// rejected with 422; the payment from the first attempt is then looked up.
+// It already follows the new total, see notifyPaymentAmountChanged.
+func (c *SagaCoordinator) createPayment(order Order) (stepResult, bool, error) {
+	if order.Group != nil {
+		return c.createSharePayments(order)
+	}
+	paymentData := map[string]interface{}{
+		"orderId":      order.ID,
+		"restaurantId": order.RestaurantID,
+		"userId":       order.UserID,
+		"amount":       order.TotalAmount,
+		"currency":     order.Currency,
+		"breakdown":    order.Pricing,
+		"description":  fmt.Sprintf("Payment for order #%d", order.ID),
+		// Later item changes send newer revisions, see notifyPaymentAmountChanged
+		"orderRevision": order.UpdatedAt.UnixNano(),
+	}
+	var payment struct {
+		ID int `json:"id"`
+	}
+	retryable, err := c.call("POST", config.PaymentServiceURL, paymentData, fmt.Sprintf("order-%d-payment", order.ID), &payment)
+	var statusErr *CallStatusError
+	if errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusUnprocessableEntity {
+		return c.findOrderPayment(order, err)
+	}
+	if err != nil {
+		return stepResult{}, retryable, err
+	}
+	return stepResult{paymentID: payment.ID, detail: fmt.Sprintf("payment %d", payment.ID)}, false, nil
+}
+
+// findOrderPayment returns the payment of the whole order an earlier attempt
+// created, or createErr if there is none
+func (c *SagaCoordinator) findOrderPayment(order Order, createErr error) (stepResult, bool, error) {
+	var payments []struct {
+		ID     int    `json:"id"`
+		Kind   string `json:"kind"`
+		Status string `json:"status"`
+	}
+	url := fmt.Sprintf("%s/order/%d", config.PaymentServiceURL, order.ID)
+	if retryable, err := c.call("GET", url, nil, "", &payments); err != nil {
+		return stepResult{}, retryable, err
+	}
+	for _, payment := range payments {
+		if payment.Kind == "" && payment.Status != "voided" {
+			return stepResult{paymentID: payment.ID, detail: fmt.Sprintf("payment %d", payment.ID)}, false, nil
+		}
+	}
+	return stepResult{}, false, createErr
+}
+
+// createSharePayments creates one payment per participant of a group order.
+// payment-service only reports the order paid once all of them are completed.
+func (c *SagaCoordinator) createSharePayments(order Order) (stepResult, bool, error) {
+	result := stepResult{}
+	ids := []string{}
+	for _, share := range order.Group.Shares {
+		paymentData := map[string]interface{}{
+			"orderId":       order.ID,
+			"restaurantId":  order.RestaurantID,
+			"userId":        share.UserID,
+			"amount":        share.Amount,
+			"currency":      order.Currency,
+			"description":   fmt.Sprintf("Share of group order #%d", order.ID),
+			"kind":          "share",
+			"shareCount":    len(order.Group.Shares), // payment-service waits for all of them
+			"orderRevision": order.UpdatedAt.UnixNano(),
+		}
+		var payment struct {
+			ID int `json:"id"`
+		}
+		key := fmt.Sprintf("order-%d-payment-user-%d", order.ID, share.UserID)
+		retryable, err := c.call("POST", config.PaymentServiceURL, paymentData, key, &payment)
+		if err != nil {
+			// Shares created so far are replayed by their idempotency keys on the retry
+			return stepResult{}, retryable, err
+		}
+		if result.paymentID == 0 {
+			result.paymentID = payment.ID
+		}
+		ids = append(ids, strconv.Itoa(payment.ID))
+	}
+	result.detail = "payments " + strings.Join(ids, ", ")
+	return result, false, nil
+}
+
+// assignDelivery asks delivery-service for a courier. delivery-service has
+// no idempotency keys, so a delivery left by an earlier attempt is reused.
+func (c *SagaCoordinator) assignDelivery(order Order) (stepResult, bool, error) {
+	deliveries, retryable, err := c.orderDeliveries(order.ID)
+	if err != nil {
+		return stepResult{}, retryable, err
+	}
+	for _, delivery := range deliveries {
+		if delivery.Status != "cancelled" {
+			return delivery.result(), false, nil
+		}
+	}
+
+	deliveryData := map[string]interface{}{
+		"orderId":      order.ID,
+		"userId":       order.UserID,
+		"restaurantId": order.RestaurantID,
+		"address":      order.Address,
+		"status":       "pending",
+	}
+	var delivery sagaDelivery
+	retryable, err = c.call("POST", config.DeliveryServiceURL, deliveryData, fmt.Sprintf("order-%d-delivery", order.ID), &delivery)
+	if err != nil {
+		return stepResult{}, retryable, err
+	}
+	return delivery.result(), false, nil
+}
+
+// cancelDeliveries cancels every open delivery of the order, which frees its courier
+func (c *SagaCoordinator) cancelDeliveries(order Order) (stepResult, bool, error) {
+	deliveries, retryable, err := c.orderDeliveries(order.ID)
+	if err != nil {
+		return stepResult{}, retryable, err
+	}
+	result := stepResult{detail: "no open deliveries"}
+	for _, delivery := range deliveries {
+		if delivery.Status == "cancelled" || delivery.Status == "delivered" {
+			continue
+		}
+		url := fmt.Sprintf("%s/%d/status", config.DeliveryServiceURL, delivery.ID)
+		if retryable, err := c.call("PUT", url, map[string]string{"status": "cancelled"}, "", nil); err != nil {
+			return stepResult{}, retryable, err
+		}
+		result = stepResult{deliveryID: delivery.ID, detail: fmt.Sprintf("delivery %d cancelled", delivery.ID)}
+	}
+	return result, false, nil
+}
+
+// refundPayments gives back every payment of the order still holding money.
+// payment-service refunds completed payments and voids pending ones, so a
+// payment the customer hasn't made yet can't be made later.
+func (c *SagaCoordinator) refundPayments(order Order) (stepResult, bool, error) {
+	var payments []struct {
+		ID     int    `json:"id"`
+		Status string `json:"status"`
+	}
+	url := fmt.Sprintf("%s/order/%d", config.PaymentServiceURL, order.ID)
+	if retryable, err := c.call("GET", url, nil, "", &payments); err != nil {
+		return stepResult{}, retryable, err
+	}
+	result := stepResult{detail: "nothing to refund"}
+	for _, payment := range payments {
+		if payment.Status != "pending" && payment.Status != "completed" {
+			continue
+		}
+		url := fmt.Sprintf("%s/%d/refund", config.PaymentServiceURL, payment.ID)
+		if retryable, err := c.call("PUT", url, nil, "", nil); err != nil {
+			return stepResult{}, retryable, err
+		}
+		action := "refunded"
+		if payment.Status == "pending" {
+			action = "voided"
+		}
+		result = stepResult{paymentID: payment.ID, detail: fmt.Sprintf("payment %d %s", payment.ID, action)}
+	}
+	return result, false, nil
+}
+
+type sagaDelivery struct {
+	ID            int    `json:"id"`
+	Status        string `json:"status"`
+	CourierID     int    `json:"courierId"`
+	EstimatedTime int    `json:"estimatedTime"` // minutes
+}
+
+// result describes a delivery as the outcome of the assign_delivery step
+func (d sagaDelivery) result() stepResult {
+	return stepResult{
+		deliveryID:      d.ID,
+		deliveryMinutes: d.EstimatedTime,
+		courierAssigned: d.CourierID != 0,
+		detail:          fmt.Sprintf("delivery %d", d.ID),
+	}
+}
+
+func (c *SagaCoordinator) orderDeliveries(orderID int) ([]sagaDelivery, bool, error) {
+	var deliveries []sagaDelivery
+	url := fmt.Sprintf("%s/order/%d", config.DeliveryServiceURL, orderID)
+	retryable, err := c.call("GET", url, nil, "", &deliveries)
+	return deliveries, retryable, err
+}
+
+// CallStatusError is a response outside 2xx to a saga call
+type CallStatusError struct {
+	Method     string
+	URL        string
+	StatusCode int
+	Body       string // the start of the response body
+}
+
+func (e *CallStatusError) Error() string {
+	return fmt.Sprintf("%s %s returned %d: %s", e.Method, e.URL, e.StatusCode, e.Body)
+}
+
+// call sends a JSON request and decodes the response into out (if not nil).
+// The bool reports whether a failure is worth retrying, as for outbox events.
+func (c *SagaCoordinator) call(method, url string, body interface{}, idempotencyKey string, out interface{}) (bool, error) {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return false, err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, url, reader)
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Source-Service", "order-service")
+	if idempotencyKey != "" {
+		req.Header.Set("Idempotency-Key", idempotencyKey)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		if out == nil {
+			return false, nil
+		}
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return true, fmt.Errorf("%s %s: decoding response: %w", method, url, err)
+		}
+		return false, nil
+	}
+
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	err = &CallStatusError{Method: method, URL: url, StatusCode: resp.StatusCode, Body: string(bytes.TrimSpace(data))}
+	switch resp.StatusCode {
+	case http.StatusRequestTimeout, http.StatusConflict, http.StatusTooManyRequests:
+		return true, err
+	}
+	return resp.StatusCode >= 500, err
+}
+
+// sagaView is an order's saga as shown to admins
+type sagaView struct {
+	OrderID     int    `json:"orderId"`
+	OrderStatus string `json:"orderStatus"`
+	*OrderSaga
+}
+
+// List order sagas, optionally filtered by ?state=running|completed|compensating|compensated|failed
+func getSagas(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	state := r.URL.Query().Get("state")
+	switch state {
+	case "", sagaRunning, sagaCompleted, sagaCompensating, sagaCompensated, sagaFailed:
+	default:
+		http.Error(w, "Invalid state value", http.StatusBadRequest)
+		return
+	}
+
+	orders, err := store.ListSagas(state)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	views := []sagaView{}
+	for _, order := range orders {
+		views = append(views, sagaView{OrderID: order.ID, OrderStatus: order.Status, OrderSaga: order.Saga})
+	}
+	json.NewEncoder(w).Encode(views)
+}
+
+// Retry the compensation a failed saga gave up on
+func retrySaga(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	params := mux.Vars(r)
+	orderID, err := strconv.Atoi(params["orderId"])
+	if err != nil {
+		http.Error(w, "Invalid order ID", http.StatusBadRequest)
+		return
+	}
+
+	order, err := store.Update(orderID, func(order *Order, tx *OrderTx) error {
+		if order.Saga == nil || order.Saga.State != sagaFailed {
+			return ErrSagaNotFailed
+		}
+		now := time.Now()
+		order.Saga.State = sagaCompensating
+		order.Saga.Attempts = 0
+		order.Saga.NextAttemptAt = &now
+		return nil
+	})
+	if errors.Is(err, ErrSagaNotFailed) {
+		http.Error(w, "Only failed sagas can be retried", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	sagas.Wake()
+	json.NewEncoder(w).Encode(sagaView{OrderID: order.ID, OrderStatus: order.Status, OrderSaga: order.Saga})
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeServices stands in for payment-service and delivery-service, recording
+// the calls that change something
+type fakeServices struct {
+	mutex        sync.Mutex
+	payments     []map[string]interface{}
+	deliveries   []map[string]interface{}
+	createStatus int // of POST /payments, 201 if 0
+	refundStatus int // of PUT /payments/{id}/refund, 200 if 0
+	calls        []string
+}
+
+func (f *fakeServices) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	reply := func(status int, body interface{}) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(body)
+	}
+	path := r.URL.Path
+	switch {
+	case r.Method == "GET" && strings.HasPrefix(path, "/payments/order/"):
+		reply(http.StatusOK, f.payments)
+		return
+	case r.Method == "GET" && strings.HasPrefix(path, "/deliveries/order/"):
+		reply(http.StatusOK, f.deliveries)
+		return
+	}
+
+	f.calls = append(f.calls, r.Method+" "+path)
+	switch {
+	case r.Method == "POST" && path == "/payments":
+		if f.createStatus != 0 {
+			http.Error(w, "rejected", f.createStatus)
+			return
+		}
+		payment := map[string]interface{}{"id": len(f.payments) + 1, "status": "pending"}
+		f.payments = append(f.payments, payment)
+		reply(http.StatusCreated, payment)
+	case r.Method == "PUT" && strings.HasSuffix(path, "/refund"):
+		if f.refundStatus != 0 {
+			http.Error(w, "refund failed", f.refundStatus)
+			return
+		}
+		reply(http.StatusOK, map[string]string{"status": "refunded"})
+	case r.Method == "PUT" && strings.HasPrefix(path, "/deliveries/"):
+		reply(http.StatusOK, map[string]string{"status": "cancelled"})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// useFakeServices points the saga at fake payment and delivery services
+func useFakeServices(t *testing.T, services *fakeServices) {
+	t.Helper()
+	server := httptest.NewServer(services)
+	previousConfig, previousOutbox := config, outbox
+	config.PaymentServiceURL = server.URL + "/payments"
+	config.DeliveryServiceURL = server.URL + "/deliveries"
+	outbox = newOutboxDispatcher(store, time.Hour, 3)
+	t.Cleanup(func() {
+		server.Close()
+		config, outbox = previousConfig, previousOutbox
+	})
+}
+
+// runSaga runs the steps of an order's saga that are due now and returns the order
+func runSaga(t *testing.T, coordinator *SagaCoordinator, id int) Order {
+	t.Helper()
+	for i := 0; i < 10; i++ {
+		order, err := store.Get(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if order.Saga == nil || !order.Saga.due(time.Now()) {
+			return order
+		}
+		if err := coordinator.attempt(order); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Fatal("saga still has steps due after 10 attempts")
+	return Order{}
+}
+
+func createSagaOrder(t *testing.T, status string, saga *OrderSaga) Order {
+	t.Helper()
+	now := time.Now()
+	order := Order{UserID: 1, RestaurantID: 1, Status: status, Currency: "USD", TotalAmount: usd(1000), Saga: saga, CreatedAt: now, UpdatedAt: now}
+	if err := store.Create(&order, nil); err != nil {
+		t.Fatal(err)
+	}
+	return order
+}
+
+func TestSagaCompensation(t *testing.T) {
+	tests := []struct {
+		name         string
+		payments     []map[string]interface{}
+		deliveries   []map[string]interface{}
+		refundStatus int
+		wantState    string
+		wantCalls    []string
+		wantAttempts int
+	}{
+		{
+			name:      "nothing to undo",
+			wantState: sagaCompensated,
+		},
+		{
+			name:       "refunds the payment and cancels the delivery",
+			payments:   []map[string]interface{}{{"id": 4, "status": "completed"}},
+			deliveries: []map[string]interface{}{{"id": 9, "status": "assigned"}},
+			wantState:  sagaCompensated,
+			wantCalls:  []string{"PUT /deliveries/9/status", "PUT /payments/4/refund"},
+		},
+		{
+			name: "voids pending payments, skips settled ones",
+			payments: []map[string]interface{}{
+				{"id": 4, "status": "refunded"},
+				{"id": 5, "status": "pending"},
+				{"id": 6, "status": "failed"},
+			},
+			deliveries: []map[string]interface{}{{"id": 8, "status": "cancelled"}, {"id": 9, "status": "delivered"}},
+			wantState:  sagaCompensated,
+			wantCalls:  []string{"PUT /payments/5/refund"},
+		},
+		{
+			name:         "a failing refund is retried later",
+			payments:     []map[string]interface{}{{"id": 4, "status": "completed"}},
+			refundStatus: http.StatusServiceUnavailable,
+			wantState:    sagaCompensating,
+			wantCalls:    []string{"PUT /payments/4/refund"},
+			wantAttempts: 1,
+		},
+		{
+			name:         "a refund rejected for good fails the saga",
+			payments:     []map[string]interface{}{{"id": 4, "status": "completed"}},
+			refundStatus: http.StatusUnprocessableEntity,
+			wantState:    sagaFailed,
+			wantCalls:    []string{"PUT /payments/4/refund"},
+			wantAttempts: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useMemoryStore(t)
+			services := &fakeServices{payments: tt.payments, deliveries: tt.deliveries, refundStatus: tt.refundStatus}
+			useFakeServices(t, services)
+			coordinator := newSagaCoordinator(store, time.Hour, 3)
+
+			saga := &OrderSaga{State: sagaRunning, Log: []SagaLogEntry{}}
+			order := createSagaOrder(t, "paid", saga)
+			if _, err := store.Update(order.ID, func(order *Order, tx *OrderTx) error {
+				return changeStatus(order, tx, "cancelled", "customer", "")
+			}); err != nil {
+				t.Fatal(err)
+			}
+
+			order = runSaga(t, coordinator, order.ID)
+			if order.Saga.State != tt.wantState {
+				t.Errorf("state %s, want %s (last error %q)", order.Saga.State, tt.wantState, order.Saga.LastError)
+			}
+			if order.Saga.Attempts != tt.wantAttempts {
+				t.Errorf("attempts %d, want %d", order.Saga.Attempts, tt.wantAttempts)
+			}
+			if !reflect.DeepEqual(services.calls, tt.wantCalls) {
+				t.Errorf("calls %v, want %v", services.calls, tt.wantCalls)
+			}
+			if tt.wantState == sagaCompensated && (len(order.Saga.Compensations) != 0 || order.Saga.NextAttemptAt != nil) {
+				t.Errorf("compensated saga still has %v due at %v", order.Saga.Compensations, order.Saga.NextAttemptAt)
+			}
+		})
+	}
+}
+
+func TestSagaCompensationRetries(t *testing.T) {
+	useMemoryStore(t)
+	services := &fakeServices{
+		payments:     []map[string]interface{}{{"id": 4, "status": "completed"}},
+		refundStatus: http.StatusServiceUnavailable,
+	}
+	useFakeServices(t, services)
+	coordinator := newSagaCoordinator(store, time.Hour, 3)
+
+	now := time.Now()
+	saga := &OrderSaga{State: sagaRunning, Log: []SagaLogEntry{}}
+	saga.compensate("test", now)
+	order := createSagaOrder(t, "cancelled", saga)
+
+	for attempt := 1; attempt <= 3; attempt++ {
+		order = runSaga(t, coordinator, order.ID)
+		if attempt < 3 {
+			if order.Saga.State != sagaCompensating || order.Saga.NextAttemptAt == nil {
+				t.Fatalf("attempt %d: state %s, next attempt %v", attempt, order.Saga.State, order.Saga.NextAttemptAt)
+			}
+			// Make the retry due now instead of after the backoff
+			if _, err := store.Update(order.ID, func(order *Order, tx *OrderTx) error {
+				order.Saga.NextAttemptAt = &now
+				return nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if order.Saga.State != sagaFailed || order.Saga.Attempts != 3 {
+		t.Errorf("after 3 attempts: state %s, attempts %d", order.Saga.State, order.Saga.Attempts)
+	}
+	if got := order.Saga.Compensations; !reflect.DeepEqual(got, []string{sagaRefundPayment}) {
+		t.Errorf("compensations left %v, want the refund", got)
+	}
+	if len(services.calls) != 3 {
+		t.Errorf("refund tried %d times, want 3: %v", len(services.calls), services.calls)
+	}
+}
+
+func TestSagaCreatePayment(t *testing.T) {
+	tests := []struct {
+		name          string
+		payments      []map[string]interface{}
+		createStatus  int
+		wantStatus    string
+		wantState     string
+		wantPaymentID int
+	}{
+		{
+			name:          "creates the payment and waits for the customer",
+			wantStatus:    "created",
+			wantState:     sagaRunning,
+			wantPaymentID: 1,
+		},
+		{
+			name:          "key used with an older total reuses the payment",
+			payments:      []map[string]interface{}{{"id": 7, "kind": "", "status": "pending"}},
+			createStatus:  http.StatusUnprocessableEntity,
+			wantStatus:    "created",
+			wantState:     sagaRunning,
+			wantPaymentID: 7,
+		},
+		{
+			name:         "rejected without a payment cancels the order",
+			payments:     []map[string]interface{}{{"id": 7, "kind": "", "status": "voided"}},
+			createStatus: http.StatusUnprocessableEntity,
+			wantStatus:   "cancelled",
+			wantState:    sagaCompensated,
+		},
+		{
+			name:         "invalid payment cancels the order",
+			createStatus: http.StatusBadRequest,
+			wantStatus:   "cancelled",
+			wantState:    sagaCompensated,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useMemoryStore(t)
+			services := &fakeServices{payments: tt.payments, createStatus: tt.createStatus}
+			useFakeServices(t, services)
+			coordinator := newSagaCoordinator(store, time.Hour, 3)
+
+			order := createSagaOrder(t, "created", newOrderSaga(time.Now()))
+			order = runSaga(t, coordinator, order.ID)
+			if order.Status != tt.wantStatus || order.Saga.State != tt.wantState {
+				t.Errorf("order %s with saga %s, want %s with %s (log %+v)", order.Status, order.Saga.State, tt.wantStatus, tt.wantState, order.Saga.Log)
+			}
+			if tt.wantPaymentID != 0 && order.Saga.PaymentID != tt.wantPaymentID {
+				t.Errorf("payment %d, want %d", order.Saga.PaymentID, tt.wantPaymentID)
+			}
+		})
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// validateSchedule checks a requested delivery time against the configured
+// lead time (the kitchen and courier need at least that long) and horizon
+func validateSchedule(scheduledFor, now time.Time) error {
+	if scheduledFor.Before(now.Add(config.ScheduleLeadTime)) {
+		return &ValidationError{Message: fmt.Sprintf(
+			"Scheduled orders must be placed at least %s ahead", config.ScheduleLeadTime)}
+	}
+	if scheduledFor.After(now.Add(config.ScheduleMaxAhead)) {
+		return &ValidationError{Message: fmt.Sprintf(
+			"Scheduled orders can be placed at most %s ahead", config.ScheduleMaxAhead)}
+	}
+	return nil
+}
+
+// releaseTime is when a scheduled order enters the normal payment and
+// delivery flow so it arrives at the requested time
+func releaseTime(order Order) time.Time {
+	return order.ScheduledFor.Add(-config.ScheduleLeadTime)
+}
+
+// OrderScheduler releases scheduled orders when their time comes, rejects
+// orders restaurants didn't accept in time and purges expired carts. All
+// state lives in the order store, so nothing is lost across a restart.
+type OrderScheduler struct {
+	interval time.Duration
+}
+
+// Run checks for due scheduled orders until the process exits
+func (s *OrderScheduler) Run() {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		s.releaseDue(time.Now())
+		s.rejectOverdue(time.Now())
+		s.purgeCarts(time.Now())
+		<-ticker.C
+	}
+}
+
+func (s *OrderScheduler) releaseDue(now time.Time) {
+	scheduled, err := store.Query(OrderQuery{Statuses: []string{"scheduled"}, SortBy: sortByCreatedAt})
+	if err != nil {
+		log.Printf("Error loading scheduled orders: %v", err)
+		return
+	}
+
+	released := false
+	for _, order := range scheduled {
+		if order.ScheduledFor == nil || releaseTime(order).After(now) {
+			continue
+		}
+		_, err := store.Update(order.ID, func(order *Order, tx *OrderTx) error {
+			// Moving to created starts the order's saga, which creates the payment
+			return changeStatus(order, tx, "created", "scheduler", "scheduled time reached")
+		})
+		var transitionErr *TransitionError
+		if errors.As(err, &transitionErr) {
+			// Cancelled since it was loaded
+			continue
+		}
+		if err != nil {
+			log.Printf("Error releasing scheduled order #%d: %v", order.ID, err)
+			continue
+		}
+		log.Printf("Released scheduled order #%d for delivery at %s", order.ID, order.ScheduledFor.Format(time.RFC3339))
+		released = true
+	}
+	if released {
+		sagas.Wake()
+	}
+}
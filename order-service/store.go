@@ -0,0 +1,557 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ErrOrderNotFound is returned by an OrderStore when no order has the requested ID
+var ErrOrderNotFound = errors.New("order not found")
+
+// OrderStore persists orders. Implementations must be safe for concurrent use.
+type OrderStore interface {
+	// List returns every order, oldest first
+	List() ([]Order, error)
+	// Query returns the orders matching q in the order q asks for, starting
+	// after q.After and returning at most q.Limit orders (all if 0)
+	Query(q OrderQuery) ([]Order, error)
+	// Get returns a single order or ErrOrderNotFound
+	Get(id int) (Order, error)
+	// Create assigns the next ID to the order, calls fn (if not nil) with the
+	// numbered order and stores the order together with anything fn adds to tx
+	Create(order *Order, fn func(order *Order, tx *OrderTx) error) error
+	// Update loads the order, applies fn to it and saves the result together
+	// with anything fn adds to tx, atomically. If fn returns an error nothing
+	// is written and the error is returned as is.
+	Update(id int, fn func(order *Order, tx *OrderTx) error) (Order, error)
+	// History returns the recorded status changes of an order, oldest first
+	History(orderID int) ([]StatusChange, error)
+	Close() error
+
+	OutboxStore
+	PromoStore
+	SagaStore
+	GroupStore
+	CartStore
+	AddressStore
+}
+
+// OrderTx collects what an order change wants written in the same transaction
+type OrderTx struct {
+	events      []OutboxEvent
+	transitions []StatusChange
+	redemptions []PromoRedemption
+	groups      []groupWrite
+	carts       []Cart
+}
+
+// newOrderStore builds the store selected by the ORDER_STORE setting
+func newOrderStore(cfg Config) (OrderStore, error) {
+	switch cfg.OrderStore {
+	case "memory":
+		return newMemoryOrderStore(), nil
+	case "sqlite":
+		return newSQLiteOrderStore(cfg.DatabasePath)
+	default:
+		return nil, fmt.Errorf("unknown order store %q (expected \"memory\" or \"sqlite\")", cfg.OrderStore)
+	}
+}
+
+// memoryOrderStore keeps orders in a slice; everything is lost on restart.
+// It is meant for tests and local development.
+type memoryOrderStore struct {
+	mutex        sync.Mutex
+	orders       []Order
+	nextID       int
+	events       []OutboxEvent
+	nextEventID  int
+	history      map[int][]StatusChange
+	nextChangeID int64
+	promos       map[string]PromoCode
+	redemptions  []PromoRedemption
+	groups       map[string]GroupSession
+	carts        map[int]Cart
+	addresses    []SavedAddress
+	nextAddrID   int
+}
+
+func newMemoryOrderStore() *memoryOrderStore {
+	return &memoryOrderStore{
+		nextID:       1,
+		nextEventID:  1,
+		nextAddrID:   1,
+		nextChangeID: 1,
+		history:      make(map[int][]StatusChange),
+		promos:       make(map[string]PromoCode),
+		groups:       make(map[string]GroupSession),
+		carts:        make(map[int]Cart),
+	}
+}
+
+func (s *memoryOrderStore) List() ([]Order, error) {
+	return s.filter(func(Order) bool { return true }), nil
+}
+
+func (s *memoryOrderStore) Query(q OrderQuery) ([]Order, error) {
+	return applyOrderQuery(q, s.filter(func(Order) bool { return true })), nil
+}
+
+func (s *memoryOrderStore) filter(match func(Order) bool) []Order {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var result []Order
+	for _, order := range s.orders {
+		if match(order) {
+			result = append(result, cloneOrder(order))
+		}
+	}
+	return result
+}
+
+func (s *memoryOrderStore) Get(id int) (Order, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, order := range s.orders {
+		if order.ID == id {
+			return cloneOrder(order), nil
+		}
+	}
+	return Order{}, ErrOrderNotFound
+}
+
+func (s *memoryOrderStore) Create(order *Order, fn func(order *Order, tx *OrderTx) error) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	order.ID = s.nextID
+	tx := &OrderTx{}
+	if fn != nil {
+		if err := fn(order, tx); err != nil {
+			return err
+		}
+	}
+	if err := s.commit(tx); err != nil {
+		return err
+	}
+	s.nextID++
+	s.orders = append(s.orders, cloneOrder(*order))
+	tx.committed(*order)
+	return nil
+}
+
+func (s *memoryOrderStore) Update(id int, fn func(order *Order, tx *OrderTx) error) (Order, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for i := range s.orders {
+		if s.orders[i].ID == id {
+			updated := cloneOrder(s.orders[i])
+			tx := &OrderTx{}
+			if err := fn(&updated, tx); err != nil {
+				return Order{}, err
+			}
+			updated.ID = id
+			if err := s.commit(tx); err != nil {
+				return Order{}, err
+			}
+			s.orders[i] = cloneOrder(updated)
+			tx.committed(updated)
+			return updated, nil
+		}
+	}
+	return Order{}, ErrOrderNotFound
+}
+
+// commit stores what was collected in tx; the caller holds the mutex.
+// Promo usage limits and group session and cart versions are checked before
+// anything is written.
+func (s *memoryOrderStore) commit(tx *OrderTx) error {
+	for _, cart := range tx.carts {
+		stored, ok := s.carts[cart.UserID]
+		if !ok || !stored.UpdatedAt.Equal(cart.UpdatedAt) {
+			return ErrCartChanged
+		}
+	}
+	for _, write := range tx.groups {
+		stored, ok := s.groups[write.group.Code]
+		if !ok {
+			return ErrGroupNotFound
+		}
+		if !stored.UpdatedAt.Equal(write.expectedUpdatedAt) {
+			return ErrGroupChanged
+		}
+	}
+	for i, redemption := range tx.redemptions {
+		usesByUser, uses := 0, 0
+		for _, r := range append(s.redemptions, tx.redemptions[:i]...) {
+			if r.Code != redemption.Code {
+				continue
+			}
+			uses++
+			if r.UserID == redemption.UserID {
+				usesByUser++
+			}
+		}
+		if err := checkRedemptionLimits(redemption, usesByUser, uses); err != nil {
+			return err
+		}
+	}
+
+	for _, event := range tx.events {
+		event.ID = s.nextEventID
+		s.nextEventID++
+		s.events = append(s.events, event)
+	}
+	for i := range tx.transitions {
+		tx.transitions[i].ID = s.nextChangeID
+		s.nextChangeID++
+		change := tx.transitions[i]
+		s.history[change.OrderID] = append(s.history[change.OrderID], change)
+	}
+	s.redemptions = append(s.redemptions, tx.redemptions...)
+	for _, write := range tx.groups {
+		s.groups[write.group.Code] = cloneGroup(write.group)
+	}
+	for _, cart := range tx.carts {
+		delete(s.carts, cart.UserID)
+	}
+	return nil
+}
+
+func (s *memoryOrderStore) History(orderID int) ([]StatusChange, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return append([]StatusChange(nil), s.history[orderID]...), nil
+}
+
+func (s *memoryOrderStore) DueEvents(now time.Time, limit int) ([]OutboxEvent, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var due []OutboxEvent
+	for _, event := range s.events {
+		if event.Status == outboxPending && !event.NextAttemptAt.After(now) {
+			due = append(due, event)
+			if len(due) == limit {
+				break
+			}
+		}
+	}
+	return due, nil
+}
+
+func (s *memoryOrderStore) ListEvents(status string) ([]OutboxEvent, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var result []OutboxEvent
+	for _, event := range s.events {
+		if status == "" || event.Status == status {
+			result = append(result, event)
+		}
+	}
+	return result, nil
+}
+
+func (s *memoryOrderStore) SaveEventAttempt(event OutboxEvent) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for i := range s.events {
+		if s.events[i].ID == event.ID {
+			s.events[i] = event
+			return nil
+		}
+	}
+	return ErrEventNotFound
+}
+
+func (s *memoryOrderStore) ReplayEvent(id int) (OutboxEvent, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for i := range s.events {
+		if s.events[i].ID == id {
+			if s.events[i].Status != outboxDead {
+				return OutboxEvent{}, ErrEventNotDead
+			}
+			s.events[i].Status = outboxPending
+			s.events[i].Attempts = 0
+			s.events[i].NextAttemptAt = time.Now()
+			return s.events[i], nil
+		}
+	}
+	return OutboxEvent{}, ErrEventNotFound
+}
+
+func (s *memoryOrderStore) PurgeDelivered(before time.Time) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	kept := s.events[:0]
+	for _, event := range s.events {
+		if event.Status == outboxDelivered && event.DeliveredAt != nil && event.DeliveredAt.Before(before) {
+			continue
+		}
+		kept = append(kept, event)
+	}
+	s.events = kept
+	return nil
+}
+
+func (s *memoryOrderStore) DueSagas(now time.Time, limit int) ([]Order, error) {
+	due := s.filter(func(order Order) bool { return order.Saga != nil && order.Saga.due(now) })
+	sort.SliceStable(due, func(i, j int) bool { return due[i].Saga.NextAttemptAt.Before(*due[j].Saga.NextAttemptAt) })
+	if len(due) > limit {
+		due = due[:limit]
+	}
+	return due, nil
+}
+
+func (s *memoryOrderStore) ListSagas(state string) ([]Order, error) {
+	return s.filter(func(order Order) bool {
+		return order.Saga != nil && (state == "" || order.Saga.State == state)
+	}), nil
+}
+
+func (s *memoryOrderStore) ListPromoCodes() ([]PromoCode, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	promos := make([]PromoCode, 0, len(s.promos))
+	for _, promo := range s.promos {
+		promos = append(promos, promo)
+	}
+	sort.Slice(promos, func(i, j int) bool { return promos[i].Code < promos[j].Code })
+	return promos, nil
+}
+
+func (s *memoryOrderStore) GetPromoCode(code string) (PromoCode, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	promo, ok := s.promos[code]
+	if !ok {
+		return PromoCode{}, ErrPromoNotFound
+	}
+	return promo, nil
+}
+
+func (s *memoryOrderStore) SavePromoCode(promo PromoCode) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.promos[promo.Code] = promo
+	return nil
+}
+
+func (s *memoryOrderStore) DeletePromoCode(code string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, ok := s.promos[code]; !ok {
+		return ErrPromoNotFound
+	}
+	delete(s.promos, code)
+	return nil
+}
+
+func (s *memoryOrderStore) CreateGroup(group GroupSession) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, ok := s.groups[group.Code]; ok {
+		return ErrGroupCodeTaken
+	}
+	s.groups[group.Code] = cloneGroup(group)
+	return nil
+}
+
+func (s *memoryOrderStore) GetGroup(code string) (GroupSession, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	group, ok := s.groups[code]
+	if !ok {
+		return GroupSession{}, ErrGroupNotFound
+	}
+	return cloneGroup(group), nil
+}
+
+func (s *memoryOrderStore) UpdateGroup(code string, fn func(group *GroupSession) error) (GroupSession, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	stored, ok := s.groups[code]
+	if !ok {
+		return GroupSession{}, ErrGroupNotFound
+	}
+	updated := cloneGroup(stored)
+	if err := fn(&updated); err != nil {
+		return GroupSession{}, err
+	}
+	updated.Code = code
+	s.groups[code] = cloneGroup(updated)
+	return updated, nil
+}
+
+func (s *memoryOrderStore) GetCart(userID int) (Cart, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	cart, ok := s.carts[userID]
+	if !ok {
+		return Cart{}, ErrCartNotFound
+	}
+	return cloneCart(cart), nil
+}
+
+func (s *memoryOrderStore) UpdateCart(userID int, fn func(cart *Cart) error) (Cart, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := time.Now()
+	updated := newCart(userID, now)
+	if stored, ok := s.carts[userID]; ok && !stored.expired(now) {
+		updated = cloneCart(stored)
+	}
+	if err := fn(&updated); err != nil {
+		return Cart{}, err
+	}
+	updated.UserID = userID
+	s.carts[userID] = cloneCart(updated)
+	return updated, nil
+}
+
+func (s *memoryOrderStore) DeleteCart(userID int) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	delete(s.carts, userID)
+	return nil
+}
+
+func (s *memoryOrderStore) PurgeExpiredCarts(now time.Time) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	purged := 0
+	for userID, cart := range s.carts {
+		if cart.expired(now) {
+			delete(s.carts, userID)
+			purged++
+		}
+	}
+	return purged, nil
+}
+
+func (s *memoryOrderStore) ListAddresses(userID int) ([]SavedAddress, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var result []SavedAddress
+	for _, address := range s.addresses {
+		if address.UserID == userID {
+			result = append(result, address)
+		}
+	}
+	return result, nil
+}
+
+func (s *memoryOrderStore) GetAddress(userID, id int) (SavedAddress, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, address := range s.addresses {
+		if address.ID == id && address.UserID == userID {
+			return address, nil
+		}
+	}
+	return SavedAddress{}, ErrAddressNotFound
+}
+
+func (s *memoryOrderStore) SaveAddress(address *SavedAddress) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	index := -1
+	if address.ID != 0 {
+		for i := range s.addresses {
+			if s.addresses[i].ID == address.ID && s.addresses[i].UserID == address.UserID {
+				index = i
+			}
+		}
+		if index < 0 {
+			return ErrAddressNotFound
+		}
+	}
+	if address.IsDefault {
+		for i := range s.addresses {
+			if s.addresses[i].UserID == address.UserID {
+				s.addresses[i].IsDefault = false
+			}
+		}
+	}
+	if index < 0 {
+		address.ID = s.nextAddrID
+		s.nextAddrID++
+		s.addresses = append(s.addresses, *address)
+		return nil
+	}
+	s.addresses[index] = *address
+	return nil
+}
+
+func (s *memoryOrderStore) DeleteAddress(userID, id int) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for i, address := range s.addresses {
+		if address.ID == id && address.UserID == userID {
+			s.addresses = append(s.addresses[:i], s.addresses[i+1:]...)
+			return nil
+		}
+	}
+	return ErrAddressNotFound
+}
+
+func (s *memoryOrderStore) Close() error {
+	return nil
+}
+
+// cloneOrder copies the slices inside an order so callers can't mutate stored state
+func cloneOrder(order Order) Order {
+	order.Items = append([]OrderItem(nil), order.Items...)
+	order.Discounts = append([]AppliedDiscount(nil), order.Discounts...)
+	order.CancelledItems = append([]ItemCancellation(nil), order.CancelledItems...)
+	if order.Acceptance != nil {
+		acceptance := *order.Acceptance
+		order.Acceptance = &acceptance
+	}
+	if order.Saga != nil {
+		saga := *order.Saga
+		saga.Compensations = append([]string(nil), saga.Compensations...)
+		saga.Log = append([]SagaLogEntry(nil), saga.Log...)
+		if saga.NextAttemptAt != nil {
+			next := *saga.NextAttemptAt
+			saga.NextAttemptAt = &next
+		}
+		order.Saga = &saga
+	}
+	if order.ETA != nil {
+		eta := *order.ETA
+		order.ETA = &eta
+	}
+	if order.Group != nil {
+		group := *order.Group
+		group.Shares = append([]PaymentShare(nil), group.Shares...)
+		order.Group = &group
+	}
+	return order
+}
@@ -0,0 +1,931 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	_ "modernc.org/sqlite" // Pure Go SQLite driver, builds without cgo on alpine
+)
+
+// sqliteMigrations is the ordered list of schema changes. Each entry is applied
+// once, inside a transaction, and recorded in schema_migrations under its
+// 1-based position. Never edit an entry that has shipped; append a new one.
+var sqliteMigrations = [][]string{
+	{
+		`CREATE TABLE orders (
+			id            INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id       INTEGER NOT NULL,
+			restaurant_id INTEGER NOT NULL,
+			status        TEXT    NOT NULL,
+			total_amount  REAL    NOT NULL,
+			created_at    INTEGER NOT NULL,
+			updated_at    INTEGER NOT NULL,
+			data          TEXT    NOT NULL
+		)`,
+		`CREATE INDEX idx_orders_user_id ON orders(user_id)`,
+		`CREATE INDEX idx_orders_restaurant_id ON orders(restaurant_id)`,
+	},
+	{
+		`CREATE TABLE idempotency_keys (
+			key         TEXT    PRIMARY KEY,
+			fingerprint TEXT    NOT NULL,
+			status_code INTEGER NOT NULL DEFAULT 0,
+			body        BLOB,
+			created_at  INTEGER NOT NULL
+		)`,
+		`CREATE INDEX idx_idempotency_keys_created_at ON idempotency_keys(created_at)`,
+	},
+	{
+		`CREATE TABLE outbox_events (
+			id              INTEGER PRIMARY KEY AUTOINCREMENT,
+			order_id        INTEGER NOT NULL,
+			destination     TEXT    NOT NULL,
+			method          TEXT    NOT NULL,
+			path            TEXT    NOT NULL,
+			payload         BLOB    NOT NULL,
+			idempotency_key TEXT    NOT NULL,
+			status          TEXT    NOT NULL,
+			attempts        INTEGER NOT NULL DEFAULT 0,
+			last_error      TEXT    NOT NULL DEFAULT '',
+			next_attempt_at INTEGER NOT NULL,
+			created_at      INTEGER NOT NULL,
+			delivered_at    INTEGER
+		)`,
+		`CREATE INDEX idx_outbox_events_due ON outbox_events(status, next_attempt_at)`,
+	},
+	{
+		`CREATE TABLE order_status_history (
+			id          INTEGER PRIMARY KEY AUTOINCREMENT,
+			order_id    INTEGER NOT NULL,
+			from_status TEXT    NOT NULL,
+			to_status   TEXT    NOT NULL,
+			actor       TEXT    NOT NULL,
+			reason      TEXT    NOT NULL DEFAULT '',
+			changed_at  INTEGER NOT NULL
+		)`,
+		`CREATE INDEX idx_order_status_history_order_id ON order_status_history(order_id)`,
+	},
+	{
+		`CREATE TABLE promo_codes (
+			code TEXT PRIMARY KEY,
+			data TEXT NOT NULL
+		)`,
+		`CREATE TABLE promo_redemptions (
+			id          INTEGER PRIMARY KEY AUTOINCREMENT,
+			code        TEXT    NOT NULL,
+			user_id     INTEGER NOT NULL,
+			order_id    INTEGER NOT NULL,
+			redeemed_at INTEGER NOT NULL
+		)`,
+		`CREATE INDEX idx_promo_redemptions_code_user ON promo_redemptions(code, user_id)`,
+	},
+	{
+		// Exact totals in minor units; total_amount is kept for ad-hoc queries.
+		// Orders stored so far were all priced in a two-digit currency.
+		`ALTER TABLE orders ADD COLUMN total_minor INTEGER NOT NULL DEFAULT 0`,
+		`UPDATE orders SET total_minor = CAST(ROUND(total_amount * 100) AS INTEGER)`,
+	},
+	{
+		// The saga itself is in the data column; these find the ones with work to do
+		`ALTER TABLE orders ADD COLUMN saga_state TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE orders ADD COLUMN saga_next_attempt_at INTEGER`,
+		`CREATE INDEX idx_orders_saga_due ON orders(saga_next_attempt_at)`,
+	},
+	{
+		`CREATE TABLE group_sessions (
+			code       TEXT PRIMARY KEY,
+			updated_at INTEGER NOT NULL,
+			data       TEXT    NOT NULL
+		)`,
+	},
+	{
+		`CREATE TABLE carts (
+			user_id    INTEGER PRIMARY KEY,
+			updated_at INTEGER NOT NULL,
+			expires_at INTEGER NOT NULL,
+			data       TEXT    NOT NULL
+		)`,
+		`CREATE INDEX idx_carts_expires_at ON carts(expires_at)`,
+	},
+	{
+		`CREATE TABLE saved_addresses (
+			id         INTEGER PRIMARY KEY AUTOINCREMENT,
+			user_id    INTEGER NOT NULL,
+			is_default INTEGER NOT NULL DEFAULT 0,
+			data       TEXT    NOT NULL
+		)`,
+		`CREATE INDEX idx_saved_addresses_user_id ON saved_addresses(user_id)`,
+	},
+	{
+		// Lets a retry take over a key whose request died with the process
+		`ALTER TABLE idempotency_keys ADD COLUMN reserved_at INTEGER NOT NULL DEFAULT 0`,
+		`UPDATE idempotency_keys SET reserved_at = created_at`,
+	},
+}
+
+// sqliteOrderStore keeps orders in an embedded SQLite database. The columns
+// that are filtered on are stored separately; the full order is kept as JSON
+// in the data column so new Order fields don't need a migration.
+type sqliteOrderStore struct {
+	db *sql.DB
+}
+
+func newSQLiteOrderStore(path string) (*sqliteOrderStore, error) {
+	if dir := filepath.Dir(path); dir != "." {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return nil, fmt.Errorf("creating database directory: %w", err)
+		}
+	}
+
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, fmt.Errorf("opening database: %w", err)
+	}
+	// SQLite allows a single writer; one connection avoids "database is locked"
+	db.SetMaxOpenConns(1)
+
+	for _, pragma := range []string{
+		"PRAGMA journal_mode = WAL",
+		"PRAGMA busy_timeout = 5000",
+		"PRAGMA foreign_keys = ON",
+	} {
+		if _, err := db.Exec(pragma); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("configuring database (%s): %w", pragma, err)
+		}
+	}
+
+	if err := migrateSQLite(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &sqliteOrderStore{db: db}, nil
+}
+
+// migrateSQLite applies every migration newer than the recorded schema version
+func migrateSQLite(db *sql.DB) error {
+	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version    INTEGER PRIMARY KEY,
+		applied_at INTEGER NOT NULL
+	)`); err != nil {
+		return fmt.Errorf("creating schema_migrations: %w", err)
+	}
+
+	var current int
+	if err := db.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&current); err != nil {
+		return fmt.Errorf("reading schema version: %w", err)
+	}
+
+	for i := current; i < len(sqliteMigrations); i++ {
+		version := i + 1
+		tx, err := db.Begin()
+		if err != nil {
+			return fmt.Errorf("migration %d: %w", version, err)
+		}
+		for _, stmt := range sqliteMigrations[i] {
+			if _, err := tx.Exec(stmt); err != nil {
+				tx.Rollback()
+				return fmt.Errorf("migration %d: %w", version, err)
+			}
+		}
+		if _, err := tx.Exec(`INSERT INTO schema_migrations (version, applied_at) VALUES (?, ?)`, version, time.Now().Unix()); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d: %w", version, err)
+		}
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("migration %d: %w", version, err)
+		}
+		log.Printf("Applied database migration %d", version)
+	}
+	return nil
+}
+
+func (s *sqliteOrderStore) List() ([]Order, error) {
+	return s.query(`SELECT data FROM orders ORDER BY id`)
+}
+
+func (s *sqliteOrderStore) Query(q OrderQuery) ([]Order, error) {
+	var where []string
+	var args []interface{}
+	if q.UserID != 0 {
+		where = append(where, "user_id = ?")
+		args = append(args, q.UserID)
+	}
+	if q.RestaurantID != 0 {
+		where = append(where, "restaurant_id = ?")
+		args = append(args, q.RestaurantID)
+	}
+	if len(q.Statuses) > 0 {
+		where = append(where, "status IN (?"+strings.Repeat(", ?", len(q.Statuses)-1)+")")
+		for _, status := range q.Statuses {
+			args = append(args, status)
+		}
+	}
+	if !q.CreatedFrom.IsZero() {
+		where = append(where, "created_at >= ?")
+		args = append(args, q.CreatedFrom.UnixNano())
+	}
+	if !q.CreatedTo.IsZero() {
+		where = append(where, "created_at < ?")
+		args = append(args, q.CreatedTo.UnixNano())
+	}
+	if q.MinTotal != nil {
+		where = append(where, "total_minor >= ?")
+		args = append(args, q.MinTotal.Amount)
+	}
+	if q.MaxTotal != nil {
+		where = append(where, "total_minor <= ?")
+		args = append(args, q.MaxTotal.Amount)
+	}
+
+	column := "created_at"
+	if q.SortBy == sortByTotalAmount {
+		column = "total_minor"
+	}
+	direction, cmp := "ASC", ">"
+	if q.Descending {
+		direction, cmp = "DESC", "<"
+	}
+	if q.After != nil {
+		var value interface{} = q.After.CreatedAt
+		if q.SortBy == sortByTotalAmount {
+			value = q.After.TotalAmount
+		}
+		where = append(where, fmt.Sprintf("(%s %s ? OR (%s = ? AND id %s ?))", column, cmp, column, cmp))
+		args = append(args, value, value, q.After.ID)
+	}
+
+	query := "SELECT data FROM orders"
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	query += fmt.Sprintf(" ORDER BY %s %s, id %s", column, direction, direction)
+	if q.Limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, q.Limit)
+	}
+	return s.query(query, args...)
+}
+
+func (s *sqliteOrderStore) query(query string, args ...interface{}) ([]Order, error) {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []Order
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		var order Order
+		if err := json.Unmarshal([]byte(data), &order); err != nil {
+			return nil, fmt.Errorf("decoding stored order: %w", err)
+		}
+		result = append(result, order)
+	}
+	return result, rows.Err()
+}
+
+func (s *sqliteOrderStore) Get(id int) (Order, error) {
+	return getOrderTx(s.db, id)
+}
+
+func (s *sqliteOrderStore) Create(order *Order, fn func(order *Order, tx *OrderTx) error) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// The ID comes from SQLite, so insert first and write the JSON once it is known
+	res, err := tx.Exec(`INSERT INTO orders (user_id, restaurant_id, status, total_amount, total_minor, created_at, updated_at, data)
+		VALUES (?, ?, ?, ?, ?, ?, ?, '{}')`,
+		order.UserID, order.RestaurantID, order.Status, order.TotalAmount.Major(), order.TotalAmount.Amount,
+		order.CreatedAt.UnixNano(), order.UpdatedAt.UnixNano())
+	if err != nil {
+		return err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	order.ID = int(id)
+
+	changes := &OrderTx{}
+	if fn != nil {
+		if err := fn(order, changes); err != nil {
+			return err
+		}
+	}
+	if err := saveOrderTx(tx, *order); err != nil {
+		return err
+	}
+	if err := commitChangesTx(tx, changes); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	changes.committed(*order)
+	return nil
+}
+
+func (s *sqliteOrderStore) Update(id int, fn func(order *Order, tx *OrderTx) error) (Order, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return Order{}, err
+	}
+	defer tx.Rollback()
+
+	order, err := getOrderTx(tx, id)
+	if err != nil {
+		return Order{}, err
+	}
+	changes := &OrderTx{}
+	if err := fn(&order, changes); err != nil {
+		return Order{}, err
+	}
+	order.ID = id
+	if err := saveOrderTx(tx, order); err != nil {
+		return Order{}, err
+	}
+	if err := commitChangesTx(tx, changes); err != nil {
+		return Order{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return Order{}, err
+	}
+	changes.committed(order)
+	return order, nil
+}
+
+func (s *sqliteOrderStore) Close() error {
+	return s.db.Close()
+}
+
+// sqlQueryer is the subset of *sql.DB and *sql.Tx used by the helpers below
+type sqlQueryer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+func getOrderTx(q sqlQueryer, id int) (Order, error) {
+	var data string
+	err := q.QueryRow(`SELECT data FROM orders WHERE id = ?`, id).Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Order{}, ErrOrderNotFound
+	}
+	if err != nil {
+		return Order{}, err
+	}
+
+	var order Order
+	if err := json.Unmarshal([]byte(data), &order); err != nil {
+		return Order{}, fmt.Errorf("decoding stored order %d: %w", id, err)
+	}
+	return order, nil
+}
+
+func saveOrderTx(q sqlQueryer, order Order) error {
+	data, err := json.Marshal(order)
+	if err != nil {
+		return err
+	}
+	sagaState := ""
+	var sagaNextAttemptAt interface{}
+	if order.Saga != nil {
+		sagaState = order.Saga.State
+		if order.Saga.NextAttemptAt != nil {
+			sagaNextAttemptAt = order.Saga.NextAttemptAt.UnixNano()
+		}
+	}
+	_, err = q.Exec(`UPDATE orders
+		SET user_id = ?, restaurant_id = ?, status = ?, total_amount = ?, total_minor = ?, created_at = ?, updated_at = ?,
+			saga_state = ?, saga_next_attempt_at = ?, data = ?
+		WHERE id = ?`,
+		order.UserID, order.RestaurantID, order.Status, order.TotalAmount.Major(), order.TotalAmount.Amount,
+		order.CreatedAt.UnixNano(), order.UpdatedAt.UnixNano(), sagaState, sagaNextAttemptAt, string(data), order.ID)
+	return err
+}
+
+// commitChangesTx writes what an order change collected in its OrderTx.
+// Promo usage limits are checked against the redemptions table in the same
+// transaction, so concurrent orders can't both take the last use.
+func commitChangesTx(q sqlQueryer, changes *OrderTx) error {
+	for _, write := range changes.groups {
+		if err := saveGroupTx(q, write.group, &write.expectedUpdatedAt); err != nil {
+			return err
+		}
+	}
+	for _, cart := range changes.carts {
+		res, err := q.Exec(`DELETE FROM carts WHERE user_id = ? AND updated_at = ?`, cart.UserID, cart.UpdatedAt.UnixNano())
+		if err != nil {
+			return fmt.Errorf("removing checked out cart: %w", err)
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			return ErrCartChanged
+		}
+	}
+	for _, redemption := range changes.redemptions {
+		var usesByUser, uses int
+		if err := q.QueryRow(`SELECT COUNT(CASE WHEN user_id = ? THEN 1 END), COUNT(*)
+			FROM promo_redemptions WHERE code = ?`, redemption.UserID, redemption.Code).Scan(&usesByUser, &uses); err != nil {
+			return fmt.Errorf("counting promo redemptions: %w", err)
+		}
+		if err := checkRedemptionLimits(redemption, usesByUser, uses); err != nil {
+			return err
+		}
+		if _, err := q.Exec(`INSERT INTO promo_redemptions (code, user_id, order_id, redeemed_at) VALUES (?, ?, ?, ?)`,
+			redemption.Code, redemption.UserID, redemption.OrderID, redemption.RedeemedAt.UnixNano()); err != nil {
+			return fmt.Errorf("writing promo redemption: %w", err)
+		}
+	}
+	for _, event := range changes.events {
+		if _, err := q.Exec(`INSERT INTO outbox_events
+			(order_id, destination, method, path, payload, idempotency_key, status, attempts, last_error, next_attempt_at, created_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?, 0, '', ?, ?)`,
+			event.OrderID, event.Destination, event.Method, event.Path, []byte(event.Payload), event.IdempotencyKey,
+			event.Status, event.NextAttemptAt.UnixNano(), event.CreatedAt.UnixNano()); err != nil {
+			return fmt.Errorf("writing outbox event: %w", err)
+		}
+	}
+	for i, change := range changes.transitions {
+		res, err := q.Exec(`INSERT INTO order_status_history (order_id, from_status, to_status, actor, reason, changed_at)
+			VALUES (?, ?, ?, ?, ?, ?)`,
+			change.OrderID, change.From, change.To, change.Actor, change.Reason, change.At.UnixNano())
+		if err != nil {
+			return fmt.Errorf("writing status history: %w", err)
+		}
+		// The row ID numbers the change on the event streams
+		if changes.transitions[i].ID, err = res.LastInsertId(); err != nil {
+			return fmt.Errorf("writing status history: %w", err)
+		}
+	}
+	return nil
+}
+
+func getGroupTx(q sqlQueryer, code string) (GroupSession, error) {
+	var data string
+	err := q.QueryRow(`SELECT data FROM group_sessions WHERE code = ?`, code).Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return GroupSession{}, ErrGroupNotFound
+	}
+	if err != nil {
+		return GroupSession{}, err
+	}
+
+	var group GroupSession
+	if err := json.Unmarshal([]byte(data), &group); err != nil {
+		return GroupSession{}, fmt.Errorf("decoding stored group order %s: %w", code, err)
+	}
+	return group, nil
+}
+
+// saveGroupTx updates a stored session. With expectedUpdatedAt set, the
+// update only happens if the stored session is still at that version.
+func saveGroupTx(q sqlQueryer, group GroupSession, expectedUpdatedAt *time.Time) error {
+	data, err := json.Marshal(group)
+	if err != nil {
+		return err
+	}
+	query := `UPDATE group_sessions SET updated_at = ?, data = ? WHERE code = ?`
+	args := []interface{}{group.UpdatedAt.UnixNano(), string(data), group.Code}
+	if expectedUpdatedAt != nil {
+		query += ` AND updated_at = ?`
+		args = append(args, expectedUpdatedAt.UnixNano())
+	}
+	res, err := q.Exec(query, args...)
+	if err != nil {
+		return fmt.Errorf("writing group order: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		if expectedUpdatedAt != nil {
+			return ErrGroupChanged
+		}
+		return ErrGroupNotFound
+	}
+	return nil
+}
+
+func (s *sqliteOrderStore) CreateGroup(group GroupSession) error {
+	data, err := json.Marshal(group)
+	if err != nil {
+		return err
+	}
+	res, err := s.db.Exec(`INSERT INTO group_sessions (code, updated_at, data) VALUES (?, ?, ?)
+		ON CONFLICT(code) DO NOTHING`, group.Code, group.UpdatedAt.UnixNano(), string(data))
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrGroupCodeTaken
+	}
+	return nil
+}
+
+func (s *sqliteOrderStore) GetGroup(code string) (GroupSession, error) {
+	return getGroupTx(s.db, code)
+}
+
+func (s *sqliteOrderStore) UpdateGroup(code string, fn func(group *GroupSession) error) (GroupSession, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return GroupSession{}, err
+	}
+	defer tx.Rollback()
+
+	group, err := getGroupTx(tx, code)
+	if err != nil {
+		return GroupSession{}, err
+	}
+	if err := fn(&group); err != nil {
+		return GroupSession{}, err
+	}
+	group.Code = code
+	if err := saveGroupTx(tx, group, nil); err != nil {
+		return GroupSession{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return GroupSession{}, err
+	}
+	return group, nil
+}
+
+func getCartTx(q sqlQueryer, userID int) (Cart, error) {
+	var data string
+	err := q.QueryRow(`SELECT data FROM carts WHERE user_id = ?`, userID).Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Cart{}, ErrCartNotFound
+	}
+	if err != nil {
+		return Cart{}, err
+	}
+
+	var cart Cart
+	if err := json.Unmarshal([]byte(data), &cart); err != nil {
+		return Cart{}, fmt.Errorf("decoding stored cart of user %d: %w", userID, err)
+	}
+	return cart, nil
+}
+
+func (s *sqliteOrderStore) GetCart(userID int) (Cart, error) {
+	return getCartTx(s.db, userID)
+}
+
+func (s *sqliteOrderStore) UpdateCart(userID int, fn func(cart *Cart) error) (Cart, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return Cart{}, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	cart, err := getCartTx(tx, userID)
+	if errors.Is(err, ErrCartNotFound) || err == nil && cart.expired(now) {
+		cart, err = newCart(userID, now), nil
+	}
+	if err != nil {
+		return Cart{}, err
+	}
+	if err := fn(&cart); err != nil {
+		return Cart{}, err
+	}
+	cart.UserID = userID
+
+	data, err := json.Marshal(cart)
+	if err != nil {
+		return Cart{}, err
+	}
+	if _, err := tx.Exec(`INSERT INTO carts (user_id, updated_at, expires_at, data) VALUES (?, ?, ?, ?)
+		ON CONFLICT(user_id) DO UPDATE SET updated_at = excluded.updated_at, expires_at = excluded.expires_at, data = excluded.data`,
+		userID, cart.UpdatedAt.UnixNano(), cart.ExpiresAt.UnixNano(), string(data)); err != nil {
+		return Cart{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return Cart{}, err
+	}
+	return cart, nil
+}
+
+func (s *sqliteOrderStore) DeleteCart(userID int) error {
+	_, err := s.db.Exec(`DELETE FROM carts WHERE user_id = ?`, userID)
+	return err
+}
+
+func (s *sqliteOrderStore) PurgeExpiredCarts(now time.Time) (int, error) {
+	res, err := s.db.Exec(`DELETE FROM carts WHERE expires_at <= ?`, now.UnixNano())
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+// The id and is_default columns win over the copies in data, which go stale
+// when another address becomes the default
+func scanSavedAddress(row sqlScanner) (SavedAddress, error) {
+	var address SavedAddress
+	var id int
+	var isDefault bool
+	var data string
+	if err := row.Scan(&id, &isDefault, &data); err != nil {
+		return SavedAddress{}, err
+	}
+	if err := json.Unmarshal([]byte(data), &address); err != nil {
+		return SavedAddress{}, fmt.Errorf("decoding saved address %d: %w", id, err)
+	}
+	address.ID = id
+	address.IsDefault = isDefault
+	return address, nil
+}
+
+func (s *sqliteOrderStore) ListAddresses(userID int) ([]SavedAddress, error) {
+	rows, err := s.db.Query(`SELECT id, is_default, data FROM saved_addresses WHERE user_id = ? ORDER BY id`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var addresses []SavedAddress
+	for rows.Next() {
+		address, err := scanSavedAddress(rows)
+		if err != nil {
+			return nil, err
+		}
+		addresses = append(addresses, address)
+	}
+	return addresses, rows.Err()
+}
+
+func (s *sqliteOrderStore) GetAddress(userID, id int) (SavedAddress, error) {
+	address, err := scanSavedAddress(s.db.QueryRow(`SELECT id, is_default, data FROM saved_addresses WHERE id = ? AND user_id = ?`, id, userID))
+	if errors.Is(err, sql.ErrNoRows) {
+		return SavedAddress{}, ErrAddressNotFound
+	}
+	return address, err
+}
+
+func (s *sqliteOrderStore) SaveAddress(address *SavedAddress) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	data, err := json.Marshal(address)
+	if err != nil {
+		return err
+	}
+	if address.IsDefault {
+		if _, err := tx.Exec(`UPDATE saved_addresses SET is_default = 0 WHERE user_id = ?`, address.UserID); err != nil {
+			return err
+		}
+	}
+	if address.ID == 0 {
+		res, err := tx.Exec(`INSERT INTO saved_addresses (user_id, is_default, data) VALUES (?, ?, ?)`,
+			address.UserID, address.IsDefault, string(data))
+		if err != nil {
+			return err
+		}
+		id, err := res.LastInsertId()
+		if err != nil {
+			return err
+		}
+		address.ID = int(id)
+	} else {
+		res, err := tx.Exec(`UPDATE saved_addresses SET is_default = ?, data = ? WHERE id = ? AND user_id = ?`,
+			address.IsDefault, string(data), address.ID, address.UserID)
+		if err != nil {
+			return err
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			return ErrAddressNotFound
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *sqliteOrderStore) DeleteAddress(userID, id int) error {
+	res, err := s.db.Exec(`DELETE FROM saved_addresses WHERE id = ? AND user_id = ?`, id, userID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrAddressNotFound
+	}
+	return nil
+}
+
+func (s *sqliteOrderStore) DueSagas(now time.Time, limit int) ([]Order, error) {
+	return s.query(`SELECT data FROM orders WHERE saga_next_attempt_at <= ? ORDER BY saga_next_attempt_at LIMIT ?`,
+		now.UnixNano(), limit)
+}
+
+func (s *sqliteOrderStore) ListSagas(state string) ([]Order, error) {
+	if state == "" {
+		return s.query(`SELECT data FROM orders WHERE saga_state != '' ORDER BY id`)
+	}
+	return s.query(`SELECT data FROM orders WHERE saga_state = ? ORDER BY id`, state)
+}
+
+func (s *sqliteOrderStore) History(orderID int) ([]StatusChange, error) {
+	rows, err := s.db.Query(`SELECT id, order_id, from_status, to_status, actor, reason, changed_at
+		FROM order_status_history WHERE order_id = ? ORDER BY id`, orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var history []StatusChange
+	for rows.Next() {
+		var change StatusChange
+		var changedAt int64
+		if err := rows.Scan(&change.ID, &change.OrderID, &change.From, &change.To, &change.Actor, &change.Reason, &changedAt); err != nil {
+			return nil, err
+		}
+		change.At = time.Unix(0, changedAt)
+		history = append(history, change)
+	}
+	return history, rows.Err()
+}
+
+func (s *sqliteOrderStore) ListPromoCodes() ([]PromoCode, error) {
+	rows, err := s.db.Query(`SELECT data FROM promo_codes ORDER BY code`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var promos []PromoCode
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		var promo PromoCode
+		if err := json.Unmarshal([]byte(data), &promo); err != nil {
+			return nil, fmt.Errorf("decoding stored promo code: %w", err)
+		}
+		promos = append(promos, promo)
+	}
+	return promos, rows.Err()
+}
+
+func (s *sqliteOrderStore) GetPromoCode(code string) (PromoCode, error) {
+	var data string
+	err := s.db.QueryRow(`SELECT data FROM promo_codes WHERE code = ?`, code).Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return PromoCode{}, ErrPromoNotFound
+	}
+	if err != nil {
+		return PromoCode{}, err
+	}
+
+	var promo PromoCode
+	if err := json.Unmarshal([]byte(data), &promo); err != nil {
+		return PromoCode{}, fmt.Errorf("decoding stored promo code %s: %w", code, err)
+	}
+	return promo, nil
+}
+
+func (s *sqliteOrderStore) SavePromoCode(promo PromoCode) error {
+	data, err := json.Marshal(promo)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(`INSERT INTO promo_codes (code, data) VALUES (?, ?)
+		ON CONFLICT(code) DO UPDATE SET data = excluded.data`, promo.Code, string(data))
+	return err
+}
+
+func (s *sqliteOrderStore) DeletePromoCode(code string) error {
+	res, err := s.db.Exec(`DELETE FROM promo_codes WHERE code = ?`, code)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrPromoNotFound
+	}
+	return nil
+}
+
+const outboxColumns = `id, order_id, destination, method, path, payload, idempotency_key, status, attempts, last_error, next_attempt_at, created_at, delivered_at`
+
+func (s *sqliteOrderStore) DueEvents(now time.Time, limit int) ([]OutboxEvent, error) {
+	return s.queryEvents(`SELECT `+outboxColumns+` FROM outbox_events
+		WHERE status = ? AND next_attempt_at <= ? ORDER BY id LIMIT ?`, outboxPending, now.UnixNano(), limit)
+}
+
+func (s *sqliteOrderStore) ListEvents(status string) ([]OutboxEvent, error) {
+	if status == "" {
+		return s.queryEvents(`SELECT ` + outboxColumns + ` FROM outbox_events ORDER BY id`)
+	}
+	return s.queryEvents(`SELECT `+outboxColumns+` FROM outbox_events WHERE status = ? ORDER BY id`, status)
+}
+
+func (s *sqliteOrderStore) queryEvents(query string, args ...interface{}) ([]OutboxEvent, error) {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []OutboxEvent
+	for rows.Next() {
+		event, err := scanOutboxEvent(rows)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+	return events, rows.Err()
+}
+
+// sqlScanner is implemented by *sql.Row and *sql.Rows
+type sqlScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanOutboxEvent(row sqlScanner) (OutboxEvent, error) {
+	var event OutboxEvent
+	var payload []byte
+	var nextAttemptAt, createdAt int64
+	var deliveredAt sql.NullInt64
+	err := row.Scan(&event.ID, &event.OrderID, &event.Destination, &event.Method, &event.Path, &payload,
+		&event.IdempotencyKey, &event.Status, &event.Attempts, &event.LastError, &nextAttemptAt, &createdAt, &deliveredAt)
+	if err != nil {
+		return OutboxEvent{}, err
+	}
+	event.Payload = payload
+	event.NextAttemptAt = time.Unix(0, nextAttemptAt)
+	event.CreatedAt = time.Unix(0, createdAt)
+	if deliveredAt.Valid {
+		t := time.Unix(0, deliveredAt.Int64)
+		event.DeliveredAt = &t
+	}
+	return event, nil
+}
+
+func (s *sqliteOrderStore) SaveEventAttempt(event OutboxEvent) error {
+	var deliveredAt sql.NullInt64
+	if event.DeliveredAt != nil {
+		deliveredAt = sql.NullInt64{Int64: event.DeliveredAt.UnixNano(), Valid: true}
+	}
+	res, err := s.db.Exec(`UPDATE outbox_events
+		SET status = ?, attempts = ?, last_error = ?, next_attempt_at = ?, delivered_at = ?
+		WHERE id = ?`,
+		event.Status, event.Attempts, event.LastError, event.NextAttemptAt.UnixNano(), deliveredAt, event.ID)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrEventNotFound
+	}
+	return nil
+}
+
+func (s *sqliteOrderStore) ReplayEvent(id int) (OutboxEvent, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return OutboxEvent{}, err
+	}
+	defer tx.Rollback()
+
+	event, err := scanOutboxEvent(tx.QueryRow(`SELECT `+outboxColumns+` FROM outbox_events WHERE id = ?`, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return OutboxEvent{}, ErrEventNotFound
+	}
+	if err != nil {
+		return OutboxEvent{}, err
+	}
+	if event.Status != outboxDead {
+		return OutboxEvent{}, ErrEventNotDead
+	}
+
+	event.Status = outboxPending
+	event.Attempts = 0
+	event.NextAttemptAt = time.Now()
+	if _, err := tx.Exec(`UPDATE outbox_events SET status = ?, attempts = 0, next_attempt_at = ? WHERE id = ?`,
+		event.Status, event.NextAttemptAt.UnixNano(), id); err != nil {
+		return OutboxEvent{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return OutboxEvent{}, err
+	}
+	return event, nil
+}
+
+func (s *sqliteOrderStore) PurgeDelivered(before time.Time) error {
+	_, err := s.db.Exec(`DELETE FROM outbox_events WHERE status = ? AND delivered_at < ?`, outboxDelivered, before.UnixNano())
+	return err
+}
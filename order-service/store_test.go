@@ -0,0 +1,178 @@
+package main
+
+import (
+	"database/sql"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"quickbite/shared/money"
+)
+
+// openTestSQLite opens a store in a fresh database file, skipping the test
+// when the SQLite driver isn't linked in
+func openTestSQLite(t *testing.T, path string) *sqliteOrderStore {
+	t.Helper()
+	s, err := newSQLiteOrderStore(path)
+	if err != nil && strings.Contains(err.Error(), "unknown driver") {
+		t.Skipf("SQLite is not available: %v", err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.db.Close() })
+	return s
+}
+
+// testStores returns an empty store of every kind
+func testStores() map[string]func(t *testing.T) OrderStore {
+	return map[string]func(t *testing.T) OrderStore{
+		"memory": func(t *testing.T) OrderStore { return newMemoryOrderStore() },
+		"sqlite": func(t *testing.T) OrderStore {
+			return openTestSQLite(t, filepath.Join(t.TempDir(), "orders.db"))
+		},
+	}
+}
+
+func schemaVersion(t *testing.T, db *sql.DB) int {
+	t.Helper()
+	var version int
+	if err := db.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&version); err != nil {
+		t.Fatal(err)
+	}
+	return version
+}
+
+func TestSQLiteMigrations(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "orders.db")
+	s := openTestSQLite(t, path)
+	if got := schemaVersion(t, s.db); got != len(sqliteMigrations) {
+		t.Fatalf("new database at version %d, want %d", got, len(sqliteMigrations))
+	}
+
+	// Opening it again applies nothing
+	if err := migrateSQLite(s.db); err != nil {
+		t.Fatal(err)
+	}
+	var applied int
+	if err := s.db.QueryRow(`SELECT COUNT(*) FROM schema_migrations`).Scan(&applied); err != nil {
+		t.Fatal(err)
+	}
+	if applied != len(sqliteMigrations) {
+		t.Errorf("%d migrations recorded, want %d", applied, len(sqliteMigrations))
+	}
+}
+
+// A database from before the idempotency lease gets reservation times for
+// the keys it already has
+func TestSQLiteMigrationUpgrade(t *testing.T) {
+	all := sqliteMigrations
+	t.Cleanup(func() { sqliteMigrations = all })
+
+	path := filepath.Join(t.TempDir(), "orders.db")
+	sqliteMigrations = all[:len(all)-1]
+	old := openTestSQLite(t, path)
+	if _, err := old.db.Exec(`INSERT INTO idempotency_keys (key, fingerprint, status_code, body, created_at) VALUES ('k', 'f', 0, NULL, 42)`); err != nil {
+		t.Fatal(err)
+	}
+	old.db.Close()
+
+	sqliteMigrations = all
+	s := openTestSQLite(t, path)
+	if got := schemaVersion(t, s.db); got != len(all) {
+		t.Fatalf("upgraded database at version %d, want %d", got, len(all))
+	}
+	var reservedAt int64
+	if err := s.db.QueryRow(`SELECT reserved_at FROM idempotency_keys WHERE key = 'k'`).Scan(&reservedAt); err != nil {
+		t.Fatal(err)
+	}
+	if reservedAt != 42 {
+		t.Errorf("reserved_at %d, want the creation time 42", reservedAt)
+	}
+}
+
+func ptrMoney(m money.Money) *money.Money {
+	return &m
+}
+
+func TestOrderQueryPaging(t *testing.T) {
+	start := time.Date(2026, 1, 2, 12, 0, 0, 0, time.UTC)
+	seed := []struct {
+		created time.Duration
+		total   int64
+		status  string
+	}{
+		{0, 1000, "delivered"},             // 1
+		{time.Second, 500, "created"},      // 2
+		{time.Second, 1500, "delivered"},   // 3, created with 2
+		{2 * time.Second, 1000, "created"}, // 4, same total as 1
+		{3 * time.Second, 500, "cancelled"},
+	}
+
+	tests := []struct {
+		name    string
+		query   OrderQuery
+		wantIDs []int
+	}{
+		{"oldest first", OrderQuery{SortBy: sortByCreatedAt}, []int{1, 2, 3, 4, 5}},
+		{"newest first", OrderQuery{SortBy: sortByCreatedAt, Descending: true}, []int{5, 4, 3, 2, 1}},
+		{"cheapest first", OrderQuery{SortBy: sortByTotalAmount}, []int{2, 5, 1, 4, 3}},
+		{"dearest first", OrderQuery{SortBy: sortByTotalAmount, Descending: true}, []int{3, 4, 1, 5, 2}},
+		{"filtered", OrderQuery{SortBy: sortByCreatedAt, Statuses: []string{"created", "delivered"}}, []int{1, 2, 3, 4}},
+		{"total range", OrderQuery{SortBy: sortByTotalAmount, MinTotal: ptrMoney(usd(600)), MaxTotal: ptrMoney(usd(1000))}, []int{1, 4}},
+		{"created range", OrderQuery{SortBy: sortByCreatedAt, CreatedFrom: start.Add(time.Second), CreatedTo: start.Add(3 * time.Second)}, []int{2, 3, 4}},
+	}
+
+	for name, open := range testStores() {
+		t.Run(name, func(t *testing.T) {
+			s := open(t)
+			for _, o := range seed {
+				created := start.Add(o.created)
+				order := Order{UserID: 1, RestaurantID: 1, Status: o.status, Currency: "USD", TotalAmount: usd(o.total), CreatedAt: created, UpdatedAt: created}
+				if err := s.Create(&order, nil); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			for _, tt := range tests {
+				for _, pageSize := range []int{1, 2, 3, 10} {
+					q := tt.query
+					q.Limit = pageSize
+					var ids []int
+					for pages := 0; pages < 10; pages++ {
+						orders, err := s.Query(q)
+						if err != nil {
+							t.Fatal(err)
+						}
+						for _, order := range orders {
+							ids = append(ids, order.ID)
+						}
+						if len(orders) < pageSize {
+							break
+						}
+						q.After = cursorFor(q, orders[len(orders)-1])
+					}
+					if !reflect.DeepEqual(ids, tt.wantIDs) {
+						t.Errorf("%s, pages of %d: %v, want %v", tt.name, pageSize, ids, tt.wantIDs)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestOrderCursorRoundTrip(t *testing.T) {
+	cursor := &orderCursor{SortBy: sortByTotalAmount, Descending: true, TotalAmount: 1299, ID: 7}
+	decoded, err := decodeCursor(cursor.encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *decoded != *cursor {
+		t.Errorf("decoded %+v, want %+v", decoded, cursor)
+	}
+	if _, err := decodeCursor("not a cursor!"); err == nil {
+		t.Error("decoded an invalid cursor")
+	}
+}
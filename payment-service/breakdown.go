@@ -0,0 +1,55 @@
+// payment-service/breakdown.go
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"quickbite/shared/money"
+)
+
+// PriceLine is one line of what a payment is for, as priced by order-service.
+// Discounts are negative; amounts include VAT at VATRate percent.
+type PriceLine struct {
+	Type        string      `json:"type"` // "items", "discount", "delivery_fee", "small_basket_fee", "service_fee", "tip"
+	Description string      `json:"description"`
+	Amount      money.Money `json:"amount"`
+	VATRate     float64     `json:"vatRate"`
+}
+
+// TaxLine is the VAT included in the lines that share a rate
+type TaxLine struct {
+	Rate  float64     `json:"rate"`
+	Net   money.Money `json:"net"`
+	VAT   money.Money `json:"vat"`
+	Gross money.Money `json:"gross"`
+}
+
+// PriceBreakdown itemises a payment's Amount
+type PriceBreakdown struct {
+	Lines []PriceLine `json:"lines"`
+	Taxes []TaxLine   `json:"taxes"`
+	Total money.Money `json:"total"`
+}
+
+// validateBreakdown checks that the lines of a breakdown add up exactly to
+// the amount charged, so payments reconcile with their orders
+func validateBreakdown(breakdown *PriceBreakdown, amount money.Money) error {
+	total := money.New(0, amount.Currency)
+	for _, line := range breakdown.Lines {
+		total = total.Add(line.Amount)
+	}
+	if total.Cmp(amount) != 0 {
+		return fmt.Errorf("breakdown lines add up to %s but the payment amount is %s", total, amount)
+	}
+	return nil
+}
+
+// Refund is money given back on a payment, itemised like the payment itself
+type Refund struct {
+	Amount    money.Money `json:"amount"`
+	Lines     []PriceLine `json:"lines,omitempty"`
+	Reason    string      `json:"reason,omitempty"`
+	Reference string      `json:"reference,omitempty"` // set by the caller so a refund is recorded once
+	CreatedAt time.Time   `json:"createdAt"`
+}
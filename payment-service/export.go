@@ -0,0 +1,260 @@
+// payment-service/export.go
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+	_ "time/tzdata" // Time zones for the date range, the alpine image has no zoneinfo
+
+	"quickbite/shared/money"
+)
+
+// Export limits
+const (
+	exportDefaultDays = 30
+	exportMaxDays     = 366
+	exportChunkSize   = 200 // payments scanned per hold of the mutex
+)
+
+// Entry types of the payment export
+const (
+	entryPayment = "payment"
+	entryRefund  = "refund"
+)
+
+// paymentExportColumns is the CSV header of the payment export. Columns are
+// only ever added at the end so finance's imports keep working.
+var paymentExportColumns = []string{
+	"entry_type", "entry_no", "payment_id", "order_id", "restaurant_id", "user_id",
+	"date", "status", "method", "currency", "amount", "description", "reference",
+}
+
+// PaymentExportEntry is one line of the payment export: a payment, or one of
+// its refunds with a negative amount. Each line is dated when it happened, so
+// a refund lands in the month it was made rather than the month of the payment.
+type PaymentExportEntry struct {
+	EntryType    string      `json:"entry_type"` // "payment" or "refund"
+	EntryNo      int         `json:"entry_no"`   // 0 for the payment, then 1, 2, ... for its refunds
+	PaymentID    int         `json:"payment_id"`
+	OrderID      int         `json:"order_id"`
+	RestaurantID int         `json:"restaurant_id"`
+	UserID       int         `json:"user_id"`
+	Date         time.Time   `json:"date"`
+	Status       string      `json:"status"` // of the payment
+	Method       string      `json:"method"`
+	Currency     string      `json:"currency"`
+	Amount       money.Money `json:"amount"`
+	Description  string      `json:"description"` // the refund reason on refund lines
+	Reference    string      `json:"reference"`   // refunds only
+}
+
+// exportRange is the filter of an export request. From and To are midnights
+// in Location; To is exclusive.
+type exportRange struct {
+	From         time.Time
+	To           time.Time
+	Location     *time.Location
+	RestaurantID int // 0 for all restaurants
+	Format       string
+}
+
+func (q exportRange) contains(t time.Time) bool {
+	return !t.Before(q.From) && t.Before(q.To)
+}
+
+// parseExportRange reads ?from=&to= (dates, to inclusive, default the last
+// 30 days), ?tz=, ?restaurantId= and ?format=csv|ndjson
+func parseExportRange(r *http.Request) (exportRange, error) {
+	values := r.URL.Query()
+	q := exportRange{Format: "csv"}
+
+	zone := values.Get("tz")
+	if zone == "" {
+		zone = "UTC"
+	}
+	location, err := time.LoadLocation(zone)
+	if err != nil {
+		return q, fmt.Errorf("Unknown time zone %q", zone)
+	}
+	q.Location = location
+
+	now := time.Now().In(location)
+	q.To = time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, location).AddDate(0, 0, 1)
+	if v := values.Get("to"); v != "" {
+		to, err := time.ParseInLocation("2006-01-02", v, location)
+		if err != nil {
+			return q, fmt.Errorf("Invalid to, expected a date like 2006-01-02")
+		}
+		q.To = to.AddDate(0, 0, 1)
+	}
+	q.From = q.To.AddDate(0, 0, -exportDefaultDays)
+	if v := values.Get("from"); v != "" {
+		from, err := time.ParseInLocation("2006-01-02", v, location)
+		if err != nil {
+			return q, fmt.Errorf("Invalid from, expected a date like 2006-01-02")
+		}
+		q.From = from
+	}
+	if !q.From.Before(q.To) {
+		return q, fmt.Errorf("from must not be after to")
+	}
+	if q.From.AddDate(0, 0, exportMaxDays).Before(q.To) {
+		return q, fmt.Errorf("Exports cover at most %d days", exportMaxDays)
+	}
+
+	if v := values.Get("restaurantId"); v != "" {
+		q.RestaurantID, err = strconv.Atoi(v)
+		if err != nil || q.RestaurantID <= 0 {
+			return q, fmt.Errorf("Invalid restaurantId")
+		}
+	}
+	if v := values.Get("format"); v != "" {
+		if v != "csv" && v != "ndjson" {
+			return q, fmt.Errorf("format must be \"csv\" or \"ndjson\"")
+		}
+		q.Format = v
+	}
+	return q, nil
+}
+
+// exportEntries lists the lines of a payment that fall in the range
+func exportEntries(payment Payment, q exportRange) []PaymentExportEntry {
+	entries := []PaymentExportEntry{}
+	base := PaymentExportEntry{
+		PaymentID:    payment.ID,
+		OrderID:      payment.OrderID,
+		RestaurantID: payment.RestaurantID,
+		UserID:       payment.UserID,
+		Status:       payment.Status,
+		Method:       payment.Method,
+		Currency:     payment.Currency,
+	}
+	if q.contains(payment.CreatedAt) {
+		entry := base
+		entry.EntryType = entryPayment
+		entry.Date = payment.CreatedAt.In(q.Location)
+		entry.Amount = payment.Amount
+		entry.Description = payment.Description
+		entries = append(entries, entry)
+	}
+	for i, refund := range payment.Refunds {
+		if !q.contains(refund.CreatedAt) {
+			continue
+		}
+		entry := base
+		entry.EntryType = entryRefund
+		entry.EntryNo = i + 1
+		entry.Date = refund.CreatedAt.In(q.Location)
+		entry.Amount = refund.Amount.Neg()
+		entry.Description = refund.Reason
+		entry.Reference = refund.Reference
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// record is the entry as CSV fields, in paymentExportColumns order
+func (e PaymentExportEntry) record() []string {
+	return []string{
+		e.EntryType,
+		strconv.Itoa(e.EntryNo),
+		strconv.Itoa(e.PaymentID),
+		strconv.Itoa(e.OrderID),
+		strconv.Itoa(e.RestaurantID),
+		strconv.Itoa(e.UserID),
+		e.Date.Format(time.RFC3339),
+		e.Status,
+		e.Method,
+		e.Currency,
+		e.Amount.Decimal(),
+		e.Description,
+		e.Reference,
+	}
+}
+
+// nextExportChunk copies the entries of up to exportChunkSize payments
+// starting at index start and before total, and returns the index to
+// continue from. Only this copy holds the mutex; writing to the client doesn't.
+func nextExportChunk(start, total int, q exportRange) ([]PaymentExportEntry, int) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	end := start + exportChunkSize
+	if end > total {
+		end = total
+	}
+	entries := []PaymentExportEntry{}
+	for _, payment := range payments[start:end] {
+		if q.RestaurantID != 0 && payment.RestaurantID != q.RestaurantID {
+			continue
+		}
+		entries = append(entries, exportEntries(payment, q)...)
+	}
+	return entries, end
+}
+
+// Export payments and refunds for accounting, as CSV or JSON Lines. Lines
+// are streamed a chunk of payments at a time, ordered by payment.
+func exportPayments(w http.ResponseWriter, r *http.Request) {
+	q, err := parseExportRange(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	contentType := "text/csv; charset=utf-8"
+	if q.Format == "ndjson" {
+		contentType = "application/x-ndjson"
+	}
+	w.Header().Set("Content-Type", contentType)
+	filename := fmt.Sprintf("payments-%s-%s.%s", q.From.Format("2006-01-02"), q.To.AddDate(0, 0, -1).Format("2006-01-02"), q.Format)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+
+	flusher, _ := w.(http.Flusher)
+	csvWriter := csv.NewWriter(w)
+	encoder := json.NewEncoder(w)
+	if q.Format == "csv" {
+		err = csvWriter.Write(paymentExportColumns)
+	}
+
+	// Payments are only ever appended, so the ones that existed when the
+	// export started are the first total of the slice
+	mutex.Lock()
+	total := len(payments)
+	mutex.Unlock()
+
+	for next := 0; next < total && err == nil; {
+		var entries []PaymentExportEntry
+		entries, next = nextExportChunk(next, total, q)
+		for _, entry := range entries {
+			if q.Format == "csv" {
+				err = csvWriter.Write(entry.record())
+			} else {
+				err = encoder.Encode(entry)
+			}
+			if err != nil {
+				break
+			}
+		}
+		csvWriter.Flush()
+		if err == nil {
+			err = csvWriter.Error()
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+	if err == nil {
+		csvWriter.Flush()
+		err = csvWriter.Error()
+	}
+	if err != nil {
+		// Too late for an error status, the client sees a truncated file
+		log.Printf("Error exporting payments: %v", err)
+	}
+}
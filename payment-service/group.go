@@ -0,0 +1,128 @@
+// payment-service/group.go
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"quickbite/shared/money"
+)
+
+// Kinds of payment a group order is paid with
+const (
+	paymentShare = "share" // one participant's part, created by order-service
+	paymentCover = "cover" // the unpaid shares, paid by one user
+)
+
+// orderFullyPaid reports whether every live payment of an order is completed.
+// Group orders have one payment per participant, and the order only moves on
+// once all of them exist and are paid. Callers hold the mutex.
+func orderFullyPaid(orderID int) bool {
+	if !allSharesCreated(orderID) {
+		return false
+	}
+	found := false
+	for _, payment := range payments {
+		if payment.OrderID != orderID || payment.Status == "voided" {
+			continue
+		}
+		if payment.Status != "completed" {
+			return false
+		}
+		found = true
+	}
+	return found
+}
+
+// allSharesCreated reports whether order-service has created every share of
+// a group order; it creates them one at a time. Orders paid in one payment
+// have no shares. Callers hold the mutex.
+func allSharesCreated(orderID int) bool {
+	expected := 0
+	participants := map[int]bool{}
+	for _, payment := range payments {
+		if payment.OrderID == orderID && payment.Kind == paymentShare {
+			expected = payment.ShareCount
+			participants[payment.UserID] = true
+		}
+	}
+	return len(participants) >= expected
+}
+
+// Cover the unpaid shares of a group order: they are voided and one payment
+// for their total is created for the given user, normally the host
+func coverOrderPayments(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	params := mux.Vars(r)
+	orderID, err := strconv.Atoi(params["orderId"])
+	if err != nil {
+		http.Error(w, "Invalid order ID", http.StatusBadRequest)
+		return
+	}
+
+	var coverRequest struct {
+		UserID int `json:"userId"`
+	}
+	err = json.NewDecoder(r.Body).Decode(&coverRequest)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if coverRequest.UserID == 0 {
+		http.Error(w, "userId is required", http.StatusBadRequest)
+		return
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	// Covering only the shares created so far would leave the others to be paid
+	if !allSharesCreated(orderID) {
+		http.Error(w, "Not every share of the order has been created yet, please retry", http.StatusConflict)
+		return
+	}
+
+	now := time.Now()
+	outstanding := money.New(0, money.DefaultCurrency)
+	var unpaid []int
+	for i, payment := range payments {
+		if payment.OrderID == orderID && (payment.Status == "pending" || payment.Status == "failed") {
+			outstanding = outstanding.Add(payment.Amount)
+			unpaid = append(unpaid, i)
+		}
+	}
+	if len(unpaid) == 0 {
+		http.Error(w, "The order has no unpaid payments to cover", http.StatusConflict)
+		return
+	}
+
+	// Voiding a share here doesn't cancel the order, the cover payment replaces it
+	for _, i := range unpaid {
+		payments[i].Status = "voided"
+		payments[i].UpdatedAt = now
+	}
+	cover := Payment{
+		ID:             nextID,
+		OrderID:        orderID,
+		RestaurantID:   payments[unpaid[0]].RestaurantID,
+		UserID:         coverRequest.UserID,
+		Amount:         outstanding,
+		Currency:       outstanding.Currency,
+		Status:         "pending",
+		Method:         "card",
+		Description:    fmt.Sprintf("Unpaid shares of order #%d", orderID),
+		Kind:           paymentCover,
+		RefundedAmount: money.New(0, outstanding.Currency),
+		CreatedAt:      now,
+		UpdatedAt:      now,
+	}
+	nextID++
+	payments = append(payments, cover)
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(cover)
+}
@@ -14,25 +14,37 @@ import (
 
 	"github.com/gorilla/mux"
 	"github.com/joho/godotenv"
+	"quickbite/shared/idempotency"
+	"quickbite/shared/money"
 )
 
 // Payment represents a payment transaction
 type Payment struct {
-	ID          int       `json:"id"`
-	OrderID     int       `json:"orderId"`
-	UserID      int       `json:"userId"`
-	Amount      float64   `json:"amount"`
-	Status      string    `json:"status"` // "pending", "completed", "failed", "refunded"
-	Method      string    `json:"method"` // "card", "cash", etc.
-	Description string    `json:"description"`
-	CreatedAt   time.Time `json:"createdAt"`
-	UpdatedAt   time.Time `json:"updatedAt"`
+	ID             int             `json:"id"`
+	OrderID        int             `json:"orderId"`
+	RestaurantID   int             `json:"restaurantId,omitempty"` // for exports, sent by order-service
+	UserID         int             `json:"userId"`
+	Amount         money.Money     `json:"amount"`
+	Currency       string          `json:"currency"` // ISO 4217 code
+	Status         string          `json:"status"`   // "pending", "completed", "failed", "refunded", "voided"
+	Method         string          `json:"method"`   // "card", "cash", etc.
+	Description    string          `json:"description"`
+	Kind           string          `json:"kind,omitempty"`       // "share" of a group order, "cover" for unpaid shares, empty for a whole order
+	ShareCount     int             `json:"shareCount,omitempty"` // how many shares the order is split into, set on shares
+	Breakdown      *PriceBreakdown `json:"breakdown,omitempty"`  // what the amount is for, sent by order-service
+	Refunds        []Refund        `json:"refunds,omitempty"`    // partial and full refunds, oldest first
+	RefundedAmount money.Money     `json:"refundedAmount"`
+	OrderRevision  int64           `json:"orderRevision,omitempty"` // version of the order the amount was priced from
+	CreatedAt      time.Time       `json:"createdAt"`
+	UpdatedAt      time.Time       `json:"updatedAt"`
 }
 
 var (
 	payments []Payment
 	nextID   int = 1
 	mutex    sync.Mutex
+	// Like payments themselves, idempotency keys only live in memory
+	idempotencyKeys = idempotency.NewMemoryStore()
 )
 
 // Get all payments
@@ -69,6 +81,32 @@ func createPayment(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	if payment.Currency == "" {
+		payment.Currency = money.DefaultCurrency
+	}
+	if payment.Currency != money.DefaultCurrency {
+		http.Error(w, fmt.Sprintf("Payments are taken in %s", money.DefaultCurrency), http.StatusBadRequest)
+		return
+	}
+	if payment.Breakdown != nil {
+		if err := validateBreakdown(payment.Breakdown, payment.Amount); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	// Cover payments are only made by coverOrderPayments
+	switch {
+	case payment.Kind == paymentShare && payment.ShareCount < 1:
+		http.Error(w, "Shares need the shareCount of their order", http.StatusBadRequest)
+		return
+	case payment.Kind != paymentShare && payment.Kind != "":
+		http.Error(w, "kind must be \"share\" or empty", http.StatusBadRequest)
+		return
+	case payment.Kind == "":
+		payment.ShareCount = 0
+	}
+	payment.Refunds = nil
+	payment.RefundedAmount = money.New(0, payment.Currency)
 
 	now := time.Now()
 	mutex.Lock()
@@ -134,6 +172,12 @@ func processPayment(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Payment not found", http.StatusNotFound)
 		return
 	}
+	// A failed payment can be tried again; a voided one belongs to a cancelled order
+	if payment.Status != "pending" && payment.Status != "failed" {
+		mutex.Unlock()
+		http.Error(w, fmt.Sprintf("Payment is %s and can't be processed", payment.Status), http.StatusUnprocessableEntity)
+		return
+	}
 
 	// Process payment (in a real system, this would integrate with payment gateways)
 	// Here we're simulating payment processing - 90% success rate
@@ -145,10 +189,12 @@ func processPayment(w http.ResponseWriter, r *http.Request) {
 		payment.Status = "failed"
 	}
 	payment.UpdatedAt = time.Now()
+	// Group orders are paid once every share is
+	orderPaid := success && orderFullyPaid(payment.OrderID)
 	mutex.Unlock()
 
-	// If payment is successful, update order status
-	if success {
+	// If the order is paid in full, update order status
+	if orderPaid {
 		go updateOrderStatus(payment.OrderID, "paid")
 	}
 
@@ -176,6 +222,8 @@ func updateOrderStatus(orderID int, status string) {
 		return
 	}
 	req.Header.Set("Content-Type", "application/json")
+	// Lets order-service record who changed the status
+	req.Header.Set("X-Source-Service", "payment-service")
 	
 	client := &http.Client{}
 	resp, err := client.Do(req)
@@ -188,6 +236,178 @@ func updateOrderStatus(orderID int, status string) {
 	log.Printf("Order status update response: %d", resp.StatusCode)
 }
 
+// Update the amount of an order's pending payment after its items changed
+func updatePendingPayment(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	params := mux.Vars(r)
+	orderID, err := strconv.Atoi(params["orderId"])
+	if err != nil {
+		http.Error(w, "Invalid order ID", http.StatusBadRequest)
+		return
+	}
+
+	var amountUpdate struct {
+		Amount        money.Money     `json:"amount"`
+		Currency      string          `json:"currency"`
+		Breakdown     *PriceBreakdown `json:"breakdown"`
+		OrderRevision int64           `json:"orderRevision"`
+	}
+	err = json.NewDecoder(r.Body).Decode(&amountUpdate)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if amountUpdate.Currency != "" && amountUpdate.Currency != money.DefaultCurrency {
+		http.Error(w, fmt.Sprintf("Payments are taken in %s", money.DefaultCurrency), http.StatusBadRequest)
+		return
+	}
+	if amountUpdate.Breakdown != nil {
+		if err := validateBreakdown(amountUpdate.Breakdown, amountUpdate.Amount); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	// Only a payment of the whole order follows its total; shares and covers
+	// are fixed. A failed payment is still unpaid and can be processed again.
+	var payment *Payment
+	unpaid, processed := 0, ""
+	for i := range payments {
+		if payments[i].OrderID != orderID || payments[i].Kind != "" {
+			continue
+		}
+		switch payments[i].Status {
+		case "pending", "failed":
+			payment = &payments[i]
+			unpaid++
+		case "completed", "refunded":
+			processed = payments[i].Status
+		}
+	}
+	if unpaid == 0 && processed != "" {
+		http.Error(w, fmt.Sprintf("Payment for order %d is already %s", orderID, processed), http.StatusUnprocessableEntity)
+		return
+	}
+	if unpaid != 1 {
+		// The payment may not have been created yet; order-service retries on 409
+		http.Error(w, fmt.Sprintf("Order %d has %d unpaid payments, expected one", orderID, unpaid), http.StatusConflict)
+		return
+	}
+
+	// An update for an older version of the order arrived late; keep the newer amount
+	if amountUpdate.OrderRevision >= payment.OrderRevision {
+		payment.Amount = amountUpdate.Amount
+		payment.Breakdown = amountUpdate.Breakdown
+		payment.OrderRevision = amountUpdate.OrderRevision
+		payment.UpdatedAt = time.Now()
+	}
+	json.NewEncoder(w).Encode(payment)
+}
+
+// Refund part of an order's completed payment, e.g. for cancelled items
+func refundOrderPayment(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	params := mux.Vars(r)
+	orderID, err := strconv.Atoi(params["orderId"])
+	if err != nil {
+		http.Error(w, "Invalid order ID", http.StatusBadRequest)
+		return
+	}
+
+	var refundRequest struct {
+		Amount    money.Money `json:"amount"`
+		Currency  string      `json:"currency"`
+		Reason    string      `json:"reason"`
+		Lines     []PriceLine `json:"lines"`
+		Reference string      `json:"reference"`
+	}
+	err = json.NewDecoder(r.Body).Decode(&refundRequest)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if refundRequest.Currency != "" && refundRequest.Currency != money.DefaultCurrency {
+		http.Error(w, fmt.Sprintf("Payments are taken in %s", money.DefaultCurrency), http.StatusBadRequest)
+		return
+	}
+	if !refundRequest.Amount.IsPositive() {
+		http.Error(w, "Refund amount must be positive", http.StatusBadRequest)
+		return
+	}
+	if len(refundRequest.Lines) > 0 {
+		if err := validateBreakdown(&PriceBreakdown{Lines: refundRequest.Lines}, refundRequest.Amount); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	var completed []*Payment
+	unpaid, settled := false, ""
+	for i := range payments {
+		if payments[i].OrderID != orderID {
+			continue
+		}
+		if refundRequest.Reference != "" {
+			for _, refund := range payments[i].Refunds {
+				if refund.Reference == refundRequest.Reference {
+					// Already recorded
+					json.NewEncoder(w).Encode(payments[i])
+					return
+				}
+			}
+		}
+		switch payments[i].Status {
+		case "completed":
+			completed = append(completed, &payments[i])
+		case "pending", "failed":
+			unpaid = true
+		default:
+			// A refunded payment explains more than the voided ones it replaced
+			if settled != "refunded" {
+				settled = payments[i].Status
+			}
+		}
+	}
+	if len(completed) > 1 {
+		// Each share belongs to a different participant, so there is no one payment to take it from
+		http.Error(w, fmt.Sprintf("Order %d was paid with %d payments, refund them one by one with PUT /api/payments/{id}/refund", orderID, len(completed)), http.StatusUnprocessableEntity)
+		return
+	}
+	if len(completed) == 0 && (unpaid || settled == "") {
+		// The payment may still be on its way; order-service retries on 409
+		http.Error(w, "No completed payment for this order yet", http.StatusConflict)
+		return
+	}
+	if len(completed) == 0 {
+		http.Error(w, fmt.Sprintf("Payment for order %d is %s", orderID, settled), http.StatusUnprocessableEntity)
+		return
+	}
+	payment := completed[0]
+	remaining := payment.Amount.Sub(payment.RefundedAmount)
+	if refundRequest.Amount.Cmp(remaining) > 0 {
+		http.Error(w, fmt.Sprintf("Only %s of this payment is left to refund", remaining), http.StatusUnprocessableEntity)
+		return
+	}
+
+	now := time.Now()
+	payment.Refunds = append(payment.Refunds, Refund{
+		Amount:    refundRequest.Amount,
+		Lines:     refundRequest.Lines,
+		Reason:    refundRequest.Reason,
+		Reference: refundRequest.Reference,
+		CreatedAt: now,
+	})
+	payment.RefundedAmount = payment.RefundedAmount.Add(refundRequest.Amount)
+	payment.UpdatedAt = now
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(payment)
+}
+
 // Get payments by order ID
 func getPaymentsByOrder(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
@@ -220,14 +440,35 @@ func refundPayment(w http.ResponseWriter, r *http.Request) {
 	mutex.Lock()
 	for i, payment := range payments {
 		if payment.ID == id {
+			now := time.Now()
+			// Nothing was charged for a pending payment: void it so it can't be
+			// processed for an order that is being cancelled
+			if payment.Status == "pending" {
+				payments[i].Status = "voided"
+				payments[i].UpdatedAt = now
+				go updateOrderStatus(payment.OrderID, "cancelled")
+
+				mutex.Unlock()
+				json.NewEncoder(w).Encode(payments[i])
+				return
+			}
 			// Only allow refunds for completed payments
 			if payment.Status != "completed" {
 				mutex.Unlock()
 				http.Error(w, "Only completed payments can be refunded", http.StatusBadRequest)
 				return
 			}
+			// A full refund gives back whatever partial refunds haven't
+			refund := Refund{Amount: payment.Amount.Sub(payment.RefundedAmount), Reason: "Full refund", CreatedAt: now}
+			if payment.Breakdown != nil && len(payment.Refunds) == 0 {
+				refund.Lines = append([]PriceLine(nil), payment.Breakdown.Lines...)
+			} else if len(payment.Refunds) > 0 {
+				refund.Lines = []PriceLine{{Type: "balance", Description: "Remaining balance", Amount: refund.Amount}}
+			}
+			payments[i].Refunds = append(payments[i].Refunds, refund)
+			payments[i].RefundedAmount = payment.Amount
 			payments[i].Status = "refunded"
-			payments[i].UpdatedAt = time.Now()
+			payments[i].UpdatedAt = now
 			
 			// Update order status to cancelled when payment is refunded
 			go updateOrderStatus(payment.OrderID, "cancelled")
@@ -253,11 +494,16 @@ func loadEnv() {
 	if err != nil {
 		log.Fatalf("Error loading .env file: %v", err)
 	}
+	// Amounts in JSON are in this currency
+	if currency := os.Getenv("CURRENCY"); currency != "" {
+		money.DefaultCurrency = currency
+	}
 	
 	// Log environment variables (for debugging)
 	log.Println("Environment loaded successfully")
 	log.Printf("Server running on %s:%s", os.Getenv("HOST"), os.Getenv("PORT"))
 	log.Printf("Order service URL: %s", os.Getenv("ORDER_SERVICE_URL"))
+	log.Printf("Currency: %s", money.DefaultCurrency)
 }
 
 func main() {
@@ -271,13 +517,18 @@ func main() {
 
 	// Payment routes
 	r.HandleFunc("/api/payments", getPayments).Methods("GET")
+	r.HandleFunc("/api/payments/export", exportPayments).Methods("GET")
 	r.HandleFunc("/api/payments/{id}", getPayment).Methods("GET")
-	r.HandleFunc("/api/payments", createPayment).Methods("POST")
+	r.HandleFunc("/api/payments", idempotency.Wrap(idempotencyKeys, createPayment)).Methods("POST")
 	r.HandleFunc("/api/payments/{id}/process", processPayment).Methods("PUT")
 	r.HandleFunc("/api/payments/{id}/refund", refundPayment).Methods("PUT")
+	r.HandleFunc("/api/payments/order/{orderId}/pending", updatePendingPayment).Methods("PUT")
+	r.HandleFunc("/api/payments/order/{orderId}/refunds", idempotency.Wrap(idempotencyKeys, refundOrderPayment)).Methods("POST")
+	r.HandleFunc("/api/payments/order/{orderId}/cover", idempotency.Wrap(idempotencyKeys, coverOrderPayments)).Methods("POST")
 	
 	// Filtered payments
 	r.HandleFunc("/api/orders/{orderId}/payments", getPaymentsByOrder).Methods("GET")
+	r.HandleFunc("/api/payments/order/{orderId}", getPaymentsByOrder).Methods("GET")
 
 	// Get server address from environment variables
 	host := os.Getenv("HOST")
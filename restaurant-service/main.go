@@ -9,28 +9,34 @@ import (
 	"os"
 	"strconv"
 	"sync"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/joho/godotenv"
+	"quickbite/shared/money"
 )
 
 // Restaurant represents a restaurant entity
 type Restaurant struct {
-	ID       int      `json:"id"`
-	Name     string   `json:"name"`
-	Address  string   `json:"address"`
-	Cuisine  string   `json:"cuisine"`
-	Rating   float64  `json:"rating"`
-	MenuItems []MenuItem `json:"menuItems"`
+	ID             int        `json:"id"`
+	Name           string     `json:"name"`
+	Address        string     `json:"address"`
+	Cuisine        string     `json:"cuisine"`
+	Rating         float64    `json:"rating"` // time-weighted average food score of the published reviews, 0 until the first
+	DeliveryRating float64    `json:"deliveryRating"`
+	ReviewCount    int        `json:"reviewCount"` // published reviews
+	MenuItems      []MenuItem `json:"menuItems"`
 }
 
 // MenuItem represents a menu item
 type MenuItem struct {
-	ID          int     `json:"id"`
-	Name        string  `json:"name"`
-	Description string  `json:"description"`
-	Price       float64 `json:"price"`
-	Category    string  `json:"category"`
+	ID           int           `json:"id"`
+	Name         string        `json:"name"`
+	Description  string        `json:"description"`
+	Price        money.Money   `json:"price"`
+	Currency     string        `json:"currency"` // ISO 4217 code of Price
+	Category     string        `json:"category"`
+	OptionGroups []OptionGroup `json:"optionGroups,omitempty"` // sizes, extras and removals the customer can choose
 }
 
 var (
@@ -48,14 +54,43 @@ func init() {
 		Name:    "Tasty Bites",
 		Address: "123 Main St",
 		Cuisine: "Italian",
-		Rating:  4.5,
 		MenuItems: []MenuItem{
 			{
 				ID:          nextItemID,
 				Name:        "Margherita Pizza",
 				Description: "Classic pizza with tomato sauce, mozzarella, and basil",
-				Price:       12.99,
+				Price:       money.New(1299, ""),
 				Category:    "Main",
+				OptionGroups: []OptionGroup{
+					{
+						ID:        1,
+						Name:      "Size",
+						MinSelect: 1,
+						MaxSelect: 1,
+						Options: []MenuOption{
+							{ID: 1, Name: "Regular", Default: true},
+							{ID: 2, Name: "Large", PriceDelta: money.New(300, "")},
+						},
+					},
+					{
+						ID:        2,
+						Name:      "Extras",
+						MaxSelect: 3,
+						Options: []MenuOption{
+							{ID: 1, Name: "Extra cheese", PriceDelta: money.New(150, "")},
+							{ID: 2, Name: "Olives", PriceDelta: money.New(100, "")},
+							{ID: 3, Name: "Mushrooms", PriceDelta: money.New(120, "")},
+						},
+					},
+					{
+						ID:   3,
+						Name: "Remove",
+						Options: []MenuOption{
+							{ID: 1, Name: "No basil"},
+							{ID: 2, Name: "No onions"},
+						},
+					},
+				},
 			},
 		},
 	})
@@ -63,6 +98,25 @@ func init() {
 	nextItemID++
 }
 
+// checkMenuItems fills in the service's currency on menu items that don't
+// name one, rejects items priced in another currency and checks their option
+// groups
+func checkMenuItems(items []MenuItem) error {
+	for i := range items {
+		if items[i].Currency == "" {
+			items[i].Currency = money.DefaultCurrency
+		}
+		if items[i].Currency != money.DefaultCurrency {
+			return fmt.Errorf("Menu items are priced in %s", money.DefaultCurrency)
+		}
+		items[i].Price.Currency = items[i].Currency
+		if err := checkOptionGroups(&items[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // Get all restaurants
 func getRestaurants(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
@@ -98,6 +152,15 @@ func createRestaurant(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	if err := checkMenuItems(restaurant.MenuItems); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Ratings only come from reviews
+	restaurant.Rating = 0
+	restaurant.DeliveryRating = 0
+	restaurant.ReviewCount = 0
 
 	mutex.Lock()
 	restaurant.ID = nextRestID
@@ -125,11 +188,18 @@ func updateRestaurant(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	if err := checkMenuItems(updatedRestaurant.MenuItems); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
 	mutex.Lock()
 	for i, restaurant := range restaurants {
 		if restaurant.ID == id {
 			updatedRestaurant.ID = id
+			updatedRestaurant.Rating = restaurant.Rating
+			updatedRestaurant.DeliveryRating = restaurant.DeliveryRating
+			updatedRestaurant.ReviewCount = restaurant.ReviewCount
 			restaurants[i] = updatedRestaurant
 			mutex.Unlock()
 			json.NewEncoder(w).Encode(updatedRestaurant)
@@ -198,6 +268,12 @@ func addMenuItem(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	items := []MenuItem{menuItem}
+	if err := checkMenuItems(items); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	menuItem = items[0]
 
 	mutex.Lock()
 	for i, restaurant := range restaurants {
@@ -255,10 +331,33 @@ func loadEnv() {
 	if os.Getenv("PORT") == "" {
 		os.Setenv("PORT", "8081")
 	}
+
+	// Amounts in JSON are in this currency; the sample menu is priced in it
+	if currency := os.Getenv("CURRENCY"); currency != "" {
+		money.DefaultCurrency = currency
+	}
+	for i := range restaurants {
+		checkMenuItems(restaurants[i].MenuItems)
+	}
+
+	// Reviews are checked against the order they rate
+	if os.Getenv("ORDER_SERVICE_URL") == "" {
+		os.Setenv("ORDER_SERVICE_URL", "http://localhost:8082")
+	}
+	if v := os.Getenv("REVIEW_HALF_LIFE"); v != "" {
+		halfLife, err := time.ParseDuration(v)
+		if err != nil || halfLife <= 0 {
+			log.Printf("Warning: invalid REVIEW_HALF_LIFE %q, using %s", v, defaultReviewHalfLife)
+		} else {
+			reviewHalfLife = halfLife
+		}
+	}
 	
 	// Log environment variables (for debugging)
 	log.Println("Environment configured successfully")
 	log.Printf("Server running on %s:%s", os.Getenv("HOST"), os.Getenv("PORT"))
+	log.Printf("Order service URL: %s", os.Getenv("ORDER_SERVICE_URL"))
+	log.Printf("Reviews count half as much after %s", reviewHalfLife)
 }
 func main() {
 	// Adaugă încărcarea variabilelor de mediu
@@ -282,6 +381,13 @@ func main() {
 	r.HandleFunc("/api/restaurants/{id}/menu", getMenuItems).Methods("GET")
 	r.HandleFunc("/api/restaurants/{id}/menu", addMenuItem).Methods("POST")
 
+	// Review routes
+	r.HandleFunc("/api/restaurants/{id}/reviews", getRestaurantReviews).Methods("GET")
+	r.HandleFunc("/api/restaurants/{id}/reviews", createReview).Methods("POST")
+	r.HandleFunc("/api/reviews", getReviews).Methods("GET")
+	r.HandleFunc("/api/reviews/{id}/moderation", moderateReview).Methods("PUT")
+	r.HandleFunc("/api/orders/{orderId}/review", getOrderReview).Methods("GET")
+
 	// Obține adresa serverului din variabilele de mediu
 	host := os.Getenv("HOST")
 	port := os.Getenv("PORT")
@@ -0,0 +1,94 @@
+// restaurant-service/options.go
+package main
+
+import (
+	"fmt"
+
+	"quickbite/shared/money"
+)
+
+// OptionGroup is a choice offered on a menu item, like its size, extras or
+// ingredients to leave out. Customers pick between MinSelect and MaxSelect
+// of its options.
+type OptionGroup struct {
+	ID        int          `json:"id"`
+	Name      string       `json:"name"`
+	MinSelect int          `json:"minSelect"`
+	MaxSelect int          `json:"maxSelect"` // 0 for no limit
+	Options   []MenuOption `json:"options"`
+}
+
+// MenuOption is one option of a group
+type MenuOption struct {
+	ID         int         `json:"id"`
+	Name       string      `json:"name"`
+	PriceDelta money.Money `json:"priceDelta"`        // added to the item's price, negative for cheaper variants
+	Default    bool        `json:"default,omitempty"` // chosen when nothing is picked from the group
+}
+
+// checkOptionGroups numbers the option groups and options that come without
+// an ID, prices their deltas in the item's currency and rejects groups whose
+// limits can't be met
+func checkOptionGroups(item *MenuItem) error {
+	groupIDs := map[int]bool{}
+	nextGroupID := 1
+	for _, group := range item.OptionGroups {
+		if group.ID >= nextGroupID {
+			nextGroupID = group.ID + 1
+		}
+	}
+
+	for i := range item.OptionGroups {
+		group := &item.OptionGroups[i]
+		if group.ID == 0 {
+			group.ID = nextGroupID
+			nextGroupID++
+		}
+		if groupIDs[group.ID] {
+			return fmt.Errorf("%s has two option groups with ID %d", item.Name, group.ID)
+		}
+		groupIDs[group.ID] = true
+		if group.Name == "" {
+			return fmt.Errorf("Option groups of %s need a name", item.Name)
+		}
+		if len(group.Options) == 0 {
+			return fmt.Errorf("%s of %s has no options", group.Name, item.Name)
+		}
+		if group.MinSelect < 0 || group.MaxSelect < 0 || group.MinSelect > len(group.Options) ||
+			group.MaxSelect > 0 && group.MinSelect > group.MaxSelect {
+			return fmt.Errorf("%s of %s can't have between %d and %d of its %d options chosen",
+				group.Name, item.Name, group.MinSelect, group.MaxSelect, len(group.Options))
+		}
+
+		optionIDs := map[int]bool{}
+		nextOptionID := 1
+		for _, option := range group.Options {
+			if option.ID >= nextOptionID {
+				nextOptionID = option.ID + 1
+			}
+		}
+		defaults := 0
+		for j := range group.Options {
+			option := &group.Options[j]
+			if option.ID == 0 {
+				option.ID = nextOptionID
+				nextOptionID++
+			}
+			if optionIDs[option.ID] {
+				return fmt.Errorf("%s of %s has two options with ID %d", group.Name, item.Name, option.ID)
+			}
+			optionIDs[option.ID] = true
+			if option.Name == "" {
+				return fmt.Errorf("Options of %s of %s need a name", group.Name, item.Name)
+			}
+			option.PriceDelta.Currency = item.Currency
+			if option.Default {
+				defaults++
+			}
+		}
+		if group.MaxSelect > 0 && defaults > group.MaxSelect {
+			return fmt.Errorf("%s of %s has more default options than can be chosen", group.Name, item.Name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,409 @@
+// restaurant-service/review.go
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+)
+
+// Moderation states of a review. Only published reviews count towards the
+// rating and are shown to customers.
+const (
+	reviewPending   = "pending"
+	reviewPublished = "published"
+	reviewRejected  = "rejected"
+)
+
+// Review limits
+const (
+	minScore              = 1
+	maxScore              = 5
+	maxReviewTextLength   = 2000 // characters
+	maxReviewPhotos       = 5
+	maxPhotoRefLength     = 500
+	defaultReviewsPage    = 20
+	maxReviewsPage        = 100
+	defaultReviewHalfLife = 90 * 24 * time.Hour
+)
+
+// Review is a customer's rating of a delivered order. There is at most one
+// per order.
+type Review struct {
+	ID             int       `json:"id"`
+	RestaurantID   int       `json:"restaurantId"`
+	OrderID        int       `json:"orderId"`
+	UserID         int       `json:"userId"`
+	FoodScore      int       `json:"foodScore"`     // 1 to 5, drives the restaurant's Rating
+	DeliveryScore  int       `json:"deliveryScore"` // 1 to 5, drives its DeliveryRating
+	Text           string    `json:"text,omitempty"`
+	Photos         []string  `json:"photos,omitempty"` // references to photos uploaded elsewhere, e.g. URLs
+	Status         string    `json:"status"`           // "pending", "published", "rejected"
+	ModerationNote string    `json:"moderationNote,omitempty"`
+	CreatedAt      time.Time `json:"createdAt"`
+	UpdatedAt      time.Time `json:"updatedAt"`
+}
+
+// ReviewPage is the response envelope of the review listings
+type ReviewPage struct {
+	Items      []Review `json:"items"`
+	NextCursor *string  `json:"nextCursor"`
+}
+
+var (
+	reviews      []Review
+	nextReviewID int = 1
+	// reviewHalfLife is how long it takes a review to count half as much as a new one
+	reviewHalfLife = defaultReviewHalfLife
+)
+
+var (
+	errOrderNotFound    = errors.New("order not found")
+	errOrderUnavailable = errors.New("order service unavailable")
+)
+
+// reviewedOrder is what a review needs to know about the order it rates
+type reviewedOrder struct {
+	ID           int    `json:"id"`
+	UserID       int    `json:"userId"`
+	RestaurantID int    `json:"restaurantId"`
+	Status       string `json:"status"`
+}
+
+var orderClient = &http.Client{Timeout: 5 * time.Second}
+
+// fetchOrder asks order-service for an order
+func fetchOrder(orderID int) (reviewedOrder, error) {
+	var order reviewedOrder
+	resp, err := orderClient.Get(fmt.Sprintf("%s/api/orders/%d", os.Getenv("ORDER_SERVICE_URL"), orderID))
+	if err != nil {
+		return order, fmt.Errorf("%w: %v", errOrderUnavailable, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return order, errOrderNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		return order, fmt.Errorf("%w: status %d", errOrderUnavailable, resp.StatusCode)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&order); err != nil {
+		return order, fmt.Errorf("%w: %v", errOrderUnavailable, err)
+	}
+	return order, nil
+}
+
+// validateReview checks the scores, text and photo references of a new review
+func validateReview(review Review) error {
+	if review.FoodScore < minScore || review.FoodScore > maxScore {
+		return fmt.Errorf("foodScore must be between %d and %d", minScore, maxScore)
+	}
+	if review.DeliveryScore < minScore || review.DeliveryScore > maxScore {
+		return fmt.Errorf("deliveryScore must be between %d and %d", minScore, maxScore)
+	}
+	if utf8.RuneCountInString(review.Text) > maxReviewTextLength {
+		return fmt.Errorf("text must be at most %d characters", maxReviewTextLength)
+	}
+	if len(review.Photos) > maxReviewPhotos {
+		return fmt.Errorf("A review has at most %d photos", maxReviewPhotos)
+	}
+	for _, photo := range review.Photos {
+		if photo == "" || len(photo) > maxPhotoRefLength || strings.ContainsAny(photo, " \t\r\n") {
+			return fmt.Errorf("Invalid photo reference %q", photo)
+		}
+	}
+	return nil
+}
+
+// weightedScore is the average of the scores with each weighted by
+// 2^(-age/halfLife). Every weight decays at the same rate, so the average
+// only changes when reviews are added or moderated and ages are taken
+// relative to the newest review.
+func weightedScore(published []Review, score func(Review) int) float64 {
+	newest := published[0].CreatedAt
+	for _, review := range published {
+		if review.CreatedAt.After(newest) {
+			newest = review.CreatedAt
+		}
+	}
+	sum, weights := 0.0, 0.0
+	for _, review := range published {
+		age := newest.Sub(review.CreatedAt)
+		weight := math.Exp2(-float64(age) / float64(reviewHalfLife))
+		sum += weight * float64(score(review))
+		weights += weight
+	}
+	return math.Round(sum/weights*10) / 10
+}
+
+// recomputeRating updates a restaurant's Rating, DeliveryRating and
+// ReviewCount from its published reviews. Callers hold the mutex.
+func recomputeRating(restaurantID int) {
+	published := []Review{}
+	for _, review := range reviews {
+		if review.RestaurantID == restaurantID && review.Status == reviewPublished {
+			published = append(published, review)
+		}
+	}
+	for i := range restaurants {
+		if restaurants[i].ID != restaurantID {
+			continue
+		}
+		restaurants[i].ReviewCount = len(published)
+		restaurants[i].Rating = 0
+		restaurants[i].DeliveryRating = 0
+		if len(published) > 0 {
+			restaurants[i].Rating = weightedScore(published, func(r Review) int { return r.FoodScore })
+			restaurants[i].DeliveryRating = weightedScore(published, func(r Review) int { return r.DeliveryScore })
+		}
+	}
+}
+
+// findRestaurant returns the index of a restaurant, or -1. Callers hold the mutex.
+func findRestaurant(id int) int {
+	for i, restaurant := range restaurants {
+		if restaurant.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// parseReviewPage reads ?limit= and ?cursor= of a review listing
+func parseReviewPage(r *http.Request) (limit, before int, err error) {
+	limit = defaultReviewsPage
+	if v := r.URL.Query().Get("limit"); v != "" {
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit <= 0 || limit > maxReviewsPage {
+			return 0, 0, fmt.Errorf("limit must be between 1 and %d", maxReviewsPage)
+		}
+	}
+	if v := r.URL.Query().Get("cursor"); v != "" {
+		before, err = strconv.Atoi(v)
+		if err != nil || before <= 0 {
+			return 0, 0, fmt.Errorf("Invalid cursor")
+		}
+	}
+	return limit, before, nil
+}
+
+// reviewPage lists the reviews matching keep, newest first, starting after
+// the review with ID before (0 for the first page). Callers hold the mutex.
+func reviewPage(limit, before int, keep func(Review) bool) ReviewPage {
+	page := ReviewPage{Items: []Review{}}
+	for i := len(reviews) - 1; i >= 0; i-- {
+		review := reviews[i]
+		if before != 0 && review.ID >= before || !keep(review) {
+			continue
+		}
+		if len(page.Items) == limit {
+			cursor := strconv.Itoa(page.Items[limit-1].ID)
+			page.NextCursor = &cursor
+			break
+		}
+		page.Items = append(page.Items, review)
+	}
+	return page
+}
+
+// Review a delivered order. Reviews with only scores are published right
+// away; ones with text or photos wait for moderation.
+func createReview(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	params := mux.Vars(r)
+	restaurantID, err := strconv.Atoi(params["id"])
+	if err != nil {
+		http.Error(w, "Invalid restaurant ID", http.StatusBadRequest)
+		return
+	}
+
+	var review Review
+	err = json.NewDecoder(r.Body).Decode(&review)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	review.Text = strings.TrimSpace(review.Text)
+	if review.OrderID == 0 || review.UserID == 0 {
+		http.Error(w, "orderId and userId are required", http.StatusBadRequest)
+		return
+	}
+	if err := validateReview(review); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Checked before taking the mutex, order-service is a network call away
+	order, err := fetchOrder(review.OrderID)
+	switch {
+	case errors.Is(err, errOrderNotFound):
+		http.Error(w, "Order not found", http.StatusNotFound)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	case order.UserID != review.UserID:
+		http.Error(w, "Only the customer who placed the order can review it", http.StatusForbidden)
+		return
+	case order.RestaurantID != restaurantID:
+		http.Error(w, "The order is from another restaurant", http.StatusBadRequest)
+		return
+	case order.Status != "delivered":
+		http.Error(w, "Only delivered orders can be reviewed", http.StatusConflict)
+		return
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if findRestaurant(restaurantID) < 0 {
+		http.Error(w, "Restaurant not found", http.StatusNotFound)
+		return
+	}
+	for _, existing := range reviews {
+		if existing.OrderID == review.OrderID {
+			http.Error(w, "The order has already been reviewed", http.StatusConflict)
+			return
+		}
+	}
+
+	now := time.Now()
+	review.ID = nextReviewID
+	nextReviewID++
+	review.RestaurantID = restaurantID
+	review.Status = reviewPublished
+	if review.Text != "" || len(review.Photos) > 0 {
+		review.Status = reviewPending
+	}
+	review.ModerationNote = ""
+	review.CreatedAt = now
+	review.UpdatedAt = now
+	reviews = append(reviews, review)
+	recomputeRating(restaurantID)
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(review)
+}
+
+// Get a restaurant's published reviews, newest first. Pass the nextCursor
+// of a page as ?cursor= for the next one.
+func getRestaurantReviews(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	params := mux.Vars(r)
+	restaurantID, err := strconv.Atoi(params["id"])
+	if err != nil {
+		http.Error(w, "Invalid restaurant ID", http.StatusBadRequest)
+		return
+	}
+	limit, before, err := parseReviewPage(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if findRestaurant(restaurantID) < 0 {
+		http.Error(w, "Restaurant not found", http.StatusNotFound)
+		return
+	}
+	json.NewEncoder(w).Encode(reviewPage(limit, before, func(review Review) bool {
+		return review.RestaurantID == restaurantID && review.Status == reviewPublished
+	}))
+}
+
+// Get reviews in any state for moderation, newest first, filtered by
+// ?status= and ?restaurantId=
+func getReviews(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	limit, before, err := parseReviewPage(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	status := r.URL.Query().Get("status")
+	restaurantID := 0
+	if v := r.URL.Query().Get("restaurantId"); v != "" {
+		restaurantID, err = strconv.Atoi(v)
+		if err != nil {
+			http.Error(w, "Invalid restaurant ID", http.StatusBadRequest)
+			return
+		}
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	json.NewEncoder(w).Encode(reviewPage(limit, before, func(review Review) bool {
+		return (status == "" || review.Status == status) && (restaurantID == 0 || review.RestaurantID == restaurantID)
+	}))
+}
+
+// Get the review of an order, if it has one
+func getOrderReview(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	params := mux.Vars(r)
+	orderID, err := strconv.Atoi(params["orderId"])
+	if err != nil {
+		http.Error(w, "Invalid order ID", http.StatusBadRequest)
+		return
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	for _, review := range reviews {
+		if review.OrderID == orderID {
+			json.NewEncoder(w).Encode(review)
+			return
+		}
+	}
+	http.Error(w, "Review not found", http.StatusNotFound)
+}
+
+// Publish or reject a review, with an optional note for the customer. The
+// restaurant's rating is recomputed.
+func moderateReview(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	params := mux.Vars(r)
+	id, err := strconv.Atoi(params["id"])
+	if err != nil {
+		http.Error(w, "Invalid review ID", http.StatusBadRequest)
+		return
+	}
+
+	var moderation struct {
+		Status string `json:"status"`
+		Note   string `json:"note"`
+	}
+	err = json.NewDecoder(r.Body).Decode(&moderation)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	switch moderation.Status {
+	case reviewPending, reviewPublished, reviewRejected:
+	default:
+		http.Error(w, "status must be \"pending\", \"published\" or \"rejected\"", http.StatusBadRequest)
+		return
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	for i := range reviews {
+		if reviews[i].ID == id {
+			reviews[i].Status = moderation.Status
+			reviews[i].ModerationNote = moderation.Note
+			reviews[i].UpdatedAt = time.Now()
+			recomputeRating(reviews[i].RestaurantID)
+			json.NewEncoder(w).Encode(reviews[i])
+			return
+		}
+	}
+	http.Error(w, "Review not found", http.StatusNotFound)
+}
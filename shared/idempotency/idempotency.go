@@ -0,0 +1,204 @@
+// Package idempotency makes HTTP handlers of the QuickBite services safe to
+// retry with an Idempotency-Key header.
+package idempotency
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// KeyTTL is how long a stored response is replayed for before the key can be reused
+const KeyTTL = 24 * time.Hour
+
+// Lease is how long a reservation holds a key while its request is handled.
+// A reservation older than that belongs to a request that died with its
+// process, and a retry takes the key over.
+const Lease = time.Minute
+
+// MaxKeyLength is the longest Idempotency-Key accepted
+const MaxKeyLength = 255
+
+// Record is what is remembered about a request sent with an Idempotency-Key
+type Record struct {
+	Key         string
+	Fingerprint string
+	StatusCode  int // 0 while the request is still being handled
+	Body        []byte
+	CreatedAt   time.Time
+	ReservedAt  time.Time // when the request being handled claimed the key
+}
+
+// Stale reports whether the record is a reservation whose lease ran out
+func (r Record) Stale(now time.Time) bool {
+	return r.StatusCode == 0 && now.Sub(r.ReservedAt) > Lease
+}
+
+// Store remembers responses by Idempotency-Key
+type Store interface {
+	// Reserve claims key for a new request. If the key is already known the
+	// existing record is returned and claimed is false, unless the record is
+	// a stale reservation for the same request, which is claimed again.
+	Reserve(key, fingerprint string) (record Record, claimed bool, err error)
+	// Complete stores the response to replay for key
+	Complete(key string, statusCode int, body []byte) error
+	// Release forgets key so the request can be retried with it
+	Release(key string) error
+}
+
+// Wrap makes a handler safe to retry: a repeat of a request with the same
+// Idempotency-Key gets the original response instead of running again.
+// Reusing a key with a different request body is rejected with 422.
+// Requests without the header are passed through untouched.
+func Wrap(keys Store, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" {
+			next(w, r)
+			return
+		}
+		if len(key) > MaxKeyLength {
+			http.Error(w, "Idempotency-Key is too long", http.StatusBadRequest)
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		// Keys are scoped per endpoint so the same key can't collide across resources
+		scopedKey := r.Method + " " + r.URL.Path + " " + key
+		fingerprint := Fingerprint(body)
+
+		record, claimed, err := keys.Reserve(scopedKey, fingerprint)
+		if err != nil {
+			log.Printf("Idempotency store error: %v", err)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if !claimed {
+			switch {
+			case record.Fingerprint != fingerprint:
+				http.Error(w, "Idempotency-Key was already used with a different request", http.StatusUnprocessableEntity)
+			case record.StatusCode == 0:
+				http.Error(w, "A request with this Idempotency-Key is still being processed", http.StatusConflict)
+			default:
+				w.Header().Set("Content-Type", "application/json")
+				w.Header().Set("Idempotent-Replayed", "true")
+				w.WriteHeader(record.StatusCode)
+				w.Write(record.Body)
+			}
+			return
+		}
+
+		recorder := &responseRecorder{ResponseWriter: w, statusCode: http.StatusOK}
+		next(recorder, r)
+
+		// Server errors are not remembered so the client can retry with the same key
+		if recorder.statusCode >= 500 {
+			err = keys.Release(scopedKey)
+		} else {
+			err = keys.Complete(scopedKey, recorder.statusCode, recorder.body.Bytes())
+		}
+		if err != nil {
+			log.Printf("Error saving idempotency key: %v", err)
+		}
+	}
+}
+
+// Fingerprint hashes a request body. JSON bodies are normalised first so
+// whitespace and key order don't count as a different request.
+func Fingerprint(body []byte) string {
+	var decoded interface{}
+	if err := json.Unmarshal(body, &decoded); err == nil {
+		if normalised, err := json.Marshal(decoded); err == nil {
+			body = normalised
+		}
+	}
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
+
+// responseRecorder passes a response through while keeping a copy of it
+type responseRecorder struct {
+	http.ResponseWriter
+	statusCode  int
+	wroteHeader bool
+	body        bytes.Buffer
+}
+
+func (r *responseRecorder) WriteHeader(statusCode int) {
+	if !r.wroteHeader {
+		r.statusCode = statusCode
+		r.wroteHeader = true
+	}
+	r.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	r.wroteHeader = true
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
+
+// MemoryStore keeps keys in a map; they are lost on restart
+type MemoryStore struct {
+	mutex   sync.Mutex
+	records map[string]Record
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{records: make(map[string]Record)}
+}
+
+func (s *MemoryStore) Reserve(key, fingerprint string) (Record, bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := time.Now()
+	for k, record := range s.records {
+		if now.Sub(record.CreatedAt) > KeyTTL {
+			delete(s.records, k)
+		}
+	}
+
+	record, ok := s.records[key]
+	if ok && !(record.Stale(now) && record.Fingerprint == fingerprint) {
+		return record, false, nil
+	}
+	if ok {
+		record.ReservedAt = now
+	} else {
+		record = Record{Key: key, Fingerprint: fingerprint, CreatedAt: now, ReservedAt: now}
+	}
+	s.records[key] = record
+	return Record{}, true, nil
+}
+
+func (s *MemoryStore) Complete(key string, statusCode int, body []byte) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	record := s.records[key]
+	record.StatusCode = statusCode
+	record.Body = append([]byte(nil), body...)
+	s.records[key] = record
+	return nil
+}
+
+func (s *MemoryStore) Release(key string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	delete(s.records, key)
+	return nil
+}
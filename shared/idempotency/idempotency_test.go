@@ -0,0 +1,92 @@
+package idempotency
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWrap(t *testing.T) {
+	keys := NewMemoryStore()
+	calls := 0
+	handler := Wrap(keys, func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"id":1}`))
+	})
+	send := func(key, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/api/payments", strings.NewReader(body))
+		if key != "" {
+			req.Header.Set("Idempotency-Key", key)
+		}
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+		return rec
+	}
+
+	tests := []struct {
+		name     string
+		key      string
+		body     string
+		status   int
+		replayed bool
+		calls    int
+	}{
+		{"first request", "a", `{"amount": 1, "orderId": 2}`, http.StatusCreated, false, 1},
+		{"replay, reformatted body", "a", `{"orderId":2,"amount":1}`, http.StatusCreated, true, 1},
+		{"same key, other body", "a", `{"orderId":2,"amount":3}`, http.StatusUnprocessableEntity, false, 1},
+		{"other key", "b", `{"orderId":2,"amount":3}`, http.StatusCreated, false, 2},
+		{"no key", "", `{"orderId":2,"amount":3}`, http.StatusCreated, false, 3},
+		{"key too long", strings.Repeat("k", MaxKeyLength+1), `{}`, http.StatusBadRequest, false, 3},
+	}
+	for _, tt := range tests {
+		rec := send(tt.key, tt.body)
+		if rec.Code != tt.status {
+			t.Errorf("%s: status %d, want %d", tt.name, rec.Code, tt.status)
+		}
+		if replayed := rec.Header().Get("Idempotent-Replayed") == "true"; replayed != tt.replayed {
+			t.Errorf("%s: replayed %v, want %v", tt.name, replayed, tt.replayed)
+		}
+		if calls != tt.calls {
+			t.Errorf("%s: handler ran %d times, want %d", tt.name, calls, tt.calls)
+		}
+	}
+}
+
+func TestMemoryStoreLease(t *testing.T) {
+	tests := []struct {
+		name        string
+		reservedAgo time.Duration
+		statusCode  int
+		fingerprint string
+		claimed     bool
+	}{
+		{"request still running", time.Second, 0, "f", false},
+		{"lease ran out", Lease + time.Second, 0, "f", true},
+		{"lease ran out, other request", Lease + time.Second, 0, "g", false},
+		{"completed long ago", Lease + time.Second, http.StatusCreated, "f", false},
+	}
+	for _, tt := range tests {
+		keys := NewMemoryStore()
+		if _, claimed, _ := keys.Reserve("k", "f"); !claimed {
+			t.Fatalf("%s: new key not claimed", tt.name)
+		}
+		record := keys.records["k"]
+		record.ReservedAt = record.ReservedAt.Add(-tt.reservedAgo)
+		record.StatusCode = tt.statusCode
+		keys.records["k"] = record
+
+		_, claimed, err := keys.Reserve("k", tt.fingerprint)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if claimed != tt.claimed {
+			t.Errorf("%s: claimed %v, want %v", tt.name, claimed, tt.claimed)
+		}
+		if claimed && time.Since(keys.records["k"].ReservedAt) > time.Second {
+			t.Errorf("%s: reservation not renewed", tt.name)
+		}
+	}
+}
@@ -0,0 +1,243 @@
+// Package money is the exact money type shared by the QuickBite services.
+package money
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Money is an exact amount of a currency, counted in its minor unit (cents
+// for USD and EUR). Adding and multiplying by quantities never rounds; only
+// applying a percentage or rate does, always half away from zero to the
+// minor unit.
+//
+// In JSON a Money is a plain decimal number in major units (12.99), as
+// amounts were before, so existing clients keep working. The number carries
+// no currency: objects with amounts have their own currency field, and
+// amounts decoded from JSON are in DefaultCurrency.
+type Money struct {
+	Amount   int64  // minor units
+	Currency string // ISO 4217 code
+}
+
+// DefaultCurrency is the currency of amounts read from JSON and
+// configuration. Services set it from their CURRENCY setting at startup.
+var DefaultCurrency = "USD"
+
+// minorUnitDigits lists the currencies whose minor unit isn't a hundredth
+var minorUnitDigits = map[string]int{
+	"JPY": 0,
+	"KRW": 0,
+	"BHD": 3,
+	"KWD": 3,
+	"TND": 3,
+}
+
+func currencyDigits(currency string) int {
+	if digits, ok := minorUnitDigits[currency]; ok {
+		return digits
+	}
+	return 2
+}
+
+func pow10(n int) int64 {
+	result := int64(1)
+	for i := 0; i < n; i++ {
+		result *= 10
+	}
+	return result
+}
+
+// DivRound divides a by b (b > 0) rounding half away from zero
+func DivRound(a, b int64) int64 {
+	if a < 0 {
+		return -((-a + b/2) / b)
+	}
+	return (a + b/2) / b
+}
+
+// New returns amount minor units of currency
+func New(amount int64, currency string) Money {
+	return Money{Amount: amount, Currency: currency}
+}
+
+// Parse reads a decimal amount in major units, e.g. "12.99". Digits
+// beyond the currency's minor unit are rounded half away from zero.
+func Parse(value, currency string) (Money, error) {
+	value = strings.TrimSpace(value)
+	invalid := fmt.Errorf("invalid amount %q", value)
+
+	negative := strings.HasPrefix(value, "-")
+	value = strings.TrimPrefix(value, "-")
+	// Accept exponents (1e2) as JSON numbers may use them
+	if strings.ContainsAny(value, "eE") {
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil || math.IsInf(f, 0) {
+			return Money{}, invalid
+		}
+		value = strconv.FormatFloat(f, 'f', -1, 64)
+	}
+
+	whole, fraction, _ := strings.Cut(value, ".")
+	if whole == "" && fraction == "" {
+		return Money{}, invalid
+	}
+	digits := currencyDigits(currency)
+	// One extra digit decides the rounding
+	padded := fraction + strings.Repeat("0", digits+1)
+	kept, roundDigit := padded[:digits], padded[digits]
+
+	units := int64(0)
+	for _, part := range []string{whole, kept} {
+		for _, c := range part {
+			if c < '0' || c > '9' {
+				return Money{}, invalid
+			}
+			units = units*10 + int64(c-'0')
+			if units > math.MaxInt64/100 {
+				return Money{}, invalid
+			}
+		}
+	}
+	for _, c := range fraction {
+		if c < '0' || c > '9' {
+			return Money{}, invalid
+		}
+	}
+	if roundDigit >= '5' {
+		units++
+	}
+	if negative {
+		units = -units
+	}
+	return Money{Amount: units, Currency: currency}, nil
+}
+
+// with returns the currency two amounts share. An amount with no currency
+// (the zero value) takes the other's. Mixing two currencies is a bug in the
+// caller, not something a request can cause, so it panics.
+func (m Money) with(other Money) string {
+	switch {
+	case m.Currency == "":
+		return other.Currency
+	case other.Currency == "" || other.Currency == m.Currency:
+		return m.Currency
+	}
+	panic(fmt.Sprintf("money: mixing %s and %s", m.Currency, other.Currency))
+}
+
+// Add returns m + other
+func (m Money) Add(other Money) Money {
+	return Money{Amount: m.Amount + other.Amount, Currency: m.with(other)}
+}
+
+// Sub returns m - other
+func (m Money) Sub(other Money) Money {
+	return Money{Amount: m.Amount - other.Amount, Currency: m.with(other)}
+}
+
+// Mul returns m times a quantity
+func (m Money) Mul(quantity int) Money {
+	return Money{Amount: m.Amount * int64(quantity), Currency: m.Currency}
+}
+
+// Neg returns -m
+func (m Money) Neg() Money {
+	return Money{Amount: -m.Amount, Currency: m.Currency}
+}
+
+// Percent returns percent % of m. The percentage is taken to two decimals
+// (basis points) and the result rounded half away from zero.
+func (m Money) Percent(percent float64) Money {
+	basisPoints := int64(math.Round(percent * 100))
+	return Money{Amount: DivRound(m.Amount*basisPoints, 10000), Currency: m.Currency}
+}
+
+// IncludedVAT returns the VAT contained in m, a gross amount taxed at rate
+// percent, rounded half away from zero
+func (m Money) IncludedVAT(rate float64) Money {
+	basisPoints := int64(math.Round(rate * 100))
+	return Money{Amount: DivRound(m.Amount*basisPoints, 10000+basisPoints), Currency: m.Currency}
+}
+
+// Cmp returns -1, 0 or 1 as m is less than, equal to or greater than other
+func (m Money) Cmp(other Money) int {
+	m.with(other)
+	switch {
+	case m.Amount < other.Amount:
+		return -1
+	case m.Amount > other.Amount:
+		return 1
+	}
+	return 0
+}
+
+// Min returns the smaller of two amounts
+func (m Money) Min(other Money) Money {
+	if m.Cmp(other) <= 0 {
+		return m
+	}
+	return other
+}
+
+// IsZero reports whether the amount is zero
+func (m Money) IsZero() bool {
+	return m.Amount == 0
+}
+
+// IsPositive reports whether the amount is above zero
+func (m Money) IsPositive() bool {
+	return m.Amount > 0
+}
+
+// Major returns the amount in major units as a float, for display and
+// for columns that can't hold exact values. Never compute with it.
+func (m Money) Major() float64 {
+	return float64(m.Amount) / float64(pow10(currencyDigits(m.Currency)))
+}
+
+// Decimal formats the amount in major units with the currency's digits, as
+// in JSON and CSV
+func (m Money) Decimal() string {
+	digits := currencyDigits(m.Currency)
+	amount := m.Amount
+	sign := ""
+	if amount < 0 {
+		sign = "-"
+		amount = -amount
+	}
+	if digits == 0 {
+		return sign + strconv.FormatInt(amount, 10)
+	}
+	scale := pow10(digits)
+	return fmt.Sprintf("%s%d.%0*d", sign, amount/scale, digits, amount%scale)
+}
+
+func (m Money) String() string {
+	if m.Currency == "" {
+		return m.Decimal()
+	}
+	return m.Decimal() + " " + m.Currency
+}
+
+// MarshalJSON writes the amount as a decimal number in major units
+func (m Money) MarshalJSON() ([]byte, error) {
+	return []byte(m.Decimal()), nil
+}
+
+// UnmarshalJSON reads a decimal number, or a string holding one, in
+// DefaultCurrency
+func (m *Money) UnmarshalJSON(data []byte) error {
+	if bytes.Equal(data, []byte("null")) {
+		return nil
+	}
+	parsed, err := Parse(strings.Trim(string(data), `"`), DefaultCurrency)
+	if err != nil {
+		return err
+	}
+	*m = parsed
+	return nil
+}
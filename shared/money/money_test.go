@@ -0,0 +1,170 @@
+package money
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		value    string
+		currency string
+		want     int64
+		wantErr  bool
+	}{
+		{"12.99", "USD", 1299, false},
+		{"12", "USD", 1200, false},
+		{"12.", "USD", 1200, false},
+		{".5", "USD", 50, false},
+		{" 3.10 ", "USD", 310, false},
+		{"-4.25", "USD", -425, false},
+		{"0.005", "USD", 1, false},   // half rounds away from zero
+		{"0.0049", "USD", 0, false},  // only the next digit decides
+		{"-0.005", "USD", -1, false}, // away from zero when negative too
+		{"2.675", "USD", 268, false}, // exact, unlike float64
+		{"1e2", "USD", 10000, false},
+		{"1.5E-1", "USD", 15, false},
+		{"1500.4", "JPY", 1500, false},
+		{"1500.5", "JPY", 1501, false},
+		{"1.2345", "KWD", 1235, false},
+		{"", "USD", 0, true},
+		{"-", "USD", 0, true},
+		{".", "USD", 0, true},
+		{"1.2.3", "USD", 0, true},
+		{"12a", "USD", 0, true},
+		{"1.x", "USD", 0, true},
+		{"--1", "USD", 0, true},
+		{"1e400", "USD", 0, true},
+		{"99999999999999999999", "USD", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := Parse(tt.value, tt.currency)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("Parse(%q) = %v, want an error", tt.value, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Parse(%q): %v", tt.value, err)
+			continue
+		}
+		if got.Amount != tt.want || got.Currency != tt.currency {
+			t.Errorf("Parse(%q, %s) = %d %s, want %d", tt.value, tt.currency, got.Amount, got.Currency, tt.want)
+		}
+	}
+}
+
+func TestDivRound(t *testing.T) {
+	tests := []struct {
+		a, b, want int64
+	}{
+		{10, 2, 5},
+		{10, 4, 3}, // 2.5
+		{10, 3, 3},
+		{11, 3, 4}, // 3.67
+		{-10, 4, -3},
+		{-11, 3, -4},
+		{1, 3, 0},
+		{0, 7, 0},
+	}
+	for _, tt := range tests {
+		if got := DivRound(tt.a, tt.b); got != tt.want {
+			t.Errorf("DivRound(%d, %d) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestIncludedVAT(t *testing.T) {
+	tests := []struct {
+		gross int64
+		rate  float64
+		want  int64
+	}{
+		{1190, 19, 190},
+		{1090, 9, 90},
+		{1000, 19, 160}, // 159.66
+		{1299, 9, 107},  // 107.26
+		{2, 19, 0},      // 0.32
+		{3, 19, 0},      // 0.48
+		{4, 19, 1},      // 0.64
+		{-1190, 19, -190},
+		{1000, 0, 0},
+		{1055, 5.5, 55},
+	}
+	for _, tt := range tests {
+		if got := New(tt.gross, "USD").IncludedVAT(tt.rate); got.Amount != tt.want {
+			t.Errorf("IncludedVAT(%d, %v) = %d, want %d", tt.gross, tt.rate, got.Amount, tt.want)
+		}
+	}
+}
+
+func TestPercent(t *testing.T) {
+	tests := []struct {
+		amount  int64
+		percent float64
+		want    int64
+	}{
+		{2000, 10, 200},
+		{1999, 10, 200}, // 199.9
+		{1995, 5, 100},  // 99.75
+		{1050, 12.5, 131},
+		{-1050, 12.5, -131},
+		{1000, 0, 0},
+	}
+	for _, tt := range tests {
+		if got := New(tt.amount, "USD").Percent(tt.percent); got.Amount != tt.want {
+			t.Errorf("Percent(%d, %v) = %d, want %d", tt.amount, tt.percent, got.Amount, tt.want)
+		}
+	}
+}
+
+func TestDecimal(t *testing.T) {
+	tests := []struct {
+		m    Money
+		want string
+	}{
+		{New(1299, "USD"), "12.99"},
+		{New(5, "USD"), "0.05"},
+		{New(-5, "EUR"), "-0.05"},
+		{New(1500, "JPY"), "1500"},
+		{New(1235, "KWD"), "1.235"},
+		{Money{}, "0.00"},
+	}
+	for _, tt := range tests {
+		if got := tt.m.Decimal(); got != tt.want {
+			t.Errorf("%#v.Decimal() = %q, want %q", tt.m, got, tt.want)
+		}
+	}
+}
+
+func TestJSON(t *testing.T) {
+	var decoded struct {
+		Amount  Money  `json:"amount"`
+		Text    Money  `json:"text"`
+		Missing *Money `json:"missing"`
+	}
+	if err := json.Unmarshal([]byte(`{"amount": 12.5, "text": "0.99", "missing": null}`), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Amount != New(1250, DefaultCurrency) || decoded.Text != New(99, DefaultCurrency) || decoded.Missing != nil {
+		t.Errorf("decoded %+v", decoded)
+	}
+
+	data, err := json.Marshal(map[string]Money{"amount": New(1250, "USD")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != `{"amount":12.50}` {
+		t.Errorf("encoded %s", data)
+	}
+}
+
+func TestMixedCurrenciesPanic(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("adding USD to EUR did not panic")
+		}
+	}()
+	New(100, "USD").Add(New(100, "EUR"))
+}